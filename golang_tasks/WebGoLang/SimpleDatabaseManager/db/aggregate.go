@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//aggregateMaxGroups больше групп /_aggregate не отдаёт
+const aggregateMaxGroups = 1000
+
+//aggregateFuncs поддерживаемые агрегаты в порядке их столбцов в ответе
+var aggregateFuncs = []string{"count", "sum", "avg", "min", "max"}
+
+//aggregate один агрегат из запроса: функция и столбец, "*" - вся строка
+type aggregate struct {
+	fn     string
+	column *Column
+}
+
+//alias имя столбца агрегата в ответе: count, count_id, sum_price
+func (ag *aggregate) alias() string {
+	if ag.column == nil {
+		return ag.fn
+	}
+	return ag.fn + "_" + ag.column.Field
+}
+
+//resultColumn метаданные значения агрегата для приведения типов
+func (ag *aggregate) resultColumn() *Column {
+	var typeName string
+	switch {
+	case ag.fn == "count":
+		typeName = "bigint"
+	case ag.fn == "avg":
+		typeName = "double"
+	case ag.fn == "sum" && ag.column.columnType().Kind == KindInt:
+		typeName = "bigint"
+	default:
+		//сумма decimal остаётся decimal, min и max - тип самого столбца
+		typeName = ag.column.Type
+	}
+	return &Column{Field: ag.alias(), Type: typeName, Null: "YES",
+		typ: parseColumnType(typeName)}
+}
+
+//parseAggregates разбирает group_by и агрегаты, проверяя столбцы по tableInfo
+func parseAggregates(tableInfo []*Column,
+	query url.Values) ([]*Column, []*aggregate, error) {
+	groupBy := make([]*Column, 0)
+	for _, names := range query["group_by"] {
+		for _, name := range strings.Split(names, ",") {
+			info := findColumn(tableInfo, name)
+			if info == nil {
+				return nil, nil, fmt.Errorf("unknown column %s", name)
+			}
+			groupBy = append(groupBy, info)
+		}
+	}
+
+	aggregates := make([]*aggregate, 0)
+	for _, fn := range aggregateFuncs {
+		for _, names := range query[fn] {
+			for _, name := range strings.Split(names, ",") {
+				if name == "*" && fn == "count" {
+					aggregates = append(aggregates, &aggregate{fn: fn})
+					continue
+				}
+				info := findColumn(tableInfo, name)
+				if info == nil {
+					return nil, nil, fmt.Errorf("unknown column %s", name)
+				}
+				switch kind := info.columnType().Kind; {
+				case (fn == "sum" || fn == "avg") &&
+					kind != KindInt && kind != KindFloat && kind != KindDecimal:
+					return nil, nil, fmt.Errorf("column %s is not numeric", name)
+				case (fn == "min" || fn == "max") &&
+					(kind == KindBlob || kind == KindJSON):
+					return nil, nil, fmt.Errorf("column %s is not comparable", name)
+				}
+				aggregates = append(aggregates, &aggregate{fn: fn, column: info})
+			}
+		}
+	}
+	if len(aggregates) == 0 {
+		return nil, nil, fmt.Errorf("nothing to aggregate")
+	}
+
+	//столбцы ответа по имени: агрегат с именем столбца группировки
+	//или повтор агрегата затёр бы значение
+	names := make(map[string]bool)
+	for _, info := range groupBy {
+		names[info.Field] = true
+	}
+	for _, ag := range aggregates {
+		if names[ag.alias()] {
+			return nil, nil, fmt.Errorf("duplicate column %s", ag.alias())
+		}
+		names[ag.alias()] = true
+	}
+	return groupBy, aggregates, nil
+}
+
+//aggregateTable GET /{table}/_aggregate?group_by=updated&count=*&sum=price -
+//агрегаты по группам с теми же фильтрами where, что и в листинге
+func (dbex *DBExplorer) aggregateTable(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	tableName := params["table"]
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	tp, err := dbex.checkRead(sc, req, tableName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	query := req.URL.Query()
+	visible := tp.visible(tableInfo)
+	groupBy, aggregates, err := parseAggregates(visible, query)
+	if err != nil {
+		writeError(w, APIError{http.StatusBadRequest, err})
+		return
+	}
+	lq, err := dbex.parseListQuery(visible, url.Values{"where": query["where"]})
+	if err != nil {
+		writeError(w, APIError{http.StatusBadRequest, err})
+		return
+	}
+	dbex.hideDeleted(lq, tableInfo, query)
+
+	limit := aggregateMaxGroups
+	if lim, err := strconv.Atoi(query.Get("limit")); err == nil && lim > 0 && lim < limit {
+		limit = lim
+	}
+
+	//столбцы ответа: сначала группировка, потом агрегаты
+	resultInfo := make([]*Column, 0, len(groupBy)+len(aggregates))
+	groups := make([]string, 0, len(groupBy))
+	selects := make([]string, 0, len(groupBy)+len(aggregates))
+	for _, info := range groupBy {
+		column := dbex.dialect.Quote(info.dbName())
+		groups = append(groups, column)
+		selects = append(selects, column)
+		resultInfo = append(resultInfo, info)
+	}
+	for _, ag := range aggregates {
+		arg := "*"
+		if ag.column != nil {
+			arg = dbex.dialect.Quote(ag.column.dbName())
+		}
+		selects = append(selects, strings.ToUpper(ag.fn)+"("+arg+") AS "+
+			dbex.dialect.Quote(ag.alias()))
+		resultInfo = append(resultInfo, ag.resultColumn())
+	}
+
+	sqlReq := "SELECT " + strings.Join(selects, ", ") +
+		" FROM " + dbex.quoteTable(sc, tableName)
+	if len(lq.where) != 0 {
+		sqlReq += " WHERE " + strings.Join(lq.where, " AND ")
+	}
+	if len(groups) != 0 {
+		sqlReq += " GROUP BY " + strings.Join(groups, ", ") +
+			" ORDER BY " + strings.Join(groups, ", ")
+	}
+	sqlReq += " LIMIT " + strconv.Itoa(limit)
+
+	rows, err := dbex.conn(req).Query(sqlReq, lq.args.values...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	records, err := dbex.readDBData(rows, resultInfo)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": map[string]interface{}{
+			"records": records}})
+	w.Write(jsonRes)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//AuditEntry одно изменение записи в журнале
+type AuditEntry struct {
+	Time  time.Time `json:"time"`
+	Table string    `json:"table"`
+	//Key id записи в том виде, в каком он идёт в URL
+	Key string `json:"key"`
+	//Action create, update или delete
+	Action    string `json:"action"`
+	Subject   string `json:"subject,omitempty"`
+	Role      string `json:"role,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	//Before и After строка до и после изменения, nil - строки не было
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+}
+
+//AuditSink куда пишется журнал изменений
+type AuditSink interface {
+	//Record сохраняет запись журнала. db - транзакция, в которой
+	//выполнено изменение, вызывается до её коммита
+	Record(db sqlExecutor, entry *AuditEntry) error
+	//History изменения записи key таблицы table от старых к новым
+	History(db sqlExecutor, table string, key string) ([]*AuditEntry, error)
+}
+
+//AuditFile журнал в файле, по JSON-строке на изменение. Запись в файл
+//не откатывается вместе с транзакцией, поэтому при сбое коммита в журнале
+//может остаться изменение, которого нет в базе
+type AuditFile struct {
+	path string
+	mu   *sync.Mutex
+	file *os.File
+}
+
+//OpenAuditFile открывает файл журнала на дозапись
+func OpenAuditFile(path string) (*AuditFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditFile{path: path, mu: &sync.Mutex{}, file: file}, nil
+}
+
+//Record дописывает изменение в конец файла
+func (af *AuditFile) Record(db sqlExecutor, entry *AuditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	af.mu.Lock()
+	defer af.mu.Unlock()
+	_, err = af.file.Write(append(line, '\n'))
+	return err
+}
+
+//History перечитывает файл целиком и отбирает изменения записи
+func (af *AuditFile) History(db sqlExecutor, table string,
+	key string) ([]*AuditEntry, error) {
+	file, err := os.Open(af.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]*AuditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		entry := &AuditEntry{}
+		//недописанную при падении строку пропускаем
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			continue
+		}
+		if entry.Table == table && entry.Key == key {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+//Close закрывает файл журнала
+func (af *AuditFile) Close() error {
+	return af.file.Close()
+}
+
+//AuditTable журнал в таблице той же базы. Изменение и запись о нём
+//коммитятся одной транзакцией. Таблица создаётся в EnableAudit
+//и не отдаётся через API
+type AuditTable struct {
+	Name    string
+	dialect Dialect
+}
+
+//ddl запросы, создающие таблицу журнала
+func (at *AuditTable) ddl() []string {
+	name := at.dialect.Quote(at.Name)
+	index := at.dialect.Quote(at.Name + "_record")
+	columns := `
+  changed_at VARCHAR(64) NOT NULL,
+  table_name VARCHAR(255) NOT NULL,
+  record_key VARCHAR(255) NOT NULL,
+  action VARCHAR(16) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  role VARCHAR(255) NOT NULL,
+  request_id VARCHAR(64) NOT NULL,`
+
+	switch at.dialect.Name() {
+	case "mysql":
+		return []string{"CREATE TABLE IF NOT EXISTS " + name + ` (
+  id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,` + columns + `
+  before_data LONGTEXT,
+  after_data LONGTEXT,
+  KEY ` + index + ` (table_name, record_key)
+)`}
+	case "postgres":
+		return []string{"CREATE TABLE IF NOT EXISTS " + name + ` (
+  id BIGSERIAL PRIMARY KEY,` + columns + `
+  before_data TEXT,
+  after_data TEXT
+)`, "CREATE INDEX IF NOT EXISTS " + index + " ON " + name +
+			" (table_name, record_key)"}
+	}
+	return []string{"CREATE TABLE IF NOT EXISTS " + name + ` (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,` + columns + `
+  before_data TEXT,
+  after_data TEXT
+)`, "CREATE INDEX IF NOT EXISTS " + index + " ON " + name +
+		" (table_name, record_key)"}
+}
+
+//auditImage строка в виде JSON для столбца журнала, NULL - строки не было
+func auditImage(record map[string]interface{}) (interface{}, error) {
+	if record == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+//Record вставляет изменение в таблицу журнала
+func (at *AuditTable) Record(db sqlExecutor, entry *AuditEntry) error {
+	before, err := auditImage(entry.Before)
+	if err != nil {
+		return err
+	}
+	after, err := auditImage(entry.After)
+	if err != nil {
+		return err
+	}
+
+	args := &sqlArgs{dialect: at.dialect}
+	_, err = db.Exec("INSERT INTO "+at.dialect.Quote(at.Name)+
+		" (changed_at, table_name, record_key, action, subject, role, request_id,"+
+		" before_data, after_data) VALUES ("+
+		args.add(entry.Time.Format(time.RFC3339Nano))+", "+args.add(entry.Table)+", "+
+		args.add(entry.Key)+", "+args.add(entry.Action)+", "+args.add(entry.Subject)+", "+
+		args.add(entry.Role)+", "+args.add(entry.RequestID)+", "+
+		args.add(before)+", "+args.add(after)+")", args.values...)
+	return err
+}
+
+//History читает изменения записи в порядке их вставки
+func (at *AuditTable) History(db sqlExecutor, table string,
+	key string) ([]*AuditEntry, error) {
+	args := &sqlArgs{dialect: at.dialect}
+	rows, err := db.Query("SELECT changed_at, action, subject, role, request_id,"+
+		" before_data, after_data FROM "+at.dialect.Quote(at.Name)+
+		" WHERE table_name = "+args.add(table)+" AND record_key = "+args.add(key)+
+		" ORDER BY id", args.values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]*AuditEntry, 0)
+	for rows.Next() {
+		entry := &AuditEntry{Table: table, Key: key}
+		var changedAt string
+		var before, after sql.NullString
+		if err := rows.Scan(&changedAt, &entry.Action, &entry.Subject, &entry.Role,
+			&entry.RequestID, &before, &after); err != nil {
+			return nil, err
+		}
+		entry.Time, _ = time.Parse(time.RFC3339Nano, changedAt)
+		if before.Valid {
+			json.Unmarshal([]byte(before.String), &entry.Before)
+		}
+		if after.Valid {
+			json.Unmarshal([]byte(after.String), &entry.After)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+//EnableAudit включает журнал изменений. Для AuditTable создаёт таблицу
+//журнала и перечитывает схему, чтобы убрать её из API
+func (dbex *DBExplorer) EnableAudit(sink AuditSink) error {
+	at, ok := sink.(*AuditTable)
+	if !ok {
+		dbex.audit = sink
+		return nil
+	}
+
+	at.dialect = dbex.dialect
+	for _, query := range at.ddl() {
+		if _, err := dbex.DB.Exec(query); err != nil {
+			return fmt.Errorf("audit table %s: %v", at.Name, err)
+		}
+	}
+	dbex.audit = sink
+	_, err := dbex.reload(context.Background())
+	return err
+}
+
+//auditTable имя таблицы журнала, пусто - журнал не в базе
+func (dbex *DBExplorer) auditTable() string {
+	if at, ok := dbex.audit.(*AuditTable); ok {
+		return at.Name
+	}
+	return ""
+}
+
+//audited выполняет изменение fn записи id в db и пишет его в журнал.
+//Для create id пустой, ключ берётся из ответа fn
+func (dbex *DBExplorer) audited(ctx context.Context, sc *dbSchema, db sqlExecutor,
+	tableName string, id string, action string,
+	fn func() (map[string]interface{}, error)) (map[string]interface{}, error) {
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if dbex.audit == nil || !ok || len(primaryKeys(tableInfo)) == 0 {
+		return fn()
+	}
+
+	var before map[string]interface{}
+	if id != "" {
+		record, err := dbex.fetchRecord(sc, db, tableName, tableInfo, id, true)
+		if err != nil {
+			return nil, err
+		}
+		before = record
+	}
+
+	res, err := fn()
+	if err != nil {
+		return nil, err
+	}
+
+	key := id
+	if action == "create" {
+		key = recordID(tableInfo, res)
+	}
+	after, err := dbex.fetchRecord(sc, db, tableName, tableInfo, key, false)
+	if err != nil {
+		return nil, err
+	}
+	if before == nil && after == nil {
+		//записи не было и нет, менять было нечего
+		return res, nil
+	}
+	if before != nil {
+		key = recordID(tableInfo, before)
+	}
+	if action == "upsert" {
+		//в журнале upsert выглядит как обычное создание или обновление
+		action = "update"
+		if before == nil {
+			action = "create"
+		}
+	}
+
+	entry := &AuditEntry{
+		Time:      time.Now().UTC(),
+		Table:     tableName,
+		Key:       key,
+		Action:    action,
+		RequestID: requestIDFrom(ctx),
+		Before:    before,
+		After:     after,
+	}
+	if ident := identityFrom(ctx); ident != nil {
+		entry.Subject = ident.Subject
+		entry.Role = ident.Role
+	}
+	if err := dbex.audit.Record(db, entry); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//recordHistory GET /{table}/{id}/_history - журнал изменений записи
+func (dbex *DBExplorer) recordHistory(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	tableName := params["table"]
+	if _, ok := sc.tablesInfo[tableName]; !ok {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	tp, err := dbex.checkRead(sc, req, tableName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if dbex.audit == nil {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("audit is disabled")})
+		return
+	}
+
+	entries, err := dbex.audit.History(dbex.conn(req), tableName, params["id"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, entry := range entries {
+		for _, image := range []map[string]interface{}{entry.Before, entry.After} {
+			if image != nil {
+				tp.strip([]map[string]interface{}{image})
+			}
+		}
+	}
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": map[string]interface{}{
+			"history": entries}})
+	w.Write(jsonRes)
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Identity кто делает запрос
+type Identity struct {
+	Subject string `json:"sub"`
+	Role    string `json:"role"`
+	//Expires unix-время истечения токена, 0 - бессрочно
+	Expires int64 `json:"exp,omitempty"`
+}
+
+//TablePolicy права роли на таблицу
+type TablePolicy struct {
+	Read  bool `json:"read"`
+	Write bool `json:"write"`
+	//Hidden столбцы, которые роль не видит и не может менять
+	Hidden []string `json:"hidden"`
+	//ReadOnly столбцы, которые роль видит, но не может менять
+	ReadOnly []string `json:"read_only"`
+	//WriteOnly столбцы, которые роль может менять, но не видит
+	WriteOnly []string `json:"write_only"`
+}
+
+//RolePolicy права роли, таблица "*" задаёт права по-умолчанию
+type RolePolicy struct {
+	Admin  bool                    `json:"admin"`
+	Tables map[string]*TablePolicy `json:"tables"`
+}
+
+//AuthConfig настройки аутентификации и политика доступа к таблицам
+type AuthConfig struct {
+	//APIKeys статические ключи из заголовка X-API-Key
+	APIKeys map[string]*Identity `json:"api_keys"`
+	//TokenSecret ключ HMAC для bearer-токенов из заголовка Authorization
+	TokenSecret string                 `json:"token_secret"`
+	Roles       map[string]*RolePolicy `json:"roles"`
+}
+
+//LoadAuthConfig читает настройки доступа из JSON-файла
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &AuthConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("auth config %s: %v", path, err)
+	}
+	for key, ident := range cfg.APIKeys {
+		//сам ключ в ошибку и лог не попадает, только его короткий хэш
+		sum := sha256.Sum256([]byte(key))
+		switch {
+		case ident == nil:
+			return nil, fmt.Errorf("auth config %s: api key sha256:%s: no identity",
+				path, hex.EncodeToString(sum[:4]))
+		case cfg.Roles[ident.Role] == nil:
+			return nil, fmt.Errorf("auth config %s: api key sha256:%s of %s: unknown role %s",
+				path, hex.EncodeToString(sum[:4]), ident.Subject, ident.Role)
+		}
+	}
+	return cfg, nil
+}
+
+//SignToken выпускает bearer-токен вида base64(payload).base64(hmac)
+func SignToken(secret string, ident *Identity) string {
+	payload, _ := json.Marshal(ident)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//verifyToken проверяет подпись и срок действия токена
+func verifyToken(secret string, token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || secret == "" {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	sign, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	if !hmac.Equal(sign, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	ident := &Identity{}
+	if err := json.Unmarshal(payload, ident); err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if ident.Expires != 0 && time.Now().Unix() > ident.Expires {
+		return nil, fmt.Errorf("token expired")
+	}
+	return ident, nil
+}
+
+//authenticate находит Identity по X-API-Key или Authorization: Bearer
+func (cfg *AuthConfig) authenticate(req *http.Request) (*Identity, error) {
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return cfg.apiKey(key)
+	}
+
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return verifyToken(cfg.TokenSecret, strings.TrimPrefix(auth, "Bearer "))
+	}
+	return nil, fmt.Errorf("unauthorized")
+}
+
+//uiRealm заголовок WWW-Authenticate админки
+const uiRealm = `Basic realm="DBExplorer", charset="UTF-8"`
+
+//authenticateUI как authenticate, но принимает ещё и Authorization: Basic
+//с API-ключом или bearer-токеном в пароле: браузер не умеет слать
+//X-API-Key, а Basic спрашивает сам. Имя пользователя не проверяется
+func (cfg *AuthConfig) authenticateUI(req *http.Request) (*Identity, error) {
+	_, password, ok := req.BasicAuth()
+	if !ok {
+		return cfg.authenticate(req)
+	}
+	if ident, err := cfg.apiKey(password); err == nil {
+		return ident, nil
+	}
+	if ident, err := verifyToken(cfg.TokenSecret, password); err == nil {
+		return ident, nil
+	}
+	return nil, fmt.Errorf("invalid credentials")
+}
+
+//apiKey Identity статического ключа key
+func (cfg *AuthConfig) apiKey(key string) (*Identity, error) {
+	for known, ident := range cfg.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(known)) == 1 {
+			return ident, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid api key")
+}
+
+//identityFrom достаёт Identity, положенную в контекст при аутентификации
+func identityFrom(ctx context.Context) *Identity {
+	ident, _ := ctx.Value(identityKey).(*Identity)
+	return ident
+}
+
+//withAuth пропускает дальше только аутентифицированные запросы
+func (dbex *DBExplorer) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if dbex.Auth == nil {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		//Basic принимается только админкой: формы в ней защищены
+		//CSRF-токеном, а API браузер с запомненным паролем мог бы
+		//вызвать с чужой страницы
+		authenticate := dbex.Auth.authenticate
+		ui := isUIRoute(req)
+		if ui {
+			authenticate = dbex.Auth.authenticateUI
+		}
+		ident, err := authenticate(req)
+		if err != nil {
+			if ui {
+				w.Header().Set("WWW-Authenticate", uiRealm)
+			}
+			writeError(w, APIError{http.StatusUnauthorized, err})
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(
+			context.WithValue(req.Context(), identityKey, ident)))
+	})
+}
+
+//allowAll политика, когда аутентификация выключена
+var allowAll = &TablePolicy{Read: true, Write: true}
+
+//tablePolicy права текущего пользователя на таблицу вместе
+//с ограничениями столбцов из Config
+func (dbex *DBExplorer) tablePolicy(sc *dbSchema, req *http.Request,
+	tableName string) *TablePolicy {
+	tp := dbex.rolePolicy(req, tableName)
+	if access, ok := sc.access[tableName]; ok {
+		return tp.merge(access)
+	}
+	return tp
+}
+
+//rolePolicy права роли текущего пользователя на таблицу
+func (dbex *DBExplorer) rolePolicy(req *http.Request, tableName string) *TablePolicy {
+	if dbex.Auth == nil {
+		return allowAll
+	}
+
+	ident := identityFrom(req.Context())
+	if ident == nil {
+		return &TablePolicy{}
+	}
+	role, ok := dbex.Auth.Roles[ident.Role]
+	if !ok {
+		return &TablePolicy{}
+	}
+	if tp, ok := role.Tables[tableName]; ok {
+		return tp
+	}
+	if tp, ok := role.Tables["*"]; ok {
+		return tp
+	}
+	return &TablePolicy{}
+}
+
+//isAdmin может ли текущий пользователь вызывать служебные методы
+func (dbex *DBExplorer) isAdmin(req *http.Request) bool {
+	if dbex.Auth == nil {
+		return true
+	}
+	ident := identityFrom(req.Context())
+	if ident == nil {
+		return false
+	}
+	role, ok := dbex.Auth.Roles[ident.Role]
+	return ok && role.Admin
+}
+
+//checkRead проверяет право на чтение таблицы
+func (dbex *DBExplorer) checkRead(sc *dbSchema, req *http.Request,
+	tableName string) (*TablePolicy, error) {
+	tp := dbex.tablePolicy(sc, req, tableName)
+	if !tp.Read {
+		return nil, APIError{http.StatusForbidden,
+			fmt.Errorf("access to table %s denied", tableName)}
+	}
+	return tp, nil
+}
+
+//checkWrite проверяет право на запись в таблицу и в переданные поля
+func (dbex *DBExplorer) checkWrite(sc *dbSchema, req *http.Request, tableName string,
+	body map[string]interface{}) error {
+	tp := dbex.tablePolicy(sc, req, tableName)
+	if !tp.Write {
+		return APIError{http.StatusForbidden,
+			fmt.Errorf("access to table %s denied", tableName)}
+	}
+	for field := range body {
+		if !tp.isWritable(field) {
+			return APIError{http.StatusForbidden,
+				fmt.Errorf("field %s is read-only", field)}
+		}
+	}
+	return nil
+}
+
+//merge политика tp с добавленными ограничениями столбцов other
+func (tp *TablePolicy) merge(other *TablePolicy) *TablePolicy {
+	return &TablePolicy{
+		Read:      tp.Read,
+		Write:     tp.Write,
+		Hidden:    append(append([]string{}, tp.Hidden...), other.Hidden...),
+		ReadOnly:  append(append([]string{}, tp.ReadOnly...), other.ReadOnly...),
+		WriteOnly: append(append([]string{}, tp.WriteOnly...), other.WriteOnly...),
+	}
+}
+
+//isHidden столбец не виден: скрыт или доступен только на запись
+func (tp *TablePolicy) isHidden(field string) bool {
+	for _, hidden := range tp.Hidden {
+		if hidden == field {
+			return true
+		}
+	}
+	return tp.isWriteOnly(field)
+}
+
+//isWritable столбец можно менять: виден и не только для чтения
+//или доступен только на запись
+func (tp *TablePolicy) isWritable(field string) bool {
+	if tp.isReadOnly(field) {
+		return false
+	}
+	return !tp.isHidden(field) || tp.isWriteOnly(field)
+}
+
+func (tp *TablePolicy) isWriteOnly(field string) bool {
+	for _, writeOnly := range tp.WriteOnly {
+		if writeOnly == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (tp *TablePolicy) isReadOnly(field string) bool {
+	for _, readOnly := range tp.ReadOnly {
+		if readOnly == field {
+			return true
+		}
+	}
+	return false
+}
+
+//visible столбцы таблицы без скрытых
+func (tp *TablePolicy) visible(tableInfo []*Column) []*Column {
+	if len(tp.Hidden) == 0 && len(tp.WriteOnly) == 0 {
+		return tableInfo
+	}
+	columns := make([]*Column, 0, len(tableInfo))
+	for _, info := range tableInfo {
+		if !tp.isHidden(info.Field) {
+			columns = append(columns, info)
+		}
+	}
+	return columns
+}
+
+//strip убирает скрытые столбцы из записей
+func (tp *TablePolicy) strip(records []map[string]interface{}) {
+	for _, record := range records {
+		for _, hidden := range tp.Hidden {
+			delete(record, hidden)
+		}
+		for _, writeOnly := range tp.WriteOnly {
+			delete(record, writeOnly)
+		}
+	}
+}
+
+//checkExpand проверяет доступ к таблицам, которые раскрываются через expand
+//из таблицы tableName. Связь по скрытому от роли столбцу выдала бы его
+//значение, поэтому для роли её нет, как и связей по столбцам, скрытым в Config
+func (dbex *DBExplorer) checkExpand(sc *dbSchema, req *http.Request, tableName string,
+	fks []*ForeignKey) (map[string]*TablePolicy, error) {
+	source := dbex.tablePolicy(sc, req, tableName)
+	policies := make(map[string]*TablePolicy)
+	for _, fk := range fks {
+		if source.isHidden(fk.Column) {
+			return nil, APIError{http.StatusBadRequest,
+				fmt.Errorf("unknown relation %s", fk.Relation())}
+		}
+		tp, err := dbex.checkRead(sc, req, fk.RefTable)
+		if err != nil {
+			return nil, err
+		}
+		policies[fk.Relation()] = tp
+	}
+	return policies, nil
+}
+
+//stripExpanded убирает скрытые столбцы из раскрытых связей
+func stripExpanded(records []map[string]interface{},
+	policies map[string]*TablePolicy) {
+	for relation, tp := range policies {
+		for _, record := range records {
+			if row, ok := record[relation].(map[string]interface{}); ok {
+				tp.strip([]map[string]interface{}{row})
+			}
+		}
+	}
+}
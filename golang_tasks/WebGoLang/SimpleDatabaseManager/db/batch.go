@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+//BatchOperation одна операция из тела POST /_batch
+type BatchOperation struct {
+	Op    string                 `json:"op"`
+	Table string                 `json:"table"`
+	ID    interface{}            `json:"id"`
+	Body  map[string]interface{} `json:"body"`
+}
+
+//batch выполняет операции из тела запроса в одной транзакции,
+//на первой же ошибке транзакция откатывается целиком
+func (dbex *DBExplorer) batch(w http.ResponseWriter, r *http.Request) {
+	sc := dbex.schema()
+	defer r.Body.Close()
+
+	ops := make([]*BatchOperation, 0)
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&ops); err != nil {
+		writeError(w, APIError{http.StatusBadRequest,
+			fmt.Errorf("invalid batch")})
+		return
+	}
+
+	tx, err := dbex.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	results := make([]map[string]interface{}, 0, len(ops))
+	for idx, op := range ops {
+		err := dbex.checkWrite(sc, r, op.Table, op.Body)
+		var res map[string]interface{}
+		if err == nil {
+			res, err = dbex.execOperation(r.Context(), sc, withContext(r.Context(), tx), op)
+		}
+		if err != nil {
+			tx.Rollback()
+			writeErrorWith(w, err, map[string]interface{}{"index": idx})
+			return
+		}
+		results = append(results, res)
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, err)
+		return
+	}
+	recordRows(w, batchRows(ops, results))
+	for idx, op := range ops {
+		dbex.publishChange(sc, op.Table, fmt.Sprint(op.ID), op.Op, results[idx])
+	}
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": map[string]interface{}{
+			"results": results}})
+	w.Write(jsonRes)
+}
+
+//batchRows сколько строк затронули операции батча
+func batchRows(ops []*BatchOperation, results []map[string]interface{}) int64 {
+	var rows int64
+	for idx, op := range ops {
+		switch op.Op {
+		case "create":
+			rows++
+		case "update":
+			rows += results[idx]["updated"].(int64)
+		case "delete":
+			rows += results[idx]["deleted"].(int64)
+		}
+	}
+	return rows
+}
+
+//execOperation выполняет одну операцию батча через те же функции,
+//что и обычные хэндлеры, и пишет её в журнал
+func (dbex *DBExplorer) execOperation(ctx context.Context, sc *dbSchema, db sqlExecutor,
+	op *BatchOperation) (map[string]interface{}, error) {
+	id := ""
+	if op.ID != nil {
+		id = fmt.Sprint(op.ID)
+	}
+
+	var fn func() (map[string]interface{}, error)
+	switch op.Op {
+	case "create":
+		fn = func() (map[string]interface{}, error) {
+			return dbex.insertRecord(sc, db, op.Table, op.Body)
+		}
+	case "update":
+		fn = func() (map[string]interface{}, error) {
+			return dbex.modifyRecord(sc, db, op.Table, id, op.Body)
+		}
+	case "delete":
+		fn = func() (map[string]interface{}, error) {
+			return dbex.removeRecord(sc, db, op.Table, id)
+		}
+	default:
+		return nil, APIError{http.StatusBadRequest,
+			fmt.Errorf("unknown operation %s", op.Op)}
+	}
+	if op.Op != "create" && id == "" {
+		return nil, APIError{http.StatusBadRequest, fmt.Errorf("id is required")}
+	}
+	return dbex.audited(ctx, sc, db, op.Table, id, op.Op, fn)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//CacheStats счётчики кэша ответов
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	//Invalidations сколько ответов сброшено из-за изменения таблиц
+	Invalidations int64 `json:"invalidations"`
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+	MaxBytes      int64 `json:"max_bytes"`
+}
+
+//cacheEntry сохранённый ответ
+type cacheEntry struct {
+	key     string
+	tables  []string
+	header  http.Header
+	body    []byte
+	size    int64
+	expires time.Time
+}
+
+//ResponseCache LRU-кэш ответов GET /{table} и GET /{table}/{id}.
+//Ответы таблицы сбрасываются после успешного изменения через API любой
+//её записи или записи таблицы, на которую она ссылается внешним ключом,
+//изменения в обход API видны по истечении TTL
+type ResponseCache struct {
+	//MaxBytes сколько байт ответов держать, самые давние вытесняются
+	MaxBytes int64
+	//TTL сколько живёт ответ, если у таблицы в Config нет cache_ttl
+	TTL time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	//byTable ключи ответов, которые зависят от таблицы
+	byTable map[string]map[string]struct{}
+	//generations растут при каждом сбросе таблицы: ответ, прочитанный
+	//до изменения, не должен попасть в кэш после сброса
+	generations map[string]uint64
+	//epoch растёт при Purge
+	epoch uint64
+	bytes int64
+	stats CacheStats
+}
+
+//NewResponseCache кэш на maxBytes байт ответов, живущих ttl
+func NewResponseCache(maxBytes int64, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		MaxBytes:    maxBytes,
+		TTL:         ttl,
+		lru:         list.New(),
+		entries:     make(map[string]*list.Element),
+		byTable:     make(map[string]map[string]struct{}),
+		generations: make(map[string]uint64),
+	}
+}
+
+//get ответ по ключу, просроченный удаляется
+func (rc *ResponseCache) get(key string) *cacheEntry {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	elem, ok := rc.entries[key]
+	if ok && time.Now().After(elem.Value.(*cacheEntry).expires) {
+		rc.remove(elem)
+		ok = false
+	}
+	if !ok {
+		rc.stats.Misses++
+		return nil
+	}
+	rc.stats.Hits++
+	rc.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+//generation версия набора таблиц на момент начала чтения
+func (rc *ResponseCache) generation(tables []string) uint64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.tablesGeneration(tables)
+}
+
+//tablesGeneration версия набора таблиц, mu должен быть захвачен
+func (rc *ResponseCache) tablesGeneration(tables []string) uint64 {
+	gen := rc.epoch
+	for _, table := range tables {
+		gen += rc.generations[table]
+	}
+	return gen
+}
+
+//put сохраняет ответ, если его таблицы не менялись с generation gen
+func (rc *ResponseCache) put(entry *cacheEntry, gen uint64, ttl time.Duration) {
+	entry.size = int64(len(entry.key) + len(entry.body))
+	for name, values := range entry.header {
+		for _, value := range values {
+			entry.size += int64(len(name) + len(value))
+		}
+	}
+	entry.expires = time.Now().Add(ttl)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.tablesGeneration(entry.tables) != gen || entry.size > rc.MaxBytes || ttl <= 0 {
+		return
+	}
+
+	if elem, ok := rc.entries[entry.key]; ok {
+		rc.remove(elem)
+	}
+	for rc.bytes+entry.size > rc.MaxBytes {
+		rc.remove(rc.lru.Back())
+		rc.stats.Evictions++
+	}
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	rc.bytes += entry.size
+	for _, table := range entry.tables {
+		if rc.byTable[table] == nil {
+			rc.byTable[table] = make(map[string]struct{})
+		}
+		rc.byTable[table][entry.key] = struct{}{}
+	}
+}
+
+//remove убирает ответ из кэша, mu должен быть захвачен
+func (rc *ResponseCache) remove(elem *list.Element) {
+	entry := rc.lru.Remove(elem).(*cacheEntry)
+	delete(rc.entries, entry.key)
+	rc.bytes -= entry.size
+	for _, table := range entry.tables {
+		delete(rc.byTable[table], entry.key)
+		if len(rc.byTable[table]) == 0 {
+			delete(rc.byTable, table)
+		}
+	}
+}
+
+//invalidate сбрасывает все ответы, которые зависят от таблицы
+func (rc *ResponseCache) invalidate(table string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.generations[table]++
+	for key := range rc.byTable[table] {
+		rc.remove(rc.entries[key])
+		rc.stats.Invalidations++
+	}
+}
+
+//invalidateTable сбрасывает ответы таблицы и всех таблиц, которые ссылаются
+//на неё внешними ключами, напрямую или через другие таблицы: ON DELETE
+//CASCADE и SET NULL меняют их записи без запроса к ним, а в их ответах
+//с expand видна изменённая запись
+func (dbex *DBExplorer) invalidateTable(sc *dbSchema, tableName string) {
+	foreignKeys := sc.foreignKeys
+	seen := map[string]bool{tableName: true}
+	queue := []string{tableName}
+	for len(queue) != 0 {
+		table := queue[0]
+		queue = queue[1:]
+		dbex.Cache.invalidate(table)
+		for child, fks := range foreignKeys {
+			for _, fk := range fks {
+				if fk.RefTable == table && !seen[child] {
+					seen[child] = true
+					queue = append(queue, child)
+				}
+			}
+		}
+	}
+}
+
+//Purge очищает кэш целиком, например после перезагрузки схемы
+func (rc *ResponseCache) Purge() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.epoch++
+	rc.lru.Init()
+	rc.entries = make(map[string]*list.Element)
+	rc.byTable = make(map[string]map[string]struct{})
+	rc.bytes = 0
+}
+
+//Stats текущие счётчики кэша
+func (rc *ResponseCache) Stats() CacheStats {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	stats := rc.stats
+	stats.Entries = len(rc.entries)
+	stats.Bytes = rc.bytes
+	stats.MaxBytes = rc.MaxBytes
+	return stats
+}
+
+//cacheRecorder копит ответ хэндлера, чтобы сохранить его в кэш
+type cacheRecorder struct {
+	http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *cacheRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *cacheRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(data)
+}
+
+func (rec *cacheRecorder) recordError(err error) {
+	if er, ok := rec.ResponseWriter.(errorRecorder); ok {
+		er.recordError(err)
+	}
+}
+
+//writeResponse отдаёт ответ клиенту, на совпавший If-None-Match - 304
+func writeResponse(w http.ResponseWriter, req *http.Request, header http.Header,
+	status int, body []byte) {
+	for name, values := range header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	etag := header.Get("ETag")
+	if inm := req.Header.Get("If-None-Match"); status == http.StatusOK &&
+		etag != "" && inm != "" && etagMatches(inm, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+//cacheKey ключ ответа: роль, путь и параметры запроса в порядке имён
+func cacheKey(req *http.Request) string {
+	role := ""
+	if ident := identityFrom(req.Context()); ident != nil {
+		role = ident.Role
+	}
+	return role + " " + req.URL.Path + "?" + req.URL.Query().Encode()
+}
+
+//cached отдаёт ответы хэндлера чтения из Cache. Ответ зависит от таблицы
+//и от таблиц, раскрытых через expand, изменение любой из них его сбрасывает
+func (dbex *DBExplorer) cached(
+	handler func(http.ResponseWriter, *http.Request, map[string]string),
+) func(http.ResponseWriter, *http.Request, map[string]string) {
+	return func(w http.ResponseWriter, req *http.Request, params map[string]string) {
+		cache := dbex.Cache
+		if cache == nil {
+			handler(w, req, params)
+			return
+		}
+		sc := dbex.schema()
+
+		key := cacheKey(req)
+		if entry := cache.get(key); entry != nil {
+			w.Header().Set("X-Cache", "HIT")
+			writeResponse(w, req, entry.header, http.StatusOK, entry.body)
+			return
+		}
+		w.Header().Set("X-Cache", "MISS")
+
+		tables := []string{params["table"]}
+		if fks, err := dbex.parseExpand(sc, params["table"], req.URL.Query()["expand"]); err == nil {
+			for _, fk := range fks {
+				tables = append(tables, fk.RefTable)
+			}
+		}
+		gen := cache.generation(tables)
+
+		rec := &cacheRecorder{ResponseWriter: w, header: make(http.Header)}
+		handler(rec, req, params)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		writeResponse(w, req, rec.header, rec.status, rec.body.Bytes())
+
+		if rec.status != http.StatusOK {
+			return
+		}
+		ttl := cache.TTL
+		if tc, ok := sc.configs[params["table"]]; ok && tc.CacheTTL != 0 {
+			ttl = tc.CacheTTL
+		}
+		cache.put(&cacheEntry{
+			key:    key,
+			tables: tables,
+			header: rec.header,
+			body:   rec.body.Bytes(),
+		}, gen, ttl)
+	}
+}
+
+//cacheStats GET /_cache - счётчики кэша ответов, только для admin
+func (dbex *DBExplorer) cacheStats(w http.ResponseWriter, req *http.Request) {
+	if !dbex.isAdmin(req) {
+		writeError(w, APIError{http.StatusForbidden, fmt.Errorf("forbidden")})
+		return
+	}
+	if dbex.Cache == nil {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("cache is disabled")})
+		return
+	}
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": dbex.Cache.Stats()})
+	w.Write(jsonRes)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+//доступ к столбцу из ColumnConfig.Access
+const (
+	accessReadOnly  = "read_only"
+	accessWriteOnly = "write_only"
+	accessHidden    = "hidden"
+)
+
+//Config какие таблицы и столбцы видны через API и под какими именами.
+//Таблицы и столбцы в нём называются так же, как в базе
+type Config struct {
+	//AllowTables если не пусто, через API видны только эти таблицы
+	AllowTables []string `yaml:"allow_tables"`
+	//DenyTables таблицы, которые через API не видны
+	DenyTables []string                `yaml:"deny_tables"`
+	Tables     map[string]*TableConfig `yaml:"tables"`
+}
+
+//TableConfig настройки таблицы
+type TableConfig struct {
+	//Name имя таблицы в API, пусто - как в базе
+	Name string `yaml:"name"`
+	//DefaultLimit сколько записей отдавать без ?limit=, 0 - 5 записей
+	DefaultLimit int `yaml:"default_limit"`
+	//MaxLimit больше стольких записей за раз не отдаётся, 0 - без ограничения
+	MaxLimit int `yaml:"max_limit"`
+	//CacheTTL сколько ответы таблицы живут в DBExplorer.Cache, например 30s,
+	//0 - ResponseCache.TTL, меньше нуля - не кэшировать
+	CacheTTL time.Duration            `yaml:"cache_ttl"`
+	Columns  map[string]*ColumnConfig `yaml:"columns"`
+}
+
+//ColumnConfig настройки столбца
+type ColumnConfig struct {
+	//Name имя столбца в API, пусто - как в базе
+	Name string `yaml:"name"`
+	//Access read_only, write_only или hidden, пусто - без ограничений
+	Access string `yaml:"access"`
+}
+
+//LoadConfig читает настройки из YAML-файла, JSON тоже подходит.
+//Незнакомые ключи считаются ошибкой
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+//ApplyConfig применяет cfg и перечитывает схему. Если cfg не сходится
+//со схемой базы, возвращается ошибка и остаются старые настройки.
+//Настройки меняются под тем же замком, что и перезагрузка схемы, и
+//сохраняются только вместе со схемой, собранной по ним
+func (dbex *DBExplorer) ApplyConfig(cfg *Config) error {
+	dbex.reloadMu.Lock()
+	defer dbex.reloadMu.Unlock()
+	if _, err := dbex.reloadLocked(context.Background(), cfg); err != nil {
+		return err
+	}
+	dbex.config = cfg
+	return nil
+}
+
+//exposed видна ли таблица tableName через API
+func (cfg *Config) exposed(tableName string) bool {
+	for _, denied := range cfg.DenyTables {
+		if denied == tableName {
+			return false
+		}
+	}
+	if len(cfg.AllowTables) == 0 {
+		return true
+	}
+	for _, allowed := range cfg.AllowTables {
+		if allowed == tableName {
+			return true
+		}
+	}
+	return false
+}
+
+//validName имя таблицы или столбца из настроек можно использовать в API:
+//имена на _ заняты служебными маршрутами
+func validName(name string) bool {
+	return !strings.HasPrefix(name, "_") && !strings.ContainsAny(name, "/?#:, ")
+}
+
+//apply проверяет настройки по схеме sc, прочитанной из базы, и
+//переводит её на имена API: убирает скрытые таблицы, переименовывает
+//таблицы, столбцы и внешние ключи, собирает ограничения столбцов
+func (cfg *Config) apply(sc *dbSchema) error {
+	for _, list := range [][]string{cfg.AllowTables, cfg.DenyTables} {
+		for _, tableName := range list {
+			if _, ok := sc.tablesInfo[tableName]; !ok {
+				return fmt.Errorf("config: unknown table %s", tableName)
+			}
+		}
+	}
+
+	names := make(map[string]string)
+	for tableName := range sc.tablesInfo {
+		tc := cfg.Tables[tableName]
+		if !cfg.exposed(tableName) {
+			if tc != nil {
+				return fmt.Errorf("config: table %s is not exposed", tableName)
+			}
+			continue
+		}
+		names[tableName] = tableName
+		if tc != nil && tc.Name != "" {
+			if !validName(tc.Name) {
+				return fmt.Errorf("config: table %s: invalid name %q", tableName, tc.Name)
+			}
+			names[tableName] = tc.Name
+		}
+	}
+	for tableName := range cfg.Tables {
+		if _, ok := sc.tablesInfo[tableName]; !ok {
+			return fmt.Errorf("config: unknown table %s", tableName)
+		}
+	}
+
+	tablesInfo := make(map[string][]*Column, len(names))
+	sc.dbTables = make(map[string]string)
+	sc.configs = make(map[string]*TableConfig)
+	sc.access = make(map[string]*TablePolicy)
+	for tableName, apiName := range names {
+		if other, ok := sc.dbTables[apiName]; ok {
+			return fmt.Errorf("config: tables %s and %s have the same name %s",
+				other, tableName, apiName)
+		}
+		sc.dbTables[apiName] = tableName
+		tablesInfo[apiName] = sc.tablesInfo[tableName]
+
+		tc := cfg.Tables[tableName]
+		if tc == nil {
+			continue
+		}
+		sc.configs[apiName] = tc
+		if err := tc.apply(tableName, sc.tablesInfo[tableName]); err != nil {
+			return err
+		}
+		sc.access[apiName] = tc.access()
+	}
+
+	//связи с невидимыми таблицами и по скрытым столбцам не раскрываются
+	foreignKeys := make(map[string][]*ForeignKey, len(names))
+	for tableName, apiName := range names {
+		tp := sc.access[apiName]
+		fks := make([]*ForeignKey, 0, len(sc.foreignKeys[tableName]))
+		for _, fk := range sc.foreignKeys[tableName] {
+			refName, ok := names[fk.RefTable]
+			column := apiColumn(sc.tablesInfo[tableName], fk.Column)
+			if !ok || tp != nil && tp.isHidden(column) {
+				continue
+			}
+			fks = append(fks, &ForeignKey{
+				Name:      fk.Name,
+				Column:    column,
+				RefTable:  refName,
+				RefColumn: apiColumn(sc.tablesInfo[fk.RefTable], fk.RefColumn),
+			})
+		}
+		foreignKeys[apiName] = fks
+	}
+
+	sc.tablesInfo = tablesInfo
+	sc.foreignKeys = foreignKeys
+	return nil
+}
+
+//apply проверяет столбцы из настроек и переименовывает их в tableInfo
+func (tc *TableConfig) apply(tableName string, tableInfo []*Column) error {
+	if tc.DefaultLimit < 0 || tc.MaxLimit < 0 {
+		return fmt.Errorf("config: table %s: limit must not be negative", tableName)
+	}
+	if tc.MaxLimit != 0 && tc.DefaultLimit > tc.MaxLimit {
+		return fmt.Errorf("config: table %s: default_limit %d is greater than max_limit %d",
+			tableName, tc.DefaultLimit, tc.MaxLimit)
+	}
+
+	for columnName, cc := range tc.Columns {
+		info := findDBColumn(tableInfo, columnName)
+		if info == nil {
+			return fmt.Errorf("config: table %s: unknown column %s", tableName, columnName)
+		}
+		if cc == nil {
+			continue
+		}
+		switch cc.Access {
+		case "", accessReadOnly:
+		case accessWriteOnly, accessHidden:
+			//без ключа записи не найти
+			if info.Key == "PRI" {
+				return fmt.Errorf("config: table %s: primary key %s can not be %s",
+					tableName, columnName, cc.Access)
+			}
+		default:
+			return fmt.Errorf("config: table %s: column %s: unknown access %q, "+
+				"want read_only, write_only or hidden", tableName, columnName, cc.Access)
+		}
+		if cc.Name == "" || cc.Name == columnName {
+			continue
+		}
+		if !validName(cc.Name) {
+			return fmt.Errorf("config: table %s: column %s: invalid name %q",
+				tableName, columnName, cc.Name)
+		}
+		info.name = info.Field
+		info.Field = cc.Name
+	}
+
+	for i, info := range tableInfo {
+		for _, other := range tableInfo[:i] {
+			if info.Field == other.Field {
+				return fmt.Errorf("config: table %s: columns %s and %s have the same name %s",
+					tableName, other.dbName(), info.dbName(), info.Field)
+			}
+		}
+	}
+	return nil
+}
+
+//access ограничения столбцов таблицы в виде политики с именами из API
+func (tc *TableConfig) access() *TablePolicy {
+	tp := &TablePolicy{}
+	for columnName, cc := range tc.Columns {
+		if cc == nil {
+			continue
+		}
+		name := columnName
+		if cc.Name != "" {
+			name = cc.Name
+		}
+		switch cc.Access {
+		case accessReadOnly:
+			tp.ReadOnly = append(tp.ReadOnly, name)
+		case accessWriteOnly:
+			tp.WriteOnly = append(tp.WriteOnly, name)
+		case accessHidden:
+			tp.Hidden = append(tp.Hidden, name)
+		}
+	}
+	return tp
+}
+
+//apiColumn имя в API столбца, который в базе называется name
+func apiColumn(tableInfo []*Column, name string) string {
+	if info := findDBColumn(tableInfo, name); info != nil {
+		return info.Field
+	}
+	return name
+}
+
+//dbColumn имя в базе столбца, который в API называется name
+func dbColumn(tableInfo []*Column, name string) string {
+	if info := findColumn(tableInfo, name); info != nil {
+		return info.dbName()
+	}
+	return name
+}
+
+//dbName имя столбца в базе
+func (c *Column) dbName() string {
+	if c.name != "" {
+		return c.name
+	}
+	return c.Field
+}
+
+//dbTable имя в базе таблицы, которая в API называется tableName
+func (sc *dbSchema) dbTable(tableName string) string {
+	if name, ok := sc.dbTables[tableName]; ok {
+		return name
+	}
+	return tableName
+}
+
+//quoteTable имя таблицы tableName из API для запроса к базе
+func (dbex *DBExplorer) quoteTable(sc *dbSchema, tableName string) string {
+	return dbex.dialect.Quote(sc.dbTable(tableName))
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	//consoleMaxRows больше строк /_query не отдаёт
+	consoleMaxRows = 1000
+	//consoleTimeout предельное время запроса из консоли
+	consoleTimeout = 10 * time.Second
+)
+
+//consoleForbidden слова, которых не может быть в запросе только на чтение:
+//изменение данных и схемы, блокировки, запись в файлы и функции с побочными
+//эффектами. Слова внутри строк и идентификаторов в кавычках не считаются
+var consoleForbidden = map[string]bool{
+	"INSERT": true, "UPDATE": true, "DELETE": true, "REPLACE": true,
+	"MERGE": true, "UPSERT": true, "TRUNCATE": true,
+	"CREATE": true, "ALTER": true, "DROP": true, "RENAME": true,
+	"GRANT": true, "REVOKE": true, "SET": true,
+	"CALL": true, "EXEC": true, "EXECUTE": true, "DO": true, "HANDLER": true,
+	"LOCK": true, "UNLOCK": true, "SHARE": true, "NOWAIT": true,
+	"INTO": true, "OUTFILE": true, "DUMPFILE": true, "LOAD": true, "COPY": true,
+	"PRAGMA": true, "ATTACH": true, "DETACH": true, "VACUUM": true,
+	"SLEEP": true, "BENCHMARK": true, "PG_SLEEP": true, "LOAD_FILE": true,
+	"NEXTVAL": true, "SETVAL": true, "LO_IMPORT": true, "LO_EXPORT": true,
+	"PG_READ_FILE": true, "PG_TERMINATE_BACKEND": true, "PG_CANCEL_BACKEND": true,
+	"GET_LOCK": true, "RELEASE_LOCK": true, "LOAD_EXTENSION": true,
+}
+
+//consoleForbiddenPrefixes начала имён запрещённых функций, у которых
+//много вариантов, например pg_advisory_lock_shared
+var consoleForbiddenPrefixes = []string{"PG_ADVISORY_", "PG_TRY_ADVISORY_"}
+
+//consoleTypes имена типов из драйверов, которых нет в parseColumnType
+var consoleTypes = map[string]string{
+	"int2":        "smallint",
+	"int4":        "int",
+	"int8":        "bigint",
+	"float4":      "real",
+	"float8":      "double",
+	"bool":        "boolean",
+	"timestamptz": "timestamp",
+}
+
+//sqlSyntax кавычки и комментарии диалекта, по которым консоль отделяет
+//слова запроса от строк, идентификаторов в кавычках и комментариев
+type sqlSyntax struct {
+	//quotes открывающие кавычки и парные им закрывающие. Закрывающая
+	//кавычка, совпадающая с открывающей, экранируется удвоением
+	quotes map[byte]byte
+	//backslash кавычки, внутри которых \ экранирует следующий символ
+	backslash string
+	//eStrings в строках E'...' \ экранирует следующий символ
+	eStrings bool
+	//dollarQuotes строки вида $tag$...$tag$, $ допустим внутри имён
+	dollarQuotes bool
+	//nestedComments комментарии /* */ могут быть вложенными
+	nestedComments bool
+	//hashComments комментарии от # до конца строки
+	hashComments bool
+	//dashSpace -- начинает комментарий, только если за ним пробел
+	dashSpace bool
+}
+
+//sqlWords разбирает запрос на слова вне строк и комментариев по правилам
+//диалекта. Возвращает ошибку, если в запросе больше одного выражения
+func sqlWords(query string, syntax sqlSyntax) ([]string, error) {
+	words := make([]string, 0)
+	//wordEnd позиция сразу за последним словом
+	wordEnd := -1
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '#' && syntax.hashComments || c == '-' && isDashComment(query[i:], syntax.dashSpace):
+			end := strings.IndexByte(query[i:], '\n')
+			if end == -1 {
+				end = len(query) - i
+			}
+			i += end
+			continue
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			//в MySQL содержимое /*! ... */ выполняется
+			if strings.HasPrefix(query[i:], "/*!") {
+				return nil, fmt.Errorf("executable comments are not allowed")
+			}
+			end := commentEnd(query, i, syntax.nestedComments)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i = end
+			continue
+		}
+
+		switch {
+		case c == ';':
+			//после точки с запятой не может быть ничего, даже комментария
+			if strings.TrimSpace(query[i+1:]) != "" {
+				return nil, fmt.Errorf("only one statement is allowed")
+			}
+			i = len(query)
+		case syntax.quotes[c] != 0:
+			backslash := strings.IndexByte(syntax.backslash, c) != -1 ||
+				syntax.eStrings && c == '\'' && wordEnd == i && words[len(words)-1] == "E"
+			end := quotedEnd(query, i, syntax.quotes[c], backslash)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			i = end
+		case c == '$' && syntax.dollarQuotes && dollarTag(query[i:]) != "":
+			tag := dollarTag(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			i += end + 2*len(tag)
+		case isWordByte(c):
+			start := i
+			for i < len(query) && (isWordByte(query[i]) || query[i] == '$' && syntax.dollarQuotes) {
+				i++
+			}
+			words = append(words, strings.ToUpper(query[start:i]))
+			wordEnd = i
+		default:
+			i++
+		}
+	}
+	return words, nil
+}
+
+//isDashComment s начинается с комментария --. В MySQL после -- нужен
+//пробельный символ, иначе это два минуса: 1 --1 равно 2
+func isDashComment(s string, dashSpace bool) bool {
+	if !strings.HasPrefix(s, "--") {
+		return false
+	}
+	return !dashSpace || len(s) == 2 || s[2] <= ' '
+}
+
+//commentEnd позиция сразу за комментарием /* */, начинающимся в start
+func commentEnd(query string, start int, nested bool) int {
+	depth := 0
+	for i := start; i+1 < len(query); i++ {
+		switch {
+		case query[i] == '/' && query[i+1] == '*' && (nested || depth == 0):
+			depth++
+			i++
+		case query[i] == '*' && query[i+1] == '/':
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+//quotedEnd позиция сразу за строкой или именем в кавычках, начинающимися
+//в start. Кавычка экранируется удвоением, если backslash - ещё и \
+func quotedEnd(query string, start int, closing byte, backslash bool) int {
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case query[i] == '\\' && backslash:
+			i++
+		case query[i] == closing:
+			if closing == query[start] && i+1 < len(query) && query[i+1] == closing {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return -1
+}
+
+//dollarTag метка строки PostgreSQL вида $tag$ в начале s, пусто - не она.
+//$1 - плейсхолдер, а не метка
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '$':
+			return s[:i+1]
+		case !isWordByte(s[i]) || i == 1 && s[i] >= '0' && s[i] <= '9':
+			return ""
+		}
+	}
+	return ""
+}
+
+//isWordByte байт слова. Байты UTF-8 больше 0x7f - буквы, базы
+//допускают их в именах без кавычек
+func isWordByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= '0' && c <= '9' || c >= 0x80
+}
+
+//checkReadOnly пропускает только одно выражение SELECT (или WITH ... SELECT)
+//без слов из consoleForbidden
+func checkReadOnly(query string, dialect Dialect) error {
+	words, err := sqlWords(query, dialect.Syntax())
+	if err != nil {
+		return err
+	}
+	if len(words) == 0 {
+		return fmt.Errorf("empty query")
+	}
+	if words[0] != "SELECT" && words[0] != "WITH" {
+		return fmt.Errorf("only SELECT queries are allowed")
+	}
+	for _, word := range words {
+		if consoleForbidden[word] {
+			return fmt.Errorf("forbidden keyword %s", word)
+		}
+		for _, prefix := range consoleForbiddenPrefixes {
+			if strings.HasPrefix(word, prefix) {
+				return fmt.Errorf("forbidden keyword %s", word)
+			}
+		}
+	}
+	return nil
+}
+
+//consoleColumns метаданные столбцов результата по типам из драйвера,
+//чтобы значения приводились так же, как в остальных ответах
+func consoleColumns(rows *sql.Rows) ([]*Column, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]*Column, 0, len(types))
+	for _, ct := range types {
+		if findColumn(columns, ct.Name()) != nil {
+			return nil, APIError{http.StatusBadRequest,
+				fmt.Errorf("duplicate column %s, use AS", ct.Name())}
+		}
+		typeName := strings.ToLower(ct.DatabaseTypeName())
+		if strings.HasPrefix(typeName, "unsigned ") {
+			typeName = strings.TrimPrefix(typeName, "unsigned ") + " unsigned"
+		}
+		if alias, ok := consoleTypes[typeName]; ok {
+			typeName = alias
+		}
+		columns = append(columns, &Column{
+			Field: ct.Name(),
+			Type:  typeName,
+			Null:  "YES",
+			typ:   parseColumnType(typeName),
+		})
+	}
+	return columns, nil
+}
+
+//ConsoleQuery тело POST /_query
+type ConsoleQuery struct {
+	SQL   string        `json:"sql"`
+	Args  []interface{} `json:"args"`
+	Limit int           `json:"limit"`
+}
+
+//runQuery POST /_query - произвольный SELECT для отладки. Доступен только
+//администраторам, выполняется в транзакции только на чтение, которая
+//всегда откатывается
+func (dbex *DBExplorer) runQuery(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	if !dbex.isAdmin(req) {
+		writeError(w, APIError{http.StatusForbidden, fmt.Errorf("forbidden")})
+		return
+	}
+
+	cq := &ConsoleQuery{}
+	decoder := json.NewDecoder(req.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(cq); err != nil {
+		writeError(w, APIError{http.StatusBadRequest, fmt.Errorf("invalid json")})
+		return
+	}
+	if err := checkReadOnly(cq.SQL, dbex.dialect); err != nil {
+		writeError(w, APIError{http.StatusBadRequest, err})
+		return
+	}
+	limit := consoleMaxRows
+	if cq.Limit > 0 && cq.Limit < limit {
+		limit = cq.Limit
+	}
+	for i, arg := range cq.Args {
+		if n, ok := arg.(json.Number); ok {
+			cq.Args[i] = string(n)
+		}
+	}
+
+	fields := map[string]interface{}{
+		"request_id": requestIDFrom(req.Context()),
+		"sql":        cq.SQL,
+	}
+	if ident := identityFrom(req.Context()); ident != nil {
+		fields["sub"] = ident.Subject
+	}
+	dbex.logEvent("console_query", fields)
+
+	ctx, cancel := context.WithTimeout(req.Context(), consoleTimeout)
+	defer cancel()
+	tx, err := dbex.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := withContext(ctx, tx).Query(cq.SQL, cq.Args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			writeError(w, ctx.Err())
+			return
+		}
+		//ошибка в самом запросе - это ошибка клиента
+		writeError(w, APIError{http.StatusBadRequest, err})
+		return
+	}
+	defer rows.Close()
+
+	columns, err := consoleColumns(rows)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rs, err := newRowScanner(rows, columns)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	records := make([]map[string]interface{}, 0)
+	truncated := false
+	for {
+		values, err := rs.values()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if values == nil {
+			break
+		}
+		if len(records) == limit {
+			truncated = true
+			break
+		}
+
+		record := make(map[string]interface{}, len(values))
+		for i, column := range rs.cols {
+			record[column] = values[i]
+		}
+		records = append(records, record)
+	}
+
+	names := make([]string, 0, len(columns))
+	for _, column := range columns {
+		names = append(names, column.Field)
+	}
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": map[string]interface{}{
+			"columns":   names,
+			"records":   records,
+			"truncated": truncated}})
+	w.Write(jsonRes)
+}
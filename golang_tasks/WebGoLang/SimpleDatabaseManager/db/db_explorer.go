@@ -5,269 +5,260 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"html/template"
 	"log"
-	"math"
 	"net/http"
-	"regexp"
+	"net/url"
+	"os"
 	"sort"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 )
 
-//MemesRouter роутер, такой же тупой, как и его название
-type MemesRouter struct {
-	simpleRoutes   map[string]func(http.ResponseWriter, *http.Request)
-	advancedRoutes map[string]func(http.ResponseWriter, *http.Request,
-		map[string]string)
-
-	advancedRoutesTemplates []*AdvancedRoute
-}
-
-//AdvancedRoute вспомогательная стркутура для MemesRouter
-type AdvancedRoute struct {
-	URL    string
-	Method string
-	RegExp *regexp.Regexp
+//DBExplorer simple SQL Database manager
+type DBExplorer struct {
+	DB      *sql.DB
+	dialect Dialect
+	router  *Router
+	//Auth включает аутентификацию и политику доступа, nil - доступ открыт
+	Auth *AuthConfig
+	//Logger сюда пишутся access-лог и события, по строке JSON на событие
+	Logger *log.Logger
+	//QueryTimeout таймаут запросов к базе на один http-запрос, 0 - без таймаута
+	QueryTimeout time.Duration
+	//RouteTimeouts таймауты отдельных маршрутов, ключ вида "GET /{table}"
+	RouteTimeouts map[string]time.Duration
+	//SoftDeleteColumn в таблицах с таким nullable-столбцом DELETE только
+	//проставляет в нём время удаления, пусто - удалять всегда физически
+	SoftDeleteColumn string
+	//Cache кэш ответов на чтение таблиц и записей, nil - без кэша
+	Cache *ResponseCache
+	//LegacyRoutes оставляет старые маршруты PUT /{table}/ (создание)
+	//и POST /{table}/{id} (обновление) рядом с POST, PATCH и PUT
+	LegacyRoutes bool
+	//Secret ключ HMAC для версий записей в ETag, по-умолчанию случайный.
+	//У экземпляров за одним балансировщиком должен быть общим
+	Secret []byte
+
+	//audit журнал изменений, включается EnableAudit
+	audit AuditSink
+	//events шина событий для GET /{table}/_changes
+	events *eventBus
+	//uiPages шаблоны страниц админки /_ui/
+	uiPages map[string]*template.Template
+	//config видимость и имена таблиц и столбцов, задаётся ApplyConfig,
+	//читается и меняется под reloadMu
+	config *Config
+
+	schemaMu *sync.RWMutex
+	reloadMu *sync.Mutex
+	current  *dbSchema
 }
 
-//NewMemesRouter создаёт MemesRouter
-func NewMemesRouter() *MemesRouter {
-	return &MemesRouter{
-		simpleRoutes: make(map[string]func(http.ResponseWriter, *http.Request)),
-		advancedRoutes: make(map[string]func(http.ResponseWriter, *http.Request,
-			map[string]string), 0),
+//Column метаданные по некоторому столбцу
+type Column struct {
+	Field   string
+	Type    string
+	Null    string
+	Key     string
+	Default string
+	Extra   string
 
-		advancedRoutesTemplates: make([]*AdvancedRoute, 0),
-	}
+	typ *ColumnType
+	//name имя в базе, если в API столбец переименован
+	name string
 }
 
-//Вешает просто хэндлер без параметров
-func (ms *MemesRouter) addSimpleHandler(url string, method string,
-	handler func(http.ResponseWriter, *http.Request)) error {
-	newURLName := url + "_" + method
-	if _, ok := ms.simpleRoutes[newURLName]; ok {
-		return fmt.Errorf("Route already exist")
+//NewDbExplorer creates new DBExplorer, диалект определяется по драйверу db
+func NewDbExplorer(db *sql.DB) (*DBExplorer, error) {
+	dialect, err := detectDialect(db)
+	if err != nil {
+		return nil, err
 	}
-	ms.simpleRoutes[newURLName] = handler
-	return nil
+	return NewDbExplorerDialect(db, dialect)
 }
 
-//Будет парсить параметры в {} в структуру
-func (ms *MemesRouter) addAdvancedHandler(url string, method string,
-	handler func(http.ResponseWriter, *http.Request, map[string]string)) error {
-	braceIndex := strings.Index(url, "{")
-	if braceIndex == -1 {
-		return fmt.Errorf("Use addSimpleHandler() for simple routes")
+//NewDbExplorerDialect creates new DBExplorer с явно заданным диалектом
+func NewDbExplorerDialect(db *sql.DB, dialect Dialect) (*DBExplorer, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return nil, err
 	}
-
-	newURLName := url + "_" + method
-	if _, ok := ms.advancedRoutes[newURLName]; ok {
-		return fmt.Errorf("Route already exist")
+	dbex := &DBExplorer{
+		DB:               db,
+		dialect:          dialect,
+		router:           NewRouter(),
+		Logger:           log.New(os.Stderr, "", 0),
+		SoftDeleteColumn: "deleted_at",
+		LegacyRoutes:     true,
+		Secret:           secret,
+		schemaMu:         &sync.RWMutex{},
+		reloadMu:         &sync.Mutex{},
+		events:           newEventBus(),
+	}
+
+	sc, err := dbex.loadSchema(db, nil)
+	if err != nil {
+		return nil, err
 	}
-
-	ms.advancedRoutes[newURLName] = handler
-	newAdvancedRoute := &AdvancedRoute{
-		URL:    newURLName,
-		Method: method,
+	dbex.current = sc
+	if dbex.uiPages, err = loadUI(); err != nil {
+		return nil, err
 	}
 
-	url = strings.Replace(url, "{", "(?P<", -1)
-	url = strings.Replace(url, "}", ">[[:alnum:]_]+)", -1)
-	newAdvancedRoute.RegExp = regexp.MustCompile("^" + url + "$")
-
-	ms.advancedRoutesTemplates = append(ms.advancedRoutesTemplates, newAdvancedRoute)
-	return nil
+	dbex.router.Use(dbex.withRequestID, dbex.withAccessLog, dbex.withRecover,
+		dbex.withTimeout, dbex.withAuth)
+	dbex.router.addSimpleHandler("/", "GET", dbex.tableList)
+	dbex.router.addSimpleHandler("/_batch", "POST", dbex.batch)
+	dbex.router.addSimpleHandler("/_openapi.json", "GET", dbex.openAPI)
+	dbex.router.addSimpleHandler("/_reload", "POST", dbex.reloadSchema)
+	dbex.router.addSimpleHandler("/_query", "POST", dbex.runQuery)
+	dbex.router.addSimpleHandler("/_graphql", "GET", dbex.graphQLSchemaSDL)
+	dbex.router.addSimpleHandler("/_graphql", "POST", dbex.graphQL)
+	dbex.router.addSimpleHandler("/_cache", "GET", dbex.cacheStats)
+	dbex.router.addAdvancedHandler("/{table}", "GET", dbex.cached(dbex.getListFrom))
+	//служебные маршруты таблицы должны идти раньше /{table}/{id}
+	dbex.router.addAdvancedHandler("/{table}/_meta", "GET", dbex.tableMeta)
+	dbex.router.addAdvancedHandler("/{table}/_schema", "GET", dbex.tableSchema)
+	dbex.router.addAdvancedHandler("/{table}/_export", "GET", dbex.exportTable)
+	dbex.router.addAdvancedHandler("/{table}/_import", "POST", dbex.importTable)
+	dbex.router.addAdvancedHandler("/{table}/_changes", "GET", dbex.tableChanges)
+	dbex.router.addAdvancedHandler("/{table}/_aggregate", "GET", dbex.aggregateTable)
+	dbex.router.addAdvancedHandler("/{table}/{id}", "GET", dbex.cached(dbex.getRecord))
+	dbex.router.addAdvancedHandler("/{table}/{id}/_history", "GET", dbex.recordHistory)
+	dbex.router.addAdvancedHandler("/{table}/{id}/_restore", "POST", dbex.restoreRecord)
+	dbex.router.addAdvancedHandler("/{table}/{id}/{related}", "GET", dbex.getRelated)
+	dbex.router.addAdvancedHandler("/{table}", "POST", dbex.createRecord)
+	dbex.router.addAdvancedHandler("/{table}/{id}", "PATCH", dbex.patchRecord)
+	dbex.router.addAdvancedHandler("/{table}/{id}", "PUT", dbex.putRecord)
+	dbex.router.addOptionalHandler("/{table}/", "PUT", dbex.legacyEnabled,
+		legacyRoute(dbex.createRecord))
+	dbex.router.addOptionalHandler("/{table}/{id}", "POST", dbex.legacyEnabled,
+		legacyRoute(dbex.updateRecord))
+	dbex.router.addAdvancedHandler("/{table}/{id}", "DELETE", dbex.deleteRecord)
+	//админка, статический сегмент _ui важнее {table}
+	dbex.router.addSimpleHandler("/_ui", "GET", dbex.uiRedirect)
+	dbex.router.addSimpleHandler("/_ui/", "GET", dbex.uiTables)
+	dbex.router.addAdvancedHandler("/_ui/{table}", "GET", dbex.uiGrid)
+	dbex.router.addAdvancedHandler("/_ui/{table}/_new", "GET", dbex.uiForm)
+	dbex.router.addAdvancedHandler("/_ui/{table}/_new", "POST", dbex.uiForm)
+	dbex.router.addAdvancedHandler("/_ui/{table}/{id}", "GET", dbex.uiForm)
+	dbex.router.addAdvancedHandler("/_ui/{table}/{id}", "POST", dbex.uiForm)
+	dbex.router.addAdvancedHandler("/_ui/{table}/{id}/_delete", "POST", dbex.uiDelete)
+	return dbex, nil
 }
 
-//Handle отправляет r на нужную функцию
-func (ms *MemesRouter) Handle(w http.ResponseWriter, r *http.Request) {
-	urlPath := r.URL.Path
-	if call, ok := ms.simpleRoutes[urlPath+"_"+r.Method]; ok {
-		call(w, r)
-		return
-	}
-
-	for _, tmpl := range ms.advancedRoutesTemplates {
-		if tmpl.Method == r.Method && tmpl.RegExp.MatchString(urlPath) {
-			log.Printf("MemesRouter: handle METHOD: %s;\tURL: %s\tto\t%s",
-				r.Method, urlPath, tmpl.URL)
-			params := make(map[string]string)
-			match := tmpl.RegExp.FindStringSubmatch(urlPath)
-			for i, name := range tmpl.RegExp.SubexpNames() {
-				if i > 0 && i <= len(match) {
-					params[name] = match[i]
-				}
-			}
-
-			ms.advancedRoutes[tmpl.URL](w, r, params)
-			return
-		}
-	}
-
-	log.Printf("MemesRouter: handle METHOD: %s;\tURL: %s\t NOT FOUND",
-		r.Method, urlPath)
-	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte("<h1>404: Not Found!</h1>"))
+//conn соединение с базой, запросы через которое живут не дольше запроса клиента
+func (dbex *DBExplorer) conn(req *http.Request) sqlExecutor {
+	return withContext(req.Context(), dbex.DB)
 }
 
-//DBExplorer simple MySQL Database manager
-type DBExplorer struct {
-	DB     *sql.DB
-	router *MemesRouter
-
-	tablesInfo map[string][]*Column
+func (dbex *DBExplorer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dbex.router.ServeHTTP(w, r)
 }
 
-//Column метаданные по некоторому столбцу
-type Column struct {
-	Field   string
-	Type    string
-	Null    string
-	Key     string
-	Default string
-	Extra   string
+//rowScanner читает строки выборки по одной, приводя значения к типам столбцов
+type rowScanner struct {
+	rows     *sql.Rows
+	cols     []string
+	colsInfo []*Column
+	records  []interface{}
+	ptrs     []interface{}
 }
 
-//NewDbExplorer creates new DBExplorer
-func NewDbExplorer(db *sql.DB) (*DBExplorer, error) {
-	dbex := &DBExplorer{
-		DB:         db,
-		tablesInfo: make(map[string][]*Column),
-		router:     NewMemesRouter(),
+func newRowScanner(rows *sql.Rows, tableInfo []*Column) (*rowScanner, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
 	}
 
-	rows, err := dbex.DB.Query("SHOW TABLES")
-	if err != nil {
-		log.Fatalf("tables open error: %v", err)
+	//Столбцы выборки могут идти не в том порядке, что в таблице,
+	//и называются так, как в базе
+	colsInfo := make([]*Column, len(cols))
+	for i, column := range cols {
+		colsInfo[i] = findDBColumn(tableInfo, column)
+		if colsInfo[i] == nil {
+			colsInfo[i] = &Column{Field: column}
+		}
+		cols[i] = colsInfo[i].Field
 	}
 
-	defer rows.Close()
-	var name string
-	for rows.Next() {
-		rows.Scan(&name)
-		dbex.tablesInfo[name] = make([]*Column, 0)
+	rs := &rowScanner{
+		rows:     rows,
+		cols:     cols,
+		colsInfo: colsInfo,
+		records:  make([]interface{}, len(cols)),
+		ptrs:     make([]interface{}, len(cols)),
 	}
-	if err := rows.Err(); err != nil {
-		log.Fatalf("db error: %v:", err)
+	for i := range rs.records {
+		//Данные попадут в records через ptrs
+		rs.ptrs[i] = &rs.records[i]
 	}
+	return rs, nil
+}
 
-	for tableName := range dbex.tablesInfo {
-		rows, err := dbex.DB.Query(fmt.Sprintf("SHOW COLUMNS FROM %s", tableName))
-		if err != nil {
-			log.Fatalf("columns read form %s error: %v", tableName, err)
-		}
-
-		defer rows.Close()
-		for rows.Next() {
-			colInfo := &Column{}
-			rows.Scan(&colInfo.Field, &colInfo.Type, &colInfo.Null,
-				&colInfo.Key, &colInfo.Default, &colInfo.Extra)
+//values значения очередной строки в порядке столбцов выборки,
+//nil без ошибки - строки кончились
+func (rs *rowScanner) values() ([]interface{}, error) {
+	if !rs.rows.Next() {
+		return nil, rs.rows.Err()
+	}
+	if err := rs.rows.Scan(rs.ptrs...); err != nil {
+		return nil, err
+	}
 
-			dbex.tablesInfo[tableName] = append(dbex.tablesInfo[tableName], colInfo)
-		}
-		if err := rows.Err(); err != nil {
-			log.Fatalf("db error: %v:", err)
+	values := make([]interface{}, len(rs.cols))
+	for i := range rs.cols {
+		v, err := decodeValue(rs.records[i], rs.colsInfo[i].columnType())
+		if err != nil {
+			return nil, err
 		}
+		values[i] = v
 	}
-
-	dbex.router.addSimpleHandler("/", "GET", dbex.tableList)
-	dbex.router.addAdvancedHandler("/{table}", "GET", dbex.getListFrom)
-	dbex.router.addAdvancedHandler("/{table}/{id}", "GET", dbex.getRecord)
-	dbex.router.addAdvancedHandler("/{table}/", "PUT", dbex.createRecord)
-	dbex.router.addAdvancedHandler("/{table}/{id}", "POST", dbex.updateRecord)
-	dbex.router.addAdvancedHandler("/{table}/{id}", "DELETE", dbex.deleteRecord)
-	return dbex, nil
-}
-
-func (dbex *DBExplorer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	dbex.router.Handle(w, r)
+	return values, nil
 }
 
 func (dbex *DBExplorer) readDBData(rows *sql.Rows, tableInfo []*Column) ([]map[string]interface{}, error) {
-	cols, err := rows.Columns()
+	rs, err := newRowScanner(rows, tableInfo)
 	if err != nil {
 		return nil, err
 	}
 
 	//Укладываем полученные записи в tableData
-	size := len(cols)
 	tableData := make([]map[string]interface{}, 0)
-	records := make([]interface{}, size)
-	recordsPtr := make([]interface{}, size)
-	for rows.Next() {
-		for i := 0; i < size; i++ {
-			recordsPtr[i] = &records[i]
+	for {
+		values, err := rs.values()
+		if err != nil {
+			return nil, err
+		}
+		if values == nil {
+			break
 		}
-		//Данные попадут в records через recordsPtr
-		rows.Scan(recordsPtr...)
-		entry := make(map[string]interface{})
-		for i, column := range cols {
-			var v interface{}
-			rec := records[i]
-			if b, ok := rec.([]byte); ok {
-				tmp := string(b)
-				if strings.HasPrefix(tableInfo[i].Type, "int") {
-					v, err = strconv.Atoi(tmp)
-					if err != nil {
-						return nil, err
-					}
-				} else if strings.HasPrefix(tableInfo[i].Type, "float") {
-					v, err = strconv.ParseFloat(tmp, 64)
-					if err != nil {
-						return nil, err
-					}
-				} else {
-					v = tmp
-				}
-			} else {
-				v = rec
-			}
 
-			entry[column] = v
+		entry := make(map[string]interface{}, len(values))
+		for i, column := range rs.cols {
+			entry[column] = values[i]
 		}
 		tableData = append(tableData, entry)
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-
 	return tableData, nil
 }
 
 func (dbex *DBExplorer) validateParametrs(field interface{}, info *Column) (interface{}, error) {
-	switch x := field.(type) {
-	case string:
-		if info.Type != "varchar(255)" && info.Type != "text" {
-			return nil, fmt.Errorf("field " + info.Field + " have invalid type")
-		}
-		return x, nil
-	case float64:
-		if math.Trunc(x) == x {
-			if !strings.HasPrefix(info.Type, "int") {
-				return nil, fmt.Errorf("field " + info.Field + " have invalid type")
-			}
-			return int(x), nil
-		} else {
-			if !strings.HasPrefix(info.Type, "float") {
-				return nil, fmt.Errorf("field " + info.Field + " have invalid type")
-			}
-			return x, nil
-		}
-	default:
-		if info.Null != "YES" {
-			return nil, fmt.Errorf("field " + info.Field + " have invalid type")
-		}
-		return x, nil
-	}
+	return validateValue(field, info)
 }
 
 func (dbex *DBExplorer) tableList(w http.ResponseWriter,
 	req *http.Request) {
-	tables := make([]string, 0, len(dbex.tablesInfo))
-	for tableName := range dbex.tablesInfo {
-		tables = append(tables, tableName)
+	sc := dbex.schema()
+	tables := make([]string, 0, len(sc.tablesInfo))
+	for tableName := range sc.tablesInfo {
+		//таблицы, которые нельзя читать, не показываем
+		if dbex.tablePolicy(sc, req, tableName).Read {
+			tables = append(tables, tableName)
+		}
 	}
 
 	//Будем выдавать в лексикографическом порядке
@@ -280,227 +271,388 @@ func (dbex *DBExplorer) tableList(w http.ResponseWriter,
 
 func (dbex *DBExplorer) getListFrom(w http.ResponseWriter, req *http.Request,
 	params map[string]string) {
+	sc := dbex.schema()
 	tableName := params["table"]
-	tableInfo, ok := dbex.tablesInfo[tableName]
+	tableInfo, ok := sc.tablesInfo[tableName]
 	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		jsonRes, _ := json.Marshal(map[string]interface{}{
-			"error": "unknown table"})
-		w.Write(jsonRes)
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
 		return
 	}
 
-	query := req.URL.Query()
-	limit := "5"
-	offset := "0"
+	tp, err := dbex.checkRead(sc, req, tableName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	//скрытые столбцы нельзя ни выбрать, ни использовать в условиях
+	lq, err := dbex.parseListQuery(tp.visible(tableInfo), req.URL.Query())
+	if err != nil {
+		writeError(w, APIError{http.StatusBadRequest, err})
+		return
+	}
+	dbex.hideDeleted(lq, tableInfo, req.URL.Query())
+
+	dbex.serveList(w, req, sc, tableName, tableInfo, lq)
+}
+
+//listLimits limit и offset выборки, по-умолчанию 5 записей с начала.
+//tc из Config меняет limit по-умолчанию и ограничивает его сверху.
+//Отрицательные значения - ошибка: LIMIT -1 в SQLite снял бы ограничение
+func listLimits(query url.Values, tc *TableConfig) (int, int, error) {
+	limit := 5
+	offset := 0
+	if tc != nil && tc.DefaultLimit > 0 {
+		limit = tc.DefaultLimit
+	}
 	if lim := query.Get("limit"); lim != "" {
-		if _, err := strconv.Atoi(lim); err == nil {
-			limit = lim
+		if v, err := strconv.Atoi(lim); err == nil {
+			limit = v
 		}
 	}
-
 	if off := query.Get("offset"); off != "" {
-		if _, err := strconv.Atoi(off); err == nil {
-			offset = off
+		if v, err := strconv.Atoi(off); err == nil {
+			offset = v
 		}
 	}
+	if limit < 0 {
+		return 0, 0, APIError{http.StatusBadRequest, fmt.Errorf("limit must not be negative")}
+	}
+	if offset < 0 {
+		return 0, 0, APIError{http.StatusBadRequest, fmt.Errorf("offset must not be negative")}
+	}
+
+	if tc != nil && tc.MaxLimit > 0 && limit > tc.MaxLimit {
+		limit = tc.MaxLimit
+	}
+	return limit, offset, nil
+}
 
-	rows, err := dbex.DB.Query(fmt.Sprintf("SELECT * FROM %s LIMIT ? OFFSET ?",
-		tableName), limit, offset)
+//serveList выполняет подготовленную выборку lq с пагинацией и раскрытием связей
+func (dbex *DBExplorer) serveList(w http.ResponseWriter, req *http.Request,
+	sc *dbSchema, tableName string, tableInfo []*Column, lq *listQuery) {
+	query := req.URL.Query()
+	tp := dbex.tablePolicy(sc, req, tableName)
+	expand, err := dbex.parseExpand(sc, tableName, query["expand"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	expandPolicies, err := dbex.checkExpand(sc, req, tableName, expand)
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+
+	dbTable := sc.dbTable(tableName)
+	limit, offset, err := listLimits(query, sc.configs[tableName])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	db := dbex.conn(req)
+	response := make(map[string]interface{})
+	var total int64 = -1
+	if query.Get("total") == "1" {
+		err := db.QueryRow(lq.countSQL(dbex.dialect, dbTable),
+			lq.args.values...).Scan(&total)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		response["total"] = total
+	}
+
+	//keyset-пагинация включается параметром cursor, даже пустым
+	_, cursorMode := query["cursor"]
+	var keys []*Column
+	sqlReq := ""
+	if cursorMode {
+		//пустая страница не даёт записи, от которой строится next_cursor
+		if limit == 0 {
+			writeError(w, APIError{http.StatusBadRequest,
+				fmt.Errorf("limit must be positive with cursor")})
+			return
+		}
+		keys, err = lq.applyCursor(dbex.dialect, tableInfo, query.Get("cursor"))
+		if err != nil {
+			writeError(w, APIError{http.StatusBadRequest, err})
+			return
+		}
+		//лишняя запись нужна, чтобы понять, есть ли следующая страница
+		sqlReq = lq.selectSQL(dbex.dialect, dbTable) +
+			" LIMIT " + lq.args.add(limit+1)
+	} else {
+		sqlReq = lq.selectSQL(dbex.dialect, dbTable) +
+			" LIMIT " + lq.args.add(limit) + " OFFSET " + lq.args.add(offset)
+	}
+
+	rows, err := db.Query(sqlReq, lq.args.values...)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 	defer rows.Close()
 
 	tableData, err := dbex.readDBData(rows, tableInfo)
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	rows.Close()
+
+	if cursorMode {
+		response["next_cursor"] = nil
+		if len(tableData) > limit {
+			tableData = tableData[:limit]
+			next := encodeCursor(keys, tableData[limit-1])
+			response["next_cursor"] = next
+			w.Header().Add("Link", pageLink(req, "next",
+				map[string]string{"cursor": next}))
+		}
+	} else {
+		for _, link := range offsetLinks(req, limit, offset, len(tableData), total) {
+			w.Header().Add("Link", link)
+		}
+	}
+
+	if err := dbex.expandRecords(sc, db, tableData, expand, includeDeleted(query)); err != nil {
+		writeError(w, err)
+		return
 	}
+	tp.strip(tableData)
+	stripExpanded(tableData, expandPolicies)
 
+	response["records"] = tableData
 	jsonRes, _ := json.Marshal(map[string]interface{}{
-		"response": map[string]interface{}{
-			"records": tableData}})
+		"response": response})
 	w.Write(jsonRes)
 }
 
 func (dbex *DBExplorer) getRecord(w http.ResponseWriter, req *http.Request,
 	params map[string]string) {
+	sc := dbex.schema()
 	tableName := params["table"]
-	tableInfo, ok := dbex.tablesInfo[tableName]
+	tableInfo, ok := sc.tablesInfo[tableName]
 	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		jsonRes, _ := json.Marshal(map[string]interface{}{
-			"error": "unknown table"})
-		w.Write(jsonRes)
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
 		return
 	}
 
-	var priName string
-	for _, info := range tableInfo {
-		if info.Key == "PRI" {
-			priName = info.Field
-			break
-		}
+	tp, err := dbex.checkRead(sc, req, tableName)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 
-	rows, err := dbex.DB.Query(fmt.Sprintf("SELECT * FROM %s WHERE %s= ?",
-		tableName, priName), params["id"])
+	expand, err := dbex.parseExpand(sc, tableName, req.URL.Query()["expand"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	expandPolicies, err := dbex.checkExpand(sc, req, tableName, expand)
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		writeError(w, err)
+		return
 	}
-	defer rows.Close()
 
-	tableData, err := dbex.readDBData(rows, tableInfo)
+	db := dbex.conn(req)
+	record, err := dbex.fetchRecord(sc, db, tableName, tableInfo, params["id"], false)
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	if record == nil || !includeDeleted(req.URL.Query()) && dbex.isDeleted(tableInfo, record) {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("record not found")})
+		return
 	}
 
-	if len(tableData) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		jsonRes, _ := json.Marshal(map[string]interface{}{
-			"error": "record not found"})
-		w.Write(jsonRes)
+	//версия считается по строке целиком, до раскрытия связей и скрытия столбцов
+	etag := dbex.recordETag(record)
+	w.Header().Set("ETag", etag)
+	if inm := req.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	if err := rows.Err(); err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+	tableData := []map[string]interface{}{record}
+	if err := dbex.expandRecords(sc, db, tableData, expand,
+		includeDeleted(req.URL.Query())); err != nil {
+		writeError(w, err)
+		return
 	}
+	tp.strip(tableData)
+	stripExpanded(tableData, expandPolicies)
 
 	jsonRes, _ := json.Marshal(map[string]interface{}{
 		"response": map[string]interface{}{
-			"record": tableData[0]}})
+			"record": record}})
 	w.Write(jsonRes)
 }
 
+//readBody разбирает JSON-объект из тела запроса
+func readBody(r *http.Request) (map[string]interface{}, error) {
+	bodyStrct := make(map[string]interface{})
+	defer r.Body.Close()
+
+	//числа оставляем строками, чтобы не терять точность bigint и decimal
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&bodyStrct); err != nil {
+		return nil, APIError{http.StatusBadRequest, fmt.Errorf("invalid json")}
+	}
+	return bodyStrct, nil
+}
+
 func (dbex *DBExplorer) createRecord(w http.ResponseWriter, r *http.Request,
 	params map[string]string) {
-	tableName := params["table"]
-	tableInfo, ok := dbex.tablesInfo[tableName]
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		jsonRes, _ := json.Marshal(map[string]interface{}{
-			"error": "unknown table"})
-		w.Write(jsonRes)
+	sc := dbex.schema()
+	bodyStrct, err := readBody(r)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	bodyStrct := make(map[string]interface{})
-	b, err := ioutil.ReadAll(r.Body)
-	defer r.Body.Close()
-	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+	if err := dbex.checkWrite(sc, r, params["table"], bodyStrct); err != nil {
+		writeError(w, err)
+		return
 	}
 
-	err = json.Unmarshal(b, &bodyStrct)
+	res, err := dbex.changeRecord(sc, r, params["table"], "", "create",
+		func(db sqlExecutor) (map[string]interface{}, error) {
+			return dbex.insertRecord(sc, db, params["table"], bodyStrct)
+		})
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	recordRows(w, 1)
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": res})
+	w.Write(jsonRes)
+}
+
+//insertRecord валидирует bodyStrct и вставляет запись в tableName
+func (dbex *DBExplorer) insertRecord(sc *dbSchema, db sqlExecutor, tableName string,
+	bodyStrct map[string]interface{}) (map[string]interface{}, error) {
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		return nil, APIError{http.StatusNotFound, fmt.Errorf("unknown table")}
 	}
 
 	values := make([]interface{}, 0)
 	keys := make([]string, 0)
-	var priName string
+	//автоинкрементный ключ генерирует база, остальные части ключа
+	//обязательны и возвращаются в ответе как есть
+	var autoKey string
+	res := make(map[string]interface{})
 	for _, info := range tableInfo {
 		newField, ok := bodyStrct[info.Field]
-		if info.Key == "PRI" {
-			priName = info.Field
+		if info.Key == "PRI" && info.isAutoIncrement() {
+			autoKey = info.Field
 			continue
 		}
 
 		//Валидация + подготовка INSERT запроса
 		if !ok {
-			if info.Null != "YES" {
-				if info.Default == "" {
-					w.WriteHeader(http.StatusBadRequest)
-					jsonRes, _ := json.Marshal(map[string]interface{}{
-						"error": "field " + info.Field + " is not nullable"})
-					w.Write(jsonRes)
-					return
-				} else {
-					newField = info.Default
-				}
+			if info.Null != "YES" && info.Default == "" {
+				return nil, APIError{http.StatusBadRequest,
+					fmt.Errorf("field %s is not nullable", info.Field)}
 			}
 			continue
 		}
 
 		v, err := dbex.validateParametrs(newField, info)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			jsonRes, _ := json.Marshal(map[string]interface{}{
-				"error": err.Error()})
-			w.Write(jsonRes)
-			return
+			return nil, APIError{http.StatusBadRequest, err}
+		}
+		if info.Key == "PRI" {
+			res[info.Field] = v
 		}
 
 		values = append(values, v)
-		keys = append(keys, info.Field)
+		keys = append(keys, info.dbName())
 	}
 
 	insertReq := bytes.Buffer{}
 	insertReq.WriteString("INSERT INTO ")
-	insertReq.WriteString(tableName)
-	insertReq.WriteString(" (")
-	for _, info := range keys[:len(keys)-1] {
-		insertReq.WriteString("`" + info + "`, ")
-	}
-	insertReq.WriteString("`" + keys[len(keys)-1] + "`) ")
-	insertReq.WriteString("VALUES (")
-	for i := 0; i < len(keys)-1; i++ {
-		insertReq.WriteString("?, ")
-	}
-	insertReq.WriteString("?)")
-
-	result, err := dbex.DB.Exec(
-		insertReq.String(),
-		values...,
-	)
-	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+	insertReq.WriteString(dbex.quoteTable(sc, tableName))
+	if len(keys) == 0 {
+		//все столбцы по-умолчанию
+		insertReq.WriteString(dbex.dialect.DefaultValues())
+	} else {
+		insertReq.WriteString(" (")
+		for i, info := range keys {
+			if i > 0 {
+				insertReq.WriteString(", ")
+			}
+			insertReq.WriteString(dbex.dialect.Quote(info))
+		}
+		insertReq.WriteString(") VALUES (")
+		for i := range keys {
+			if i > 0 {
+				insertReq.WriteString(", ")
+			}
+			insertReq.WriteString(dbex.dialect.Placeholder(i + 1))
+		}
+		insertReq.WriteString(")")
 	}
 
-	lastID, err := result.LastInsertId()
+	lastID, err := dbex.dialect.Insert(db, insertReq.String(), autoKey,
+		values...)
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		return nil, err
 	}
 
-	jsonRes, _ := json.Marshal(map[string]interface{}{
-		"response": map[string]interface{}{
-			priName: lastID}})
-	w.Write(jsonRes)
+	if autoKey != "" {
+		res[autoKey] = lastID
+	}
+	return res, nil
 }
 
 func (dbex *DBExplorer) updateRecord(w http.ResponseWriter, r *http.Request,
 	params map[string]string) {
-	tableName := params["table"]
-	tableInfo, ok := dbex.tablesInfo[tableName]
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		jsonRes, _ := json.Marshal(map[string]interface{}{
-			"error": "unknown table"})
-		w.Write(jsonRes)
+	sc := dbex.schema()
+	bodyStrct, err := readBody(r)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	bodyStrct := make(map[string]interface{})
-	b, err := ioutil.ReadAll(r.Body)
-	defer r.Body.Close()
-	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+	if err := dbex.checkWrite(sc, r, params["table"], bodyStrct); err != nil {
+		writeError(w, err)
+		return
 	}
 
-	err = json.Unmarshal(b, &bodyStrct)
+	res, err := dbex.changeRecord(sc, r, params["table"], params["id"], "update",
+		func(db sqlExecutor) (map[string]interface{}, error) {
+			return dbex.modifyRecord(sc, db, params["table"], params["id"], bodyStrct)
+		})
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		writeError(w, err)
+		return
+	}
+	recordRows(w, res["updated"].(int64))
+	dbex.setETag(w, r, sc, params["table"], params["id"])
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": res})
+	w.Write(jsonRes)
+}
+
+//modifyRecord валидирует bodyStrct и обновляет запись id в tableName
+func (dbex *DBExplorer) modifyRecord(sc *dbSchema, db sqlExecutor, tableName string,
+	id string, bodyStrct map[string]interface{}) (map[string]interface{}, error) {
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		return nil, APIError{http.StatusNotFound, fmt.Errorf("unknown table")}
 	}
 
 	values := make([]interface{}, 0)
 	keys := make([]string, 0)
-	var priName string
 	for _, info := range tableInfo {
-		if info.Key == "PRI" {
-			priName = info.Field
-		}
-
 		newField, ok := bodyStrct[info.Field]
 		//Валидация + подготовка UPDATE запроса
 		if !ok {
@@ -509,82 +661,124 @@ func (dbex *DBExplorer) updateRecord(w http.ResponseWriter, r *http.Request,
 
 		// primary key нельзя обновлять у существующей записи
 		if info.Key == "PRI" {
-			w.WriteHeader(http.StatusBadRequest)
-			jsonRes, _ := json.Marshal(map[string]interface{}{
-				"error": "field " + info.Field + " have invalid type"})
-			w.Write(jsonRes)
-			return
+			return nil, APIError{http.StatusBadRequest,
+				fmt.Errorf("field %s have invalid type", info.Field)}
 		}
 
 		v, err := dbex.validateParametrs(newField, info)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			jsonRes, _ := json.Marshal(map[string]interface{}{
-				"error": err.Error()})
-			w.Write(jsonRes)
-			return
+			return nil, APIError{http.StatusBadRequest, err}
 		}
 
 		values = append(values, v)
-		keys = append(keys, info.Field)
+		keys = append(keys, info.dbName())
+	}
+
+	if len(keys) == 0 {
+		return nil, APIError{http.StatusBadRequest,
+			fmt.Errorf("nothing to update")}
 	}
 
 	insertReq := bytes.Buffer{}
 	insertReq.WriteString("UPDATE ")
-	insertReq.WriteString(tableName)
+	insertReq.WriteString(dbex.quoteTable(sc, tableName))
 	insertReq.WriteString(" SET ")
-	for _, info := range keys[:len(keys)-1] {
-		insertReq.WriteString("`" + info + "` = ?,")
+	for i, info := range keys {
+		if i > 0 {
+			insertReq.WriteString(", ")
+		}
+		insertReq.WriteString(dbex.dialect.Quote(info) + " = " +
+			dbex.dialect.Placeholder(i+1))
+	}
+	args := &sqlArgs{dialect: dbex.dialect, values: values}
+	cond, err := dbex.keyCondition(tableInfo, id, args)
+	if err != nil {
+		return nil, err
+	}
+	insertReq.WriteString(" WHERE ")
+	insertReq.WriteString(cond)
+	//удалённую запись сначала надо восстановить
+	if column := dbex.softDeleteColumn(tableInfo); column != nil {
+		insertReq.WriteString(" AND " + dbex.dialect.Quote(column.dbName()) + " IS NULL")
 	}
-	insertReq.WriteString("`" + keys[len(keys)-1] + "` = ? ")
-	insertReq.WriteString("WHERE ")
-	insertReq.WriteString(priName)
-	insertReq.WriteString(" = ?")
-	values = append(values, params["id"])
 
-	result, err := dbex.DB.Exec(insertReq.String(), values...)
+	result, err := db.Exec(insertReq.String(), args.values...)
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		return nil, err
 	}
 
 	updated, err := result.RowsAffected()
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		return nil, err
 	}
 
-	jsonRes, _ := json.Marshal(map[string]interface{}{
-		"response": map[string]interface{}{
-			"updated": updated}})
-	w.Write(jsonRes)
-
+	return map[string]interface{}{
+		"updated": updated}, nil
 }
 
 func (dbex *DBExplorer) deleteRecord(w http.ResponseWriter, r *http.Request,
 	params map[string]string) {
+	sc := dbex.schema()
+	if err := dbex.checkWrite(sc, r, params["table"], nil); err != nil {
+		writeError(w, err)
+		return
+	}
 
-	tableName := params["table"]
-	_, ok := dbex.tablesInfo[tableName]
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		jsonRes, _ := json.Marshal(map[string]interface{}{
-			"error": "unknown table"})
-		w.Write(jsonRes)
+	res, err := dbex.changeRecord(sc, r, params["table"], params["id"], "delete",
+		func(db sqlExecutor) (map[string]interface{}, error) {
+			return dbex.removeRecord(sc, db, params["table"], params["id"])
+		})
+	if err != nil {
+		writeError(w, err)
 		return
 	}
+	recordRows(w, res["deleted"].(int64))
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": res})
+	w.Write(jsonRes)
+}
+
+//removeRecord удаляет запись id из tableName
+func (dbex *DBExplorer) removeRecord(sc *dbSchema, db sqlExecutor, tableName string,
+	id string) (map[string]interface{}, error) {
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		return nil, APIError{http.StatusNotFound, fmt.Errorf("unknown table")}
+	}
+
+	args := &sqlArgs{dialect: dbex.dialect}
+	sqlReq := "DELETE FROM " + dbex.quoteTable(sc, tableName)
+	column := dbex.softDeleteColumn(tableInfo)
+	if column != nil {
+		//мягкое удаление: только отмечаем время удаления
+		now, err := dbex.validateParametrs(time.Now().UTC().Format(time.RFC3339), column)
+		if err != nil {
+			return nil, err
+		}
+		sqlReq = "UPDATE " + dbex.quoteTable(sc, tableName) + " SET " +
+			dbex.dialect.Quote(column.dbName()) + " = " + args.add(now)
+	}
 
-	result, err := dbex.DB.Exec(fmt.Sprintf(
-		"DELETE FROM %s WHERE id = ?", tableName), params["id"])
+	cond, err := dbex.keyCondition(tableInfo, id, args)
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		return nil, err
+	}
+	sqlReq += " WHERE " + cond
+	if column != nil {
+		sqlReq += " AND " + dbex.dialect.Quote(column.dbName()) + " IS NULL"
+	}
+
+	result, err := db.Exec(sqlReq, args.values...)
+	if err != nil {
+		return nil, err
 	}
 
 	deleted, err := result.RowsAffected()
 	if err != nil {
-		http.Error(w, "500", http.StatusInternalServerError)
+		return nil, err
 	}
 
-	jsonRes, _ := json.Marshal(map[string]interface{}{
-		"response": map[string]interface{}{
-			"deleted": deleted}})
-	w.Write(jsonRes)
+	return map[string]interface{}{
+		"deleted": deleted}, nil
 }
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+//sqlExecutor общий интерфейс *sql.DB и *sql.Tx
+type sqlExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+//ctxQueryer запросы с контекстом у *sql.DB и *sql.Tx
+type ctxQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+//ctxExecutor выполняет запросы с контекстом запроса клиента: запрос к базе
+//прерывается, когда клиент ушёл или вышел таймаут
+type ctxExecutor struct {
+	ctx context.Context
+	db  ctxQueryer
+}
+
+//withContext sqlExecutor, привязанный к ctx
+func withContext(ctx context.Context, db ctxQueryer) sqlExecutor {
+	return &ctxExecutor{ctx: ctx, db: db}
+}
+
+func (ce *ctxExecutor) Exec(query string, args ...interface{}) (sql.Result, error) {
+	result, err := ce.db.ExecContext(ce.ctx, query, args...)
+	return result, ce.wrap(err)
+}
+
+func (ce *ctxExecutor) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	rows, err := ce.db.QueryContext(ce.ctx, query, args...)
+	return rows, ce.wrap(err)
+}
+
+func (ce *ctxExecutor) QueryRow(query string, args ...interface{}) *sql.Row {
+	return ce.db.QueryRowContext(ce.ctx, query, args...)
+}
+
+//wrap драйверы по-разному сообщают о прерванном запросе,
+//поэтому причину берём из самого контекста
+func (ce *ctxExecutor) wrap(err error) error {
+	if err != nil && ce.ctx.Err() != nil {
+		return ce.ctx.Err()
+	}
+	return err
+}
+
+//Dialect прячет особенности конкретной СУБД: получение схемы,
+//экранирование имён, вид плейсхолдеров и получение id новой записи
+type Dialect interface {
+	//Name имя диалекта
+	Name() string
+	//Tables возвращает список таблиц базы
+	Tables(db sqlExecutor) ([]string, error)
+	//Columns возвращает метаданные столбцов таблицы
+	Columns(db sqlExecutor, table string) ([]*Column, error)
+	//ForeignKeys возвращает внешние ключи таблицы
+	ForeignKeys(db sqlExecutor, table string) ([]*ForeignKey, error)
+	//Quote экранирует имя таблицы или столбца
+	Quote(ident string) string
+	//Placeholder возвращает плейсхолдер для n-го (начиная с 1) аргумента
+	Placeholder(n int) string
+	//ForUpdate окончание SELECT, блокирующее строки до конца транзакции
+	ForUpdate() string
+	//Insert выполняет INSERT и возвращает значение primary key новой записи
+	Insert(db sqlExecutor, query string, priName string,
+		args ...interface{}) (int64, error)
+	//DefaultValues окончание INSERT INTO t, когда все столбцы берутся
+	//по-умолчанию
+	DefaultValues() string
+	//Upsert окончание INSERT, которое при конфликте по keys
+	//вместо вставки обновляет columns существующей строки.
+	//Пусто - диалект так не умеет, запись обновляется через UPDATE
+	Upsert(keys []string, columns []string) string
+	//Syntax кавычки и комментарии, по которым консоль разбирает запрос
+	Syntax() sqlSyntax
+}
+
+//DialectByDriver выбирает диалект по имени драйвера database/sql
+func DialectByDriver(driverName string) (Dialect, error) {
+	switch strings.ToLower(driverName) {
+	case "mysql":
+		return MySQLDialect{}, nil
+	case "postgres", "postgresql", "pq", "pgx", "stdlib":
+		return PostgresDialect{}, nil
+	case "sqlite", "sqlite3":
+		return SQLiteDialect{}, nil
+	}
+	return nil, fmt.Errorf("unsupported driver %q", driverName)
+}
+
+//detectDialect угадывает диалект по типу драйвера, например *mysql.MySQLDriver
+func detectDialect(db *sql.DB) (Dialect, error) {
+	t := reflect.TypeOf(db.Driver())
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	//имя пакета драйвера: mysql, sqlite3, pq, stdlib
+	pkg := strings.SplitN(t.String(), ".", 2)[0]
+	if d, err := DialectByDriver(pkg); err == nil {
+		return d, nil
+	}
+	return nil, fmt.Errorf("can not detect dialect for driver %s", t.String())
+}
+
+//quoteWith экранирует ident кавычкой q, удваивая её внутри имени
+func quoteWith(ident string, q string) string {
+	return q + strings.Replace(ident, q, q+q, -1) + q
+}
+
+//scanForeignKeys читает строки вида (name, column, ref_table, ref_column)
+//и отбрасывает составные внешние ключи, их мы не поддерживаем
+func scanForeignKeys(rows *sql.Rows) ([]*ForeignKey, error) {
+	defer rows.Close()
+
+	fks := make([]*ForeignKey, 0)
+	count := make(map[string]int)
+	for rows.Next() {
+		fk := &ForeignKey{}
+		if err := rows.Scan(&fk.Name, &fk.Column, &fk.RefTable,
+			&fk.RefColumn); err != nil {
+			return nil, err
+		}
+		count[fk.Name]++
+		fks = append(fks, fk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	single := make([]*ForeignKey, 0, len(fks))
+	for _, fk := range fks {
+		if count[fk.Name] == 1 {
+			single = append(single, fk)
+		}
+	}
+	return single, nil
+}
+
+//insertLastID выполняет INSERT и достаёт id через LastInsertId
+func insertLastID(db sqlExecutor, query string, args ...interface{}) (int64, error) {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+//MySQLDialect диалект MySQL
+type MySQLDialect struct{}
+
+//Name имя диалекта
+func (MySQLDialect) Name() string { return "mysql" }
+
+//Tables список таблиц через SHOW TABLES
+func (MySQLDialect) Tables(db sqlExecutor) ([]string, error) {
+	rows, err := db.Query("SHOW TABLES")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+//Columns метаданные через SHOW COLUMNS FROM
+func (d MySQLDialect) Columns(db sqlExecutor, table string) ([]*Column, error) {
+	rows, err := db.Query("SHOW COLUMNS FROM " + d.Quote(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make([]*Column, 0)
+	for rows.Next() {
+		colInfo := &Column{}
+		var def sql.NullString
+		if err := rows.Scan(&colInfo.Field, &colInfo.Type, &colInfo.Null,
+			&colInfo.Key, &def, &colInfo.Extra); err != nil {
+			return nil, err
+		}
+		colInfo.Default = def.String
+		columns = append(columns, colInfo)
+	}
+	return columns, rows.Err()
+}
+
+//ForeignKeys внешние ключи из information_schema.KEY_COLUMN_USAGE
+func (MySQLDialect) ForeignKeys(db sqlExecutor, table string) ([]*ForeignKey, error) {
+	rows, err := db.Query(`SELECT CONSTRAINT_NAME, COLUMN_NAME,
+			REFERENCED_TABLE_NAME, REFERENCED_COLUMN_NAME
+		FROM information_schema.KEY_COLUMN_USAGE
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?
+			AND REFERENCED_TABLE_NAME IS NOT NULL
+		ORDER BY CONSTRAINT_NAME, ORDINAL_POSITION`, table)
+	if err != nil {
+		return nil, err
+	}
+	return scanForeignKeys(rows)
+}
+
+//Quote экранирует обратными кавычками
+func (MySQLDialect) Quote(ident string) string { return quoteWith(ident, "`") }
+
+//Placeholder всегда ?
+func (MySQLDialect) Placeholder(n int) string { return "?" }
+
+func (MySQLDialect) ForUpdate() string { return " FOR UPDATE" }
+
+//DefaultValues DEFAULT VALUES в MySQL нет, пустой список столбцов есть
+func (MySQLDialect) DefaultValues() string { return " () VALUES ()" }
+
+//Insert id берётся из LastInsertId
+func (MySQLDialect) Insert(db sqlExecutor, query string, priName string,
+	args ...interface{}) (int64, error) {
+	return insertLastID(db, query, args...)
+}
+
+//Upsert ON DUPLICATE KEY UPDATE. Он срабатывает на любом уникальном
+//индексе, поэтому столбцы меняются, только если у найденной строки
+//тот же primary key: чужую строку с тем же значением уникального
+//столбца он не перезаписывает
+func (d MySQLDialect) Upsert(keys []string, columns []string) string {
+	same := make([]string, 0, len(keys))
+	for _, key := range keys {
+		same = append(same, d.Quote(key)+" <=> VALUES("+d.Quote(key)+")")
+	}
+	cond := strings.Join(same, " AND ")
+
+	res := " ON DUPLICATE KEY UPDATE "
+	if len(columns) == 0 {
+		return res + d.Quote(keys[0]) + " = " + d.Quote(keys[0])
+	}
+	sets := make([]string, 0, len(columns))
+	for _, column := range columns {
+		sets = append(sets, d.Quote(column)+" = IF("+cond+", VALUES("+
+			d.Quote(column)+"), "+d.Quote(column)+")")
+	}
+	return res + strings.Join(sets, ", ")
+}
+
+//Syntax строки в '' и "" с экранированием \, имена в ``, комментарии
+//через # и через -- с пробелом
+func (MySQLDialect) Syntax() sqlSyntax {
+	return sqlSyntax{
+		quotes:       map[byte]byte{'\'': '\'', '"': '"', '`': '`'},
+		backslash:    `'"`,
+		hashComments: true,
+		dashSpace:    true,
+	}
+}
+
+//PostgresDialect диалект PostgreSQL
+type PostgresDialect struct{}
+
+//Name имя диалекта
+func (PostgresDialect) Name() string { return "postgres" }
+
+//Tables список таблиц текущей схемы из information_schema
+func (PostgresDialect) Tables(db sqlExecutor) ([]string, error) {
+	rows, err := db.Query(`SELECT table_name FROM information_schema.tables
+		WHERE table_schema = current_schema() AND table_type = 'BASE TABLE'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+//Columns метаданные из information_schema.columns, primary key
+//определяется по table_constraints
+func (PostgresDialect) Columns(db sqlExecutor, table string) ([]*Column, error) {
+	rows, err := db.Query(`SELECT c.column_name, c.data_type,
+			c.character_maximum_length, c.is_nullable, c.column_default,
+			EXISTS (
+				SELECT 1 FROM information_schema.table_constraints tc
+				JOIN information_schema.key_column_usage kcu
+					ON tc.constraint_name = kcu.constraint_name
+					AND tc.table_schema = kcu.table_schema
+				WHERE tc.constraint_type = 'PRIMARY KEY'
+					AND tc.table_schema = c.table_schema
+					AND tc.table_name = c.table_name
+					AND kcu.column_name = c.column_name
+			)
+		FROM information_schema.columns c
+		WHERE c.table_schema = current_schema() AND c.table_name = $1
+		ORDER BY c.ordinal_position`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make([]*Column, 0)
+	for rows.Next() {
+		colInfo := &Column{}
+		var (
+			maxLen sql.NullInt64
+			def    sql.NullString
+			isPri  bool
+		)
+		if err := rows.Scan(&colInfo.Field, &colInfo.Type, &maxLen,
+			&colInfo.Null, &def, &isPri); err != nil {
+			return nil, err
+		}
+
+		colInfo.Type = postgresType(colInfo.Type, maxLen)
+		if isPri {
+			colInfo.Key = "PRI"
+		}
+		//serial-столбцы выглядят как nextval('..._seq'::regclass)
+		if strings.HasPrefix(def.String, "nextval(") {
+			colInfo.Extra = "auto_increment"
+		} else {
+			colInfo.Default = def.String
+		}
+		columns = append(columns, colInfo)
+	}
+	return columns, rows.Err()
+}
+
+//ForeignKeys внешние ключи из table_constraints и constraint_column_usage
+func (PostgresDialect) ForeignKeys(db sqlExecutor, table string) ([]*ForeignKey, error) {
+	rows, err := db.Query(`SELECT tc.constraint_name, kcu.column_name,
+			ccu.table_name, ccu.column_name
+		FROM information_schema.table_constraints tc
+		JOIN information_schema.key_column_usage kcu
+			ON tc.constraint_name = kcu.constraint_name
+			AND tc.table_schema = kcu.table_schema
+		JOIN information_schema.constraint_column_usage ccu
+			ON tc.constraint_name = ccu.constraint_name
+			AND tc.table_schema = ccu.table_schema
+		WHERE tc.constraint_type = 'FOREIGN KEY'
+			AND tc.table_schema = current_schema() AND tc.table_name = $1
+		ORDER BY tc.constraint_name, kcu.ordinal_position`, table)
+	if err != nil {
+		return nil, err
+	}
+	return scanForeignKeys(rows)
+}
+
+//postgresType приводит имя типа PostgreSQL к виду, похожему на MySQL,
+//чтобы дальше с ним работала общая валидация
+func postgresType(dataType string, maxLen sql.NullInt64) string {
+	switch dataType {
+	case "character varying":
+		if maxLen.Valid {
+			return "varchar(" + strconv.FormatInt(maxLen.Int64, 10) + ")"
+		}
+		return "text"
+	case "character":
+		return "char(" + strconv.FormatInt(maxLen.Int64, 10) + ")"
+	case "integer":
+		return "int"
+	case "real", "double precision":
+		return "float"
+	}
+	return dataType
+}
+
+//Quote экранирует двойными кавычками
+func (PostgresDialect) Quote(ident string) string { return quoteWith(ident, `"`) }
+
+//Placeholder нумерованные $1, $2, ...
+func (PostgresDialect) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+func (PostgresDialect) ForUpdate() string { return " FOR UPDATE" }
+
+//DefaultValues пустой список столбцов PostgreSQL не принимает
+func (PostgresDialect) DefaultValues() string { return " DEFAULT VALUES" }
+
+//Insert LastInsertId в PostgreSQL не поддерживается, используем RETURNING
+func (d PostgresDialect) Insert(db sqlExecutor, query string, priName string,
+	args ...interface{}) (int64, error) {
+	if priName == "" {
+		_, err := db.Exec(query, args...)
+		return 0, err
+	}
+
+	var id int64
+	err := db.QueryRow(query+" RETURNING "+d.Quote(priName), args...).Scan(&id)
+	return id, err
+}
+
+//Upsert ON CONFLICT ... DO UPDATE
+func (d PostgresDialect) Upsert(keys []string, columns []string) string {
+	return onConflict(d, keys, columns)
+}
+
+//Syntax строки E'...' и $tag$...$tag$, вложенные комментарии
+func (PostgresDialect) Syntax() sqlSyntax {
+	return sqlSyntax{
+		quotes:         map[byte]byte{'\'': '\'', '"': '"'},
+		eStrings:       true,
+		dollarQuotes:   true,
+		nestedComments: true,
+	}
+}
+
+//onConflict ON CONFLICT (keys) DO UPDATE, общий для PostgreSQL и SQLite
+func onConflict(d Dialect, keys []string, columns []string) string {
+	quoted := make([]string, 0, len(keys))
+	for _, key := range keys {
+		quoted = append(quoted, d.Quote(key))
+	}
+	res := " ON CONFLICT (" + strings.Join(quoted, ", ") + ")"
+	if len(columns) == 0 {
+		return res + " DO NOTHING"
+	}
+
+	sets := make([]string, 0, len(columns))
+	for _, column := range columns {
+		sets = append(sets, d.Quote(column)+" = excluded."+d.Quote(column))
+	}
+	return res + " DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+//SQLiteDialect диалект SQLite
+type SQLiteDialect struct{}
+
+//Name имя диалекта
+func (SQLiteDialect) Name() string { return "sqlite" }
+
+//Tables список таблиц из sqlite_master без служебных sqlite_*
+func (SQLiteDialect) Tables(db sqlExecutor) ([]string, error) {
+	rows, err := db.Query(`SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name NOT LIKE 'sqlite_%'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+	return tables, rows.Err()
+}
+
+//Columns метаданные через PRAGMA table_info
+func (d SQLiteDialect) Columns(db sqlExecutor, table string) ([]*Column, error) {
+	rows, err := db.Query("PRAGMA table_info(" + d.Quote(table) + ")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make([]*Column, 0)
+	for rows.Next() {
+		var (
+			cid     int
+			notNull int
+			pk      int
+			def     sql.NullString
+		)
+		colInfo := &Column{}
+		if err := rows.Scan(&cid, &colInfo.Field, &colInfo.Type, &notNull,
+			&def, &pk); err != nil {
+			return nil, err
+		}
+
+		//в SQLite тип хранится как его написали в CREATE TABLE
+		colInfo.Type = strings.ToLower(colInfo.Type)
+		colInfo.Null = "YES"
+		if notNull != 0 || pk != 0 {
+			colInfo.Null = "NO"
+		}
+		if pk != 0 {
+			colInfo.Key = "PRI"
+		}
+		//DEFAULT NULL в SQLite приходит строкой NULL, а в MySQL как NULL
+		if !strings.EqualFold(def.String, "NULL") {
+			colInfo.Default = strings.Trim(def.String, "'")
+		}
+		columns = append(columns, colInfo)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	//одиночный INTEGER PRIMARY KEY является синонимом rowid
+	keys := primaryKeys(columns)
+	if len(keys) == 1 && keys[0].Type == "integer" {
+		keys[0].Extra = "auto_increment"
+	}
+	return columns, nil
+}
+
+//ForeignKeys внешние ключи через PRAGMA foreign_key_list, у ключей
+//в SQLite нет имён, поэтому имя собирается из id ограничения
+func (d SQLiteDialect) ForeignKeys(db sqlExecutor, table string) ([]*ForeignKey, error) {
+	rows, err := db.Query(`SELECT 'fk_' || id, "from", "table", COALESCE("to", '')
+		FROM pragma_foreign_key_list(` + quoteWith(table, "'") + `)
+		ORDER BY id, seq`)
+	if err != nil {
+		return nil, err
+	}
+	return scanForeignKeys(rows)
+}
+
+//Quote экранирует двойными кавычками
+func (SQLiteDialect) Quote(ident string) string { return quoteWith(ident, `"`) }
+
+//Placeholder всегда ?
+func (SQLiteDialect) Placeholder(n int) string { return "?" }
+
+//ForUpdate в SQLite нет, пишущие транзакции и так идут по одной
+func (SQLiteDialect) ForUpdate() string { return "" }
+
+//DefaultValues пустой список столбцов SQLite не принимает
+func (SQLiteDialect) DefaultValues() string { return " DEFAULT VALUES" }
+
+//Insert id берётся из LastInsertId
+func (SQLiteDialect) Insert(db sqlExecutor, query string, priName string,
+	args ...interface{}) (int64, error) {
+	return insertLastID(db, query, args...)
+}
+
+//Upsert ON CONFLICT ... DO UPDATE, есть с SQLite 3.24
+func (d SQLiteDialect) Upsert(keys []string, columns []string) string {
+	return onConflict(d, keys, columns)
+}
+
+//Syntax имена бывают в "", `` и [], \ ничего не экранирует
+func (SQLiteDialect) Syntax() sqlSyntax {
+	return sqlSyntax{
+		quotes: map[byte]byte{'\'': '\'', '"': '"', '`': '`', '[': ']'},
+	}
+}
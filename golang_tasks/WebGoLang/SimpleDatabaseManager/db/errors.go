@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+//APIError ошибка с http-статусом, который надо отдать клиенту
+type APIError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae APIError) Error() string {
+	return ae.Err.Error()
+}
+
+//errorCodes машиночитаемые коды ошибок для поля "code"
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "too_large",
+	http.StatusInternalServerError:   "internal",
+	http.StatusGatewayTimeout:        "timeout",
+}
+
+//Code код ошибки по http-статусу
+func (ae APIError) Code() string {
+	if code, ok := errorCodes[ae.HTTPStatus]; ok {
+		return code
+	}
+	return "error"
+}
+
+//errorRecorder обёртки над ResponseWriter, которые запоминают
+//настоящую причину ошибки для лога
+type errorRecorder interface {
+	recordError(err error)
+}
+
+//writeError отдаёт ошибку как {"error": ..., "code": ...}. Ошибки без
+//http-статуса отдаются как 500 без подробностей, причина уходит в лог
+func writeError(w http.ResponseWriter, err error) {
+	writeErrorWith(w, err, nil)
+}
+
+//apiError ошибка в том виде, в каком она уходит клиенту. Ошибки без
+//http-статуса превращаются в 500 без подробностей
+func apiError(err error) APIError {
+	//запрос к базе не уложился в таймаут маршрута
+	if errors.Is(err, context.DeadlineExceeded) {
+		return APIError{http.StatusGatewayTimeout, fmt.Errorf("query timeout")}
+	}
+	if apiErr, ok := err.(APIError); ok {
+		return apiErr
+	}
+	return APIError{http.StatusInternalServerError, fmt.Errorf("internal error")}
+}
+
+//writeErrorWith то же, что writeError, но с дополнительными полями ответа
+func writeErrorWith(w http.ResponseWriter, err error, extra map[string]interface{}) {
+	if rec, ok := w.(errorRecorder); ok {
+		rec.recordError(err)
+	}
+	apiErr := apiError(err)
+
+	res := map[string]interface{}{
+		"error": apiErr.Error(),
+		"code":  apiErr.Code()}
+	for key, value := range extra {
+		res[key] = value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.HTTPStatus)
+	jsonRes, _ := json.Marshal(res)
+	w.Write(jsonRes)
+}
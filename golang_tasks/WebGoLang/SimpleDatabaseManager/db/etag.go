@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//newSecret случайный ключ для DBExplorer.Secret
+func newSecret() ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+//recordETag версия записи - HMAC всех её столбцов с ключом Secret.
+//Скрытые столбцы тоже меняют версию, но подобрать их по ней нельзя
+func (dbex *DBExplorer) recordETag(record map[string]interface{}) string {
+	//ключи map при маршалинге сортируются, поэтому хэш стабилен
+	data, _ := json.Marshal(record)
+	mac := hmac.New(sha256.New, dbex.Secret)
+	mac.Write(data)
+	return "\"" + hex.EncodeToString(mac.Sum(nil)[:16]) + "\""
+}
+
+//etagMatches есть ли etag в списке из If-Match/If-None-Match.
+//weak - сравнение для If-None-Match, где W/ не учитывается
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+//fetchRecord читает запись по ключу id, nil - записи нет.
+//lock блокирует строку до конца транзакции db
+func (dbex *DBExplorer) fetchRecord(sc *dbSchema, db sqlExecutor, tableName string,
+	tableInfo []*Column, id string, lock bool) (map[string]interface{}, error) {
+	args := &sqlArgs{dialect: dbex.dialect}
+	cond, err := dbex.keyCondition(tableInfo, id, args)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlReq := "SELECT * FROM " + dbex.quoteTable(sc, tableName) + " WHERE " + cond
+	if lock {
+		sqlReq += dbex.dialect.ForUpdate()
+	}
+	rows, err := db.Query(sqlReq, args.values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tableData, err := dbex.readDBData(rows, tableInfo)
+	if err != nil || len(tableData) == 0 {
+		return nil, err
+	}
+	return tableData[0], nil
+}
+
+//changeRecord выполняет изменение fn записи id (для create id пустой).
+//Если пришёл If-Match, включён журнал или это upsert, изменение идёт
+//в транзакции: версия записи проверяется с блокировкой строки, запись
+//в журнал коммитится вместе с изменением, а upsert решает, вставлять или
+//обновлять, по записи из той же транзакции. Об успешном изменении
+//публикуется событие
+func (dbex *DBExplorer) changeRecord(sc *dbSchema, r *http.Request, tableName string, id string,
+	action string, fn func(db sqlExecutor) (map[string]interface{}, error)) (map[string]interface{}, error) {
+	ifMatch := ""
+	if id != "" {
+		ifMatch = r.Header.Get("If-Match")
+	}
+	if ifMatch == "" && dbex.audit == nil && action != "upsert" {
+		res, err := fn(dbex.conn(r))
+		if err == nil {
+			dbex.publishChange(sc, tableName, id, action, res)
+		}
+		return res, err
+	}
+
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		return nil, APIError{http.StatusNotFound, fmt.Errorf("unknown table")}
+	}
+
+	tx, err := dbex.DB.BeginTx(r.Context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	db := withContext(r.Context(), tx)
+
+	if ifMatch != "" {
+		record, err := dbex.fetchRecord(sc, db, tableName, tableInfo, id, true)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if record == nil || !etagMatches(ifMatch, dbex.recordETag(record), false) {
+			tx.Rollback()
+			return nil, APIError{http.StatusPreconditionFailed,
+				fmt.Errorf("record was modified")}
+		}
+	}
+
+	res, err := dbex.audited(r.Context(), sc, db, tableName, id, action,
+		func() (map[string]interface{}, error) {
+			return fn(db)
+		})
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	dbex.publishChange(sc, tableName, id, action, res)
+	return res, nil
+}
+
+//setETag отдаёт в заголовке версию записи после изменения
+func (dbex *DBExplorer) setETag(w http.ResponseWriter, r *http.Request,
+	sc *dbSchema, tableName string, id string) {
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		return
+	}
+	record, err := dbex.fetchRecord(sc, dbex.conn(r), tableName, tableInfo, id, false)
+	if err == nil && record != nil {
+		w.Header().Set("ETag", dbex.recordETag(record))
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	//eventHistorySize сколько последних событий хранится для Last-Event-ID
+	eventHistorySize = 1000
+	//eventBufferSize события, ждущие отправки одному подписчику
+	eventBufferSize = 64
+	//changesHeartbeat как часто слать комментарий, чтобы прокси не рвали поток
+	changesHeartbeat = 15 * time.Second
+)
+
+//ChangeEvent изменение записи, сделанное через DBExplorer
+type ChangeEvent struct {
+	ID uint64 `json:"id"`
+	//Type created, updated или deleted
+	Type  string    `json:"type"`
+	Table string    `json:"table"`
+	Key   string    `json:"key"`
+	Time  time.Time `json:"time"`
+}
+
+//subscriber получатель событий одной таблицы
+type subscriber struct {
+	table string
+	ch    chan *ChangeEvent
+}
+
+//eventBus шина событий внутри процесса. Последние события хранятся,
+//чтобы переподключившийся клиент получил пропущенное
+type eventBus struct {
+	mu      *sync.Mutex
+	lastID  uint64
+	history []*ChangeEvent
+	subs    map[*subscriber]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		mu:      &sync.Mutex{},
+		history: make([]*ChangeEvent, 0, eventHistorySize),
+		subs:    make(map[*subscriber]struct{}),
+	}
+}
+
+//publish раздаёт событие подписчикам его таблицы. Подписчик, который
+//не успевает читать, отключается: он переподключится с Last-Event-ID
+func (eb *eventBus) publish(ev *ChangeEvent) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	eb.lastID++
+	ev.ID = eb.lastID
+	if len(eb.history) == eventHistorySize {
+		copy(eb.history, eb.history[1:])
+		eb.history = eb.history[:eventHistorySize-1]
+	}
+	eb.history = append(eb.history, ev)
+
+	for sub := range eb.subs {
+		if sub.table != ev.Table {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			delete(eb.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+//subscribe подписывает на события таблицы и отдаёт события после lastID.
+//complete - пропущенные события есть целиком, иначе клиенту надо
+//перечитать таблицу
+func (eb *eventBus) subscribe(table string,
+	lastID uint64) (sub *subscriber, backlog []*ChangeEvent, complete bool) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+
+	complete = lastID <= eb.lastID
+	if len(eb.history) != 0 && lastID+1 < eb.history[0].ID {
+		complete = false
+	}
+	if complete {
+		for _, ev := range eb.history {
+			if ev.ID > lastID && ev.Table == table {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+
+	sub = &subscriber{table: table, ch: make(chan *ChangeEvent, eventBufferSize)}
+	eb.subs[sub] = struct{}{}
+	return sub, backlog, complete
+}
+
+func (eb *eventBus) unsubscribe(sub *subscriber) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	if _, ok := eb.subs[sub]; ok {
+		delete(eb.subs, sub)
+		close(sub.ch)
+	}
+}
+
+//changeTypes тип события по действию над записью
+var changeTypes = map[string]string{
+	"create":  "created",
+	"update":  "updated",
+	"delete":  "deleted",
+	"restore": "updated",
+	"upsert":  "updated",
+}
+
+//publishChange публикует событие об успешном изменении записи и
+//сбрасывает кэш ответов таблицы и таблиц, которые на неё ссылаются.
+//res - ответ insertRecord, modifyRecord, upsertRecord, removeRecord
+//или undeleteRecord
+func (dbex *DBExplorer) publishChange(sc *dbSchema, tableName string, id string,
+	action string, res map[string]interface{}) {
+	for _, counter := range []string{"updated", "deleted", "restored"} {
+		if n, ok := res[counter].(int64); ok && n == 0 {
+			return
+		}
+	}
+	if dbex.Cache != nil {
+		dbex.invalidateTable(sc, tableName)
+	}
+	if action == "create" {
+		id = recordID(sc.tablesInfo[tableName], res)
+	}
+	eventType := changeTypes[action]
+	if action == "upsert" && res["created"] == true {
+		eventType = changeTypes["create"]
+	}
+	dbex.events.publish(&ChangeEvent{
+		Type:  eventType,
+		Table: tableName,
+		Key:   id,
+		Time:  time.Now().UTC(),
+	})
+}
+
+//writeEvent пишет событие в формате text/event-stream
+func writeEvent(w http.ResponseWriter, id string, event string, data interface{}) {
+	payload, _ := json.Marshal(data)
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
+
+//tableChanges GET /{table}/_changes - поток изменений таблицы в виде
+//Server-Sent Events. Last-Event-ID (или ?last_event_id=) досылает
+//пропущенные события, если их уже нет - приходит событие reset
+func (dbex *DBExplorer) tableChanges(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	tableName := params["table"]
+	if _, ok := sc.tablesInfo[tableName]; !ok {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	if _, err := dbex.checkRead(sc, req, tableName); err != nil {
+		writeError(w, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	resume := lastEventID != ""
+	if resume {
+		var err error
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			writeError(w, APIError{http.StatusBadRequest,
+				fmt.Errorf("invalid Last-Event-ID")})
+			return
+		}
+	}
+
+	sub, backlog, complete := dbex.events.subscribe(tableName, lastID)
+	defer dbex.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if resume && !complete {
+		writeEvent(w, "", "reset", map[string]interface{}{"table": tableName})
+	}
+	if resume {
+		for _, ev := range backlog {
+			writeEvent(w, strconv.FormatUint(ev.ID, 10), ev.Type, ev)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(changesHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case ev, ok := <-sub.ch:
+			if !ok {
+				//отстали от потока, клиент переподключится с Last-Event-ID
+				return
+			}
+			writeEvent(w, strconv.FormatUint(ev.ID, 10), ev.Type, ev)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//importBatchSize строк в одной транзакции импорта по-умолчанию
+	importBatchSize = 500
+	//importMaxErrors больше ошибок в ответ на импорт не попадает
+	importMaxErrors = 100
+	//exportFlushRows через сколько строк экспорт проталкивает данные клиенту
+	exportFlushRows = 100
+)
+
+//exportFormat формат из ?format=, по-умолчанию ndjson
+func exportFormat(req *http.Request) (string, error) {
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		//для импорта формат можно передать через Content-Type
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "text/csv") {
+			return "csv", nil
+		}
+		return "ndjson", nil
+	}
+	if format != "csv" && format != "ndjson" {
+		return "", APIError{http.StatusBadRequest,
+			fmt.Errorf("unknown format %s", format)}
+	}
+	return format, nil
+}
+
+//csvValue значение столбца в ячейке CSV, NULL - пустая ячейка
+func csvValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case []byte:
+		return base64.StdEncoding.EncodeToString(x)
+	case json.RawMessage:
+		return string(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+//idleContext отменяется, если между вызовами touch прошло больше
+//timeout, timeout 0 - не отменяется. Err тогда DeadlineExceeded, как
+//у обычного таймаута
+type idleContext struct {
+	context.Context
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+	expired int32
+}
+
+//withIdleTimeout контекст ctx, который отменяется после timeout без touch
+func withIdleTimeout(ctx context.Context, timeout time.Duration) *idleContext {
+	ic := &idleContext{timeout: timeout}
+	ic.Context, ic.cancel = context.WithCancel(ctx)
+	if timeout > 0 {
+		ic.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&ic.expired, 1)
+			ic.cancel()
+		})
+	}
+	return ic
+}
+
+func (ic *idleContext) Err() error {
+	if atomic.LoadInt32(&ic.expired) == 1 {
+		return context.DeadlineExceeded
+	}
+	return ic.Context.Err()
+}
+
+//touch откладывает отмену ещё на timeout
+func (ic *idleContext) touch() {
+	if ic.timer != nil {
+		ic.timer.Reset(ic.timeout)
+	}
+}
+
+//stop освобождает таймер и контекст
+func (ic *idleContext) stop() {
+	if ic.timer != nil {
+		ic.timer.Stop()
+	}
+	ic.cancel()
+}
+
+//exportTable отдаёт всю таблицу (с учётом where, order и fields) в CSV
+//или NDJSON, строки пишутся клиенту по мере чтения из базы. Общего
+//таймаута у выгрузки нет, но каждая строка должна прийти из базы за
+//QueryTimeout. Если выгрузка оборвалась, последней идёт запись об
+//ошибке: в NDJSON {"error": ..., "code": ...}, в CSV строка "#error",
+//код и текст, а также трейлер X-Export-Error
+func (dbex *DBExplorer) exportTable(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	tableName := params["table"]
+	sc := dbex.schema()
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	tp, err := dbex.checkRead(sc, req, tableName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	format, err := exportFormat(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	lq, err := dbex.parseListQuery(tp.visible(tableInfo), req.URL.Query())
+	if err != nil {
+		writeError(w, APIError{http.StatusBadRequest, err})
+		return
+	}
+	dbex.hideDeleted(lq, tableInfo, req.URL.Query())
+
+	ctx := withIdleTimeout(req.Context(), dbex.QueryTimeout)
+	defer ctx.stop()
+	rows, err := withContext(ctx, dbex.DB).Query(lq.selectSQL(dbex.dialect, sc.dbTable(tableName)),
+		lq.args.values...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer rows.Close()
+
+	rs, err := newRowScanner(rows, tableInfo)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	//скрытые столбцы могли прийти из SELECT *
+	visible := make([]int, 0, len(rs.cols))
+	header := make([]string, 0, len(rs.cols))
+	for i, column := range rs.cols {
+		if !tp.isHidden(column) {
+			visible = append(visible, i)
+			header = append(header, column)
+		}
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition",
+		"attachment; filename=\""+tableName+"."+format+"\"")
+	w.Header().Set("Trailer", "X-Export-Error")
+
+	bw := bufio.NewWriter(w)
+	cw := csv.NewWriter(bw)
+	if format == "csv" {
+		cw.Write(header)
+	}
+	flusher, _ := w.(http.Flusher)
+
+	var count int64
+	for {
+		values, err := rs.values()
+		if err != nil {
+			//заголовки уже ушли, поэтому об обрыве говорит последняя
+			//запись, иначе неполная выгрузка выглядела бы успешной
+			if rec, ok := w.(errorRecorder); ok {
+				rec.recordError(err)
+			}
+			apiErr := apiError(err)
+			if format == "csv" {
+				cw.Write([]string{"#error", apiErr.Code(), apiErr.Error()})
+			} else {
+				line, _ := json.Marshal(map[string]interface{}{
+					"error": apiErr.Error(),
+					"code":  apiErr.Code()})
+				bw.Write(line)
+				bw.WriteByte('\n')
+			}
+			w.Header().Set("X-Export-Error", apiErr.Error())
+			break
+		}
+		if values == nil {
+			break
+		}
+		ctx.touch()
+
+		if format == "csv" {
+			record := make([]string, 0, len(visible))
+			for _, i := range visible {
+				record = append(record, csvValue(values[i]))
+			}
+			cw.Write(record)
+		} else {
+			entry := make(map[string]interface{}, len(visible))
+			for _, i := range visible {
+				entry[rs.cols[i]] = values[i]
+			}
+			line, _ := json.Marshal(entry)
+			bw.Write(line)
+			bw.WriteByte('\n')
+		}
+
+		count++
+		if count%exportFlushRows == 0 {
+			cw.Flush()
+			bw.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	cw.Flush()
+	bw.Flush()
+}
+
+//importError ошибка в строке line входных данных
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+//importRow строка входных данных с номером строки во входном файле
+type importRow struct {
+	line int
+	body map[string]interface{}
+	err  error
+}
+
+//csvField приводит ячейку CSV к тому виду, в каком значение пришло бы
+//в JSON, дальше оно проверяется как обычное поле записи
+func csvField(cell string, info *Column) interface{} {
+	if info == nil {
+		return cell
+	}
+	if cell == "" && info.Null == "YES" {
+		return nil
+	}
+
+	switch info.columnType().Kind {
+	case KindInt, KindFloat, KindDecimal:
+		return json.Number(cell)
+	case KindBool:
+		if v, err := strconv.ParseBool(cell); err == nil {
+			return v
+		}
+	case KindJSON:
+		var v interface{}
+		decoder := json.NewDecoder(strings.NewReader(cell))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err == nil {
+			return v
+		}
+	}
+	return cell
+}
+
+//importReader читает входные данные построчно, весь файл в память не попадает
+type importReader struct {
+	tableInfo []*Column
+
+	csv    *csv.Reader
+	header []string
+
+	scanner *bufio.Scanner
+	line    int
+	//failed после ошибки чтения дальше читать нечего
+	failed bool
+}
+
+func newImportReader(body io.Reader, format string,
+	tableInfo []*Column) (*importReader, error) {
+	ir := &importReader{tableInfo: tableInfo}
+	if format == "csv" {
+		ir.csv = csv.NewReader(body)
+		header, err := ir.csv.Read()
+		if err != nil {
+			return nil, APIError{http.StatusBadRequest, fmt.Errorf("invalid csv header")}
+		}
+		ir.header = header
+		ir.csv.FieldsPerRecord = len(header)
+		return ir, nil
+	}
+
+	ir.scanner = bufio.NewScanner(body)
+	ir.scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	return ir, nil
+}
+
+//next очередная строка, nil - данные кончились
+func (ir *importReader) next() *importRow {
+	if ir.failed {
+		return nil
+	}
+	if ir.csv != nil {
+		record, err := ir.csv.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if perr, ok := err.(*csv.ParseError); ok {
+			return &importRow{line: perr.StartLine, err: fmt.Errorf("invalid csv")}
+		}
+		if err != nil {
+			ir.failed = true
+			return &importRow{line: ir.line + 1, err: fmt.Errorf("read error")}
+		}
+		ir.line, _ = ir.csv.FieldPos(0)
+
+		row := make(map[string]interface{}, len(ir.header))
+		for i, column := range ir.header {
+			row[column] = csvField(record[i], findColumn(ir.tableInfo, column))
+		}
+		return ir.checked(row)
+	}
+
+	for ir.scanner.Scan() {
+		ir.line++
+		text := strings.TrimSpace(ir.scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		row := make(map[string]interface{})
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		if err := decoder.Decode(&row); err != nil {
+			return &importRow{line: ir.line, err: fmt.Errorf("invalid json")}
+		}
+		return ir.checked(row)
+	}
+	if ir.scanner.Err() != nil {
+		ir.failed = true
+		return &importRow{line: ir.line + 1, err: fmt.Errorf("read error")}
+	}
+	return nil
+}
+
+//checked строка row с текущим номером. Столбец, которого нет в таблице,
+//insertRecord молча пропустил бы, поэтому такая строка - ошибка
+func (ir *importReader) checked(row map[string]interface{}) *importRow {
+	unknown := make([]string, 0)
+	for column := range row {
+		if findColumn(ir.tableInfo, column) == nil {
+			unknown = append(unknown, column)
+		}
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return &importRow{line: ir.line,
+			err: fmt.Errorf("unknown column %s", strings.Join(unknown, ", "))}
+	}
+	return &importRow{line: ir.line, body: row}
+}
+
+//importTable вставляет строки CSV или NDJSON в таблицу пачками по ?batch=
+//строк в одной транзакции. Строки, не прошедшие проверку, пропускаются и
+//попадают в errors. Ошибка базы откатывает текущую пачку и прерывает импорт
+func (dbex *DBExplorer) importTable(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	defer req.Body.Close()
+	tableName := params["table"]
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	if err := dbex.checkWrite(sc, req, tableName, nil); err != nil {
+		writeError(w, err)
+		return
+	}
+	format, err := exportFormat(req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	batchSize := importBatchSize
+	if b := req.URL.Query().Get("batch"); b != "" {
+		if v, err := strconv.Atoi(b); err == nil && v > 0 {
+			batchSize = v
+		}
+	}
+
+	reader, err := newImportReader(req.Body, format, tableInfo)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var inserted, failed int64
+	errs := make([]*importError, 0)
+	addError := func(line int, err error) {
+		failed++
+		if len(errs) < importMaxErrors {
+			errs = append(errs, &importError{Line: line, Error: err.Error()})
+		}
+	}
+
+	aborted := false
+	//следующая строка читается до начала пачки: если данные кончились
+	//ровно на границе, пустая транзакция не открывается
+	row := reader.next()
+	for row != nil {
+		tx, err := dbex.DB.BeginTx(req.Context(), nil)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		db := withContext(req.Context(), tx)
+
+		var batchRows int64
+		created := make([]map[string]interface{}, 0)
+		for ; row != nil; row = reader.next() {
+			if row.err != nil {
+				addError(row.line, row.err)
+				continue
+			}
+			if err := dbex.checkWrite(sc, req, tableName, row.body); err != nil {
+				addError(row.line, err)
+				continue
+			}
+
+			res, err := dbex.audited(req.Context(), sc, db, tableName, "", "create",
+				func() (map[string]interface{}, error) {
+					return dbex.insertRecord(sc, db, tableName, row.body)
+				})
+			if _, isAPI := err.(APIError); isAPI {
+				//проверка не дошла до базы, транзакция цела
+				addError(row.line, err)
+				continue
+			}
+			if err != nil && req.Context().Err() != nil {
+				tx.Rollback()
+				writeError(w, err)
+				return
+			}
+			if err != nil {
+				dbex.logEvent("import_error", map[string]interface{}{
+					"request_id": requestIDFrom(req.Context()),
+					"table":      tableName,
+					"line":       row.line,
+					"error":      err.Error(),
+				})
+				addError(row.line, fmt.Errorf("insert failed, batch rolled back"))
+				failed += batchRows
+				aborted = true
+				break
+			}
+
+			created = append(created, res)
+			batchRows++
+			if batchRows == int64(batchSize) {
+				row = reader.next()
+				break
+			}
+		}
+
+		if aborted {
+			tx.Rollback()
+			break
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, err)
+			return
+		}
+		inserted += batchRows
+		for _, res := range created {
+			dbex.publishChange(sc, tableName, "", "create", res)
+		}
+	}
+	recordRows(w, inserted)
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": map[string]interface{}{
+			"inserted": inserted,
+			"failed":   failed,
+			"aborted":  aborted,
+			"errors":   errs}})
+	w.Write(jsonRes)
+}
@@ -0,0 +1,1095 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//gqlScalars скалярные типы схемы, которых нет среди встроенных в GraphQL
+const gqlScalars = `scalar BigInt
+scalar Decimal
+scalar JSON
+`
+
+const (
+	//gqlMaxFields больше стольких полей в запросе после раскрытия фрагментов
+	//быть не может: фрагменты, раскрывающие другие фрагменты по несколько
+	//раз, растут экспоненциально
+	gqlMaxFields = 10000
+	//gqlMaxDepth предельная вложенность полей запроса
+	gqlMaxDepth = 16
+)
+
+//gqlFilterOps операторы фильтра столбца, те же, что в ?where=column:op:value
+var gqlFilterOps = []string{"eq", "ne", "gt", "gte", "lt", "lte", "like"}
+
+//gqlReserved имена типов, которые нельзя занять типом таблицы
+var gqlReserved = map[string]bool{
+	"Query": true, "Mutation": true, "Filter": true,
+	"BigInt": true, "Decimal": true, "JSON": true,
+	"Int": true, "Float": true, "String": true, "Boolean": true, "ID": true,
+}
+
+//gqlFieldKind чем разрешается поле схемы
+type gqlFieldKind int
+
+const (
+	gqlColumnField gqlFieldKind = iota
+	gqlRelationField
+	gqlListQuery
+	gqlGetQuery
+	gqlCreateMutation
+	gqlUpdateMutation
+	gqlDeleteMutation
+)
+
+//gqlArg аргумент поля, typ в синтаксисе SDL
+type gqlArg struct {
+	name string
+	typ  string
+}
+
+//gqlField поле типа схемы
+type gqlField struct {
+	name string
+	kind gqlFieldKind
+	typ  string
+	args []*gqlArg
+	//object тип вложенного объекта, nil - скалярное поле
+	object *gqlObjectType
+	//table таблица корневого поля Query и Mutation
+	table  string
+	column *Column
+	fk     *ForeignKey
+}
+
+//arg аргумент поля по имени
+func (f *gqlField) arg(name string) *gqlArg {
+	for _, arg := range f.args {
+		if arg.name == name {
+			return arg
+		}
+	}
+	return nil
+}
+
+//gqlObjectType тип таблицы или корневой тип Query/Mutation
+type gqlObjectType struct {
+	name   string
+	table  string
+	policy *TablePolicy
+	fields []*gqlField
+	//inputs столбцы, которые роль может менять
+	inputs []*Column
+}
+
+func (ot *gqlObjectType) field(name string) *gqlField {
+	for _, f := range ot.fields {
+		if f.name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+//add добавляет поле, если имя ещё не занято
+func (ot *gqlObjectType) add(f *gqlField) {
+	if ot.field(f.name) == nil {
+		ot.fields = append(ot.fields, f)
+	}
+}
+
+//gqlSchema схема GraphQL, построенная по tablesInfo с учётом прав роли
+type gqlSchema struct {
+	types    []*gqlObjectType
+	query    *gqlObjectType
+	mutation *gqlObjectType
+}
+
+//gqlValidName подходит ли имя таблицы или столбца для GraphQL
+func gqlValidName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "__") || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isWordByte(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//gqlTypeName имя типа таблицы: audit_log -> AuditLog
+func gqlTypeName(tableName string) string {
+	name := strings.Builder{}
+	for _, part := range strings.Split(tableName, "_") {
+		if part != "" {
+			name.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return name.String()
+}
+
+//gqlScalar скалярный тип GraphQL для столбца
+func gqlScalar(info *Column) string {
+	ct := info.columnType()
+	switch ct.Kind {
+	case KindInt:
+		//Int в GraphQL 32-битный
+		if ct.Bits < 32 || ct.Bits == 32 && !ct.Unsigned {
+			return "Int"
+		}
+		return "BigInt"
+	case KindFloat:
+		return "Float"
+	case KindDecimal:
+		return "Decimal"
+	case KindBool:
+		return "Boolean"
+	case KindJSON:
+		return "JSON"
+	}
+	return "String"
+}
+
+//graphQLSchema строит схему по таблицам, доступным роли запроса:
+//скрытых таблиц и столбцов в ней нет, мутации только для таблиц с правом записи.
+//Таблица items даёт тип Items, запросы items(filter, order, limit, offset)
+//и items_by_id(id), мутации create_items, update_items и delete_items.
+//Внешний ключ author_id становится полем author со связанной записью
+func (dbex *DBExplorer) graphQLSchema(sc *dbSchema, req *http.Request) *gqlSchema {
+	tables := make([]string, 0, len(sc.tablesInfo))
+	for tableName := range sc.tablesInfo {
+		tables = append(tables, tableName)
+	}
+	sort.Strings(tables)
+
+	schema := &gqlSchema{
+		types:    make([]*gqlObjectType, 0, len(tables)),
+		query:    &gqlObjectType{name: "Query"},
+		mutation: &gqlObjectType{name: "Mutation"},
+	}
+	byTable := make(map[string]*gqlObjectType)
+	used := make(map[string]bool)
+	for _, tableName := range tables {
+		tp := dbex.tablePolicy(sc, req, tableName)
+		typeName := gqlTypeName(tableName)
+		if !tp.Read || !gqlValidName(tableName) || typeName == "" ||
+			gqlReserved[typeName] || used[typeName] {
+			continue
+		}
+		used[typeName] = true
+
+		ot := &gqlObjectType{name: typeName, table: tableName, policy: tp}
+		for _, info := range sc.tablesInfo[tableName] {
+			if !gqlValidName(info.Field) {
+				continue
+			}
+			//столбцы только на запись есть лишь во входных типах
+			if tp.isWritable(info.Field) {
+				ot.inputs = append(ot.inputs, info)
+			}
+			if tp.isHidden(info.Field) {
+				continue
+			}
+			typ := gqlScalar(info)
+			if info.Null != "YES" {
+				typ += "!"
+			}
+			ot.add(&gqlField{name: info.Field, kind: gqlColumnField, typ: typ, column: info})
+		}
+		schema.types = append(schema.types, ot)
+		byTable[tableName] = ot
+	}
+
+	for _, ot := range schema.types {
+		//связь по внешнему ключу - поле с записью, на которую он ссылается
+		for _, fk := range sc.foreignKeys[ot.table] {
+			ref, ok := byTable[fk.RefTable]
+			if !ok || ot.field(fk.Column) == nil || !gqlValidName(fk.Relation()) {
+				continue
+			}
+			ot.add(&gqlField{name: fk.Relation(), kind: gqlRelationField,
+				typ: ref.name, object: ref, fk: fk})
+		}
+
+		keyed := len(primaryKeys(sc.tablesInfo[ot.table])) != 0
+		schema.query.add(&gqlField{name: ot.table, kind: gqlListQuery,
+			table: ot.table, typ: "[" + ot.name + "!]", object: ot, args: []*gqlArg{
+				{"filter", ot.name + "Filter"},
+				{"order", "[String!]"},
+				{"limit", "Int"},
+				{"offset", "Int"},
+				{"include_deleted", "Boolean"},
+			}})
+		if keyed {
+			schema.query.add(&gqlField{name: ot.table + "_by_id", kind: gqlGetQuery,
+				table: ot.table, typ: ot.name, object: ot, args: []*gqlArg{
+					{"id", "ID!"},
+					{"include_deleted", "Boolean"},
+				}})
+		}
+
+		if !ot.policy.Write {
+			continue
+		}
+		schema.mutation.add(&gqlField{name: "create_" + ot.table, kind: gqlCreateMutation,
+			table: ot.table, typ: ot.name, object: ot, args: []*gqlArg{{"input", ot.name + "Input!"}}})
+		if keyed {
+			schema.mutation.add(&gqlField{name: "update_" + ot.table, kind: gqlUpdateMutation,
+				table: ot.table, typ: ot.name, object: ot, args: []*gqlArg{
+					{"id", "ID!"},
+					{"input", ot.name + "Input!"},
+				}})
+			schema.mutation.add(&gqlField{name: "delete_" + ot.table, kind: gqlDeleteMutation,
+				table: ot.table, typ: "Int", args: []*gqlArg{{"id", "ID!"}}})
+		}
+	}
+	return schema
+}
+
+//sdl схема в синтаксисе GraphQL SDL
+func (schema *gqlSchema) sdl() string {
+	buf := &bytes.Buffer{}
+	buf.WriteString(gqlScalars)
+
+	buf.WriteString("\ninput Filter {\n")
+	for _, op := range gqlFilterOps {
+		buf.WriteString("  " + op + ": String\n")
+	}
+	buf.WriteString("  is_null: Boolean\n}\n")
+
+	writeType := func(kind string, name string, fields []*gqlField) {
+		if len(fields) == 0 {
+			return
+		}
+		buf.WriteString("\n" + kind + " " + name + " {\n")
+		for _, f := range fields {
+			buf.WriteString("  " + f.name)
+			if len(f.args) != 0 {
+				args := make([]string, 0, len(f.args))
+				for _, arg := range f.args {
+					args = append(args, arg.name+": "+arg.typ)
+				}
+				buf.WriteString("(" + strings.Join(args, ", ") + ")")
+			}
+			buf.WriteString(": " + f.typ + "\n")
+		}
+		buf.WriteString("}\n")
+	}
+
+	for _, ot := range schema.types {
+		writeType("type", ot.name, ot.fields)
+
+		filters := make([]*gqlField, 0, len(ot.fields))
+		for _, f := range ot.fields {
+			if f.kind == gqlColumnField {
+				filters = append(filters, &gqlField{name: f.name, typ: "Filter"})
+			}
+		}
+		writeType("input", ot.name+"Filter", filters)
+
+		if ot.policy.Write {
+			inputs := make([]*gqlField, 0, len(ot.inputs))
+			for _, info := range ot.inputs {
+				inputs = append(inputs, &gqlField{name: info.Field, typ: gqlScalar(info)})
+			}
+			writeType("input", ot.name+"Input", inputs)
+		}
+	}
+	writeType("type", "Query", schema.query.fields)
+	writeType("type", "Mutation", schema.mutation.fields)
+	return buf.String()
+}
+
+//GraphQLRequest тело POST /_graphql
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+//gqlError ошибка в ответе GraphQL, в extensions.code тот же код, что в REST
+type gqlError struct {
+	Message    string            `json:"message"`
+	Path       []interface{}     `json:"path,omitempty"`
+	Extensions map[string]string `json:"extensions,omitempty"`
+}
+
+//gqlResult объект ответа, поля идут в порядке запроса
+type gqlResult struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func newGQLResult() *gqlResult {
+	return &gqlResult{values: make(map[string]interface{})}
+}
+
+func (gr *gqlResult) set(key string, value interface{}) {
+	if _, ok := gr.values[key]; !ok {
+		gr.keys = append(gr.keys, key)
+	}
+	gr.values[key] = value
+}
+
+func (gr *gqlResult) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, key := range gr.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		value, err := json.Marshal(gr.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+//gqlCollected поле ответа: выборки с одним ключом из фрагментов сливаются
+type gqlCollected struct {
+	key string
+	//field nil для __typename
+	field      *gqlField
+	selections []*gqlSelection
+}
+
+//subSelections вложенные поля всех слитых выборок
+func (c *gqlCollected) subSelections() []*gqlSelection {
+	selections := make([]*gqlSelection, 0)
+	for _, sel := range c.selections {
+		selections = append(selections, sel.selections...)
+	}
+	return selections
+}
+
+//gqlExec выполнение одной операции
+type gqlExec struct {
+	dbex   *DBExplorer
+	w      http.ResponseWriter
+	req    *http.Request
+	schema *gqlSchema
+	doc    *gqlDocument
+	vars   map[string]interface{}
+	errors []*gqlError
+	//rows сколько строк изменили мутации, для лога
+	rows int64
+	//fragments размеры проверенных фрагментов. Фрагмент раскрывается только
+	//на тип из своего условия, поэтому проверяется один раз
+	fragments map[string]gqlSize
+	//sc снимок метаданных, с которым выполняется весь запрос
+	sc *dbSchema
+}
+
+//gqlSize размер набора полей после раскрытия фрагментов
+type gqlSize struct {
+	fields int
+	depth  int
+}
+
+//add добавляет к размеру набора размер одной из его выборок. Число полей
+//не растёт дальше предела, чтобы не переполниться
+func (size *gqlSize) add(other gqlSize) {
+	size.fields += other.fields
+	if size.fields > gqlMaxFields {
+		size.fields = gqlMaxFields + 1
+	}
+	if other.depth > size.depth {
+		size.depth = other.depth
+	}
+}
+
+//writeGraphQLErrors ответ на запрос, который не дошёл до выполнения
+func writeGraphQLErrors(w http.ResponseWriter, errs ...error) {
+	res := make([]*gqlError, 0, len(errs))
+	for _, err := range errs {
+		res = append(res, &gqlError{Message: err.Error(),
+			Extensions: map[string]string{"code": errorCodes[http.StatusBadRequest]}})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	jsonRes, _ := json.Marshal(map[string]interface{}{"errors": res})
+	w.Write(jsonRes)
+}
+
+//graphQL POST /_graphql - запрос GraphQL к схеме из graphQLSchema.
+//Поля разрешаются теми же функциями, что и REST: parseListQuery,
+//fetchRecord, insertRecord, modifyRecord, removeRecord с проверкой прав.
+//Есть переменные, алиасы, фрагменты и @skip/@include, интроспекции нет.
+//Ошибки разбора и проверки запроса - 400, ошибки полей - в errors с path
+func (dbex *DBExplorer) graphQL(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	gr := &GraphQLRequest{}
+	decoder := json.NewDecoder(req.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(gr); err != nil {
+		writeGraphQLErrors(w, fmt.Errorf("invalid json"))
+		return
+	}
+
+	doc, err := parseGraphQL(gr.Query)
+	if err != nil {
+		writeGraphQLErrors(w, err)
+		return
+	}
+	op, err := doc.operation(gr.OperationName)
+	if err != nil {
+		writeGraphQLErrors(w, err)
+		return
+	}
+
+	sc := dbex.schema()
+	ex := &gqlExec{
+		dbex:   dbex,
+		w:      w,
+		req:    req.Clone(req.Context()),
+		schema: dbex.graphQLSchema(sc, req),
+		doc:    doc,
+		errors: make([]*gqlError, 0),
+		sc:     sc,
+	}
+	//If-Match относится к одной записи и в мутациях GraphQL не проверяется
+	ex.req.Header.Del("If-Match")
+	errs := ex.validate(op)
+	if err := req.Context().Err(); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(errs) != 0 {
+		writeGraphQLErrors(w, errs...)
+		return
+	}
+	if ex.vars, err = ex.variables(op, gr.Variables); err != nil {
+		writeGraphQLErrors(w, err)
+		return
+	}
+
+	data := ex.execute(op)
+	if op.kind == "mutation" {
+		recordRows(w, ex.rows)
+	}
+	res := map[string]interface{}{"data": data}
+	if len(ex.errors) != 0 {
+		res["errors"] = ex.errors
+	}
+	w.Header().Set("Content-Type", "application/json")
+	jsonRes, _ := json.Marshal(res)
+	w.Write(jsonRes)
+}
+
+//graphQLSchemaSDL GET /_graphql - схема для роли запроса в виде SDL
+func (dbex *DBExplorer) graphQLSchemaSDL(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(dbex.graphQLSchema(dbex.schema(), req).sdl()))
+}
+
+//operation операция по имени, без имени - единственная в документе
+func (doc *gqlDocument) operation(name string) (*gqlOperation, error) {
+	if name == "" {
+		if len(doc.operations) != 1 {
+			return nil, fmt.Errorf("operationName is required")
+		}
+		return doc.operations[0], nil
+	}
+	for _, op := range doc.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %s", name)
+}
+
+//root корневой тип операции
+func (ex *gqlExec) root(op *gqlOperation) *gqlObjectType {
+	if op.kind == "mutation" {
+		return ex.schema.mutation
+	}
+	return ex.schema.query
+}
+
+//validate проверяет операцию по схеме до выполнения: поля, аргументы,
+//вложенные наборы полей, фрагменты, переменные и размер запроса
+func (ex *gqlExec) validate(op *gqlOperation) []error {
+	defined := make(map[string]bool)
+	errs := make([]error, 0)
+	for _, def := range op.vars {
+		if defined[def.name] {
+			errs = append(errs, fmt.Errorf("variable $%s is defined twice", def.name))
+		}
+		defined[def.name] = true
+	}
+	ex.fragments = make(map[string]gqlSize)
+	size := ex.validateSet(ex.root(op), op.selections, defined, make(map[string]bool), &errs)
+	if size.fields > gqlMaxFields {
+		errs = append(errs, fmt.Errorf("query has more than %d fields", gqlMaxFields))
+	}
+	if size.depth > gqlMaxDepth {
+		errs = append(errs, fmt.Errorf("query is nested deeper than %d levels", gqlMaxDepth))
+	}
+	return errs
+}
+
+//validateSet проверяет набор полей типа ot и возвращает его размер
+func (ex *gqlExec) validateSet(ot *gqlObjectType, selections []*gqlSelection,
+	defined map[string]bool, visiting map[string]bool, errs *[]error) gqlSize {
+	fail := func(format string, args ...interface{}) {
+		*errs = append(*errs, fmt.Errorf(format, args...))
+	}
+	checkVars := func(args map[string]*gqlValue) {
+		for _, arg := range args {
+			for _, name := range arg.variables() {
+				if !defined[name] {
+					fail("variable $%s is not defined", name)
+				}
+			}
+		}
+	}
+
+	size := gqlSize{}
+	for _, sel := range selections {
+		if ex.req.Context().Err() != nil {
+			return size
+		}
+		for _, d := range sel.directives {
+			if d.name != "skip" && d.name != "include" {
+				fail("unknown directive @%s", d.name)
+			}
+			if d.args["if"] == nil {
+				fail("directive @%s requires argument if", d.name)
+			}
+			checkVars(d.args)
+		}
+
+		switch {
+		case sel.fragment != "":
+			fragment, ok := ex.doc.fragments[sel.fragment]
+			validated, done := ex.fragments[sel.fragment]
+			switch {
+			case done && fragment.typeCond == ot.name:
+				size.add(validated)
+			case !ok:
+				fail("unknown fragment %s", sel.fragment)
+			case visiting[sel.fragment]:
+				fail("fragment %s spreads itself", sel.fragment)
+			case fragment.typeCond != ot.name:
+				fail("fragment %s on %s can not be spread on %s",
+					sel.fragment, fragment.typeCond, ot.name)
+			default:
+				visiting[sel.fragment] = true
+				validated = ex.validateSet(ot, fragment.selections, defined, visiting, errs)
+				delete(visiting, sel.fragment)
+				ex.fragments[sel.fragment] = validated
+				size.add(validated)
+			}
+		case sel.inline:
+			if sel.typeCond != "" && sel.typeCond != ot.name {
+				fail("fragment on %s can not be spread on %s", sel.typeCond, ot.name)
+				continue
+			}
+			size.add(ex.validateSet(ot, sel.selections, defined, visiting, errs))
+		case sel.name == "__typename":
+			if sel.selections != nil || len(sel.args) != 0 {
+				fail("field __typename has no arguments and subfields")
+			}
+			size.add(gqlSize{fields: 1, depth: 1})
+		case strings.HasPrefix(sel.name, "__"):
+			fail("introspection is not supported, schema is available at GET /_graphql")
+		default:
+			field := ot.field(sel.name)
+			if field == nil {
+				fail("unknown field %s on type %s", sel.name, ot.name)
+				continue
+			}
+			for name := range sel.args {
+				if field.arg(name) == nil {
+					fail("unknown argument %s of field %s.%s", name, ot.name, sel.name)
+				}
+			}
+			for _, arg := range field.args {
+				if strings.HasSuffix(arg.typ, "!") && sel.args[arg.name] == nil {
+					fail("argument %s of field %s.%s is required", arg.name, ot.name, sel.name)
+				}
+			}
+			checkVars(sel.args)
+
+			switch {
+			case field.object != nil && sel.selections == nil:
+				fail("field %s.%s must have subfields", ot.name, sel.name)
+			case field.object == nil && sel.selections != nil:
+				fail("field %s.%s has no subfields", ot.name, sel.name)
+			case field.object != nil:
+				sub := ex.validateSet(field.object, sel.selections, defined, visiting, errs)
+				size.add(gqlSize{fields: sub.fields + 1, depth: sub.depth + 1})
+				continue
+			}
+			size.add(gqlSize{fields: 1, depth: 1})
+		}
+	}
+	return size
+}
+
+//variables значения переменных операции с учётом значений по-умолчанию.
+//Сами значения проверяются там же, где и аргументы, при выполнении
+func (ex *gqlExec) variables(op *gqlOperation,
+	input map[string]interface{}) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	for _, def := range op.vars {
+		v, ok := input[def.name]
+		if !ok && def.def != nil {
+			v, ok = ex.value(def.def), true
+		}
+		if def.typ.nonNull && v == nil {
+			return nil, fmt.Errorf("variable $%s of type %s is required", def.name, def.typ)
+		}
+		if ok {
+			vars[def.name] = v
+		}
+	}
+	return vars, nil
+}
+
+//variables имена переменных, которые используются в значении
+func (v *gqlValue) variables() []string {
+	switch v.kind {
+	case gqlVariable:
+		return []string{v.raw}
+	case gqlListValue, gqlObjectValue:
+		names := make([]string, 0)
+		for _, item := range v.list {
+			names = append(names, item.variables()...)
+		}
+		for _, item := range v.fields {
+			names = append(names, item.variables()...)
+		}
+		return names
+	}
+	return nil
+}
+
+//value значение аргумента в том же виде, что и из JSON с UseNumber
+func (ex *gqlExec) value(v *gqlValue) interface{} {
+	switch v.kind {
+	case gqlVariable:
+		return ex.vars[v.raw]
+	case gqlIntValue, gqlFloatValue:
+		return json.Number(v.raw)
+	case gqlBoolValue:
+		return v.raw == "true"
+	case gqlNullValue:
+		return nil
+	case gqlListValue:
+		list := make([]interface{}, 0, len(v.list))
+		for _, item := range v.list {
+			list = append(list, ex.value(item))
+		}
+		return list
+	case gqlObjectValue:
+		fields := make(map[string]interface{}, len(v.fields))
+		for name, item := range v.fields {
+			fields[name] = ex.value(item)
+		}
+		return fields
+	}
+	return v.raw
+}
+
+//included не отключено ли поле директивами @skip и @include
+func (ex *gqlExec) included(directives []*gqlDirective) bool {
+	for _, d := range directives {
+		cond := ex.value(d.args["if"]) == true
+		if d.name == "skip" && cond || d.name == "include" && !cond {
+			return false
+		}
+	}
+	return true
+}
+
+//collectFields раскрывает фрагменты и сливает выборки с одним ключом
+func (ex *gqlExec) collectFields(ot *gqlObjectType,
+	selections []*gqlSelection) []*gqlCollected {
+	fields := make([]*gqlCollected, 0, len(selections))
+	index := make(map[string]*gqlCollected)
+	var collect func(selections []*gqlSelection)
+	collect = func(selections []*gqlSelection) {
+		for _, sel := range selections {
+			if !ex.included(sel.directives) {
+				continue
+			}
+			switch {
+			case sel.fragment != "":
+				collect(ex.doc.fragments[sel.fragment].selections)
+			case sel.inline:
+				collect(sel.selections)
+			default:
+				c, ok := index[sel.key()]
+				if !ok {
+					c = &gqlCollected{key: sel.key(), field: ot.field(sel.name)}
+					index[c.key] = c
+					fields = append(fields, c)
+				}
+				c.selections = append(c.selections, sel)
+			}
+		}
+	}
+	collect(selections)
+	return fields
+}
+
+//fail добавляет в ответ ошибку поля. Как и в writeError, ошибки без
+//http-статуса отдаются без подробностей
+func (ex *gqlExec) fail(path []interface{}, err error) {
+	if rec, ok := ex.w.(errorRecorder); ok {
+		rec.recordError(err)
+	}
+	apiErr := apiError(err)
+	ex.errors = append(ex.errors, &gqlError{
+		Message:    apiErr.Error(),
+		Path:       path,
+		Extensions: map[string]string{"code": apiErr.Code()},
+	})
+}
+
+//execute выполняет корневые поля, мутации - строго по порядку
+func (ex *gqlExec) execute(op *gqlOperation) *gqlResult {
+	root := ex.root(op)
+	data := newGQLResult()
+	for _, c := range ex.collectFields(root, op.selections) {
+		if c.field == nil {
+			data.set(c.key, root.name)
+			continue
+		}
+		v, err := ex.resolveRoot(c)
+		if err != nil {
+			ex.fail([]interface{}{c.key}, err)
+			v = nil
+		}
+		data.set(c.key, v)
+	}
+	return data
+}
+
+//gqlBadRequest ошибка в аргументах поля
+func gqlBadRequest(format string, args ...interface{}) error {
+	return APIError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+//gqlID значение аргумента id
+func gqlID(v interface{}) (string, error) {
+	switch x := v.(type) {
+	case string:
+		return x, nil
+	case json.Number:
+		return x.String(), nil
+	}
+	return "", gqlBadRequest("invalid id")
+}
+
+//resolveRoot разрешает поле Query или Mutation
+func (ex *gqlExec) resolveRoot(c *gqlCollected) (interface{}, error) {
+	if err := ex.req.Context().Err(); err != nil {
+		return nil, err
+	}
+	args := make(map[string]interface{})
+	for name, v := range c.selections[0].args {
+		args[name] = ex.value(v)
+	}
+	field := c.field
+	table := field.table
+	tableInfo, ok := ex.sc.tablesInfo[table]
+	if !ok {
+		return nil, APIError{http.StatusNotFound, fmt.Errorf("unknown table")}
+	}
+
+	var id string
+	if _, ok := args["id"]; ok {
+		var err error
+		if id, err = gqlID(args["id"]); err != nil {
+			return nil, err
+		}
+	}
+
+	switch field.kind {
+	case gqlListQuery:
+		records, err := ex.list(field.object, tableInfo, args)
+		if err != nil {
+			return nil, err
+		}
+		return ex.resolveObjects(field.object, records, c.subSelections())
+	case gqlGetQuery:
+		record, err := ex.dbex.fetchRecord(ex.sc, ex.dbex.conn(ex.req), table, tableInfo, id, false)
+		if err != nil || record == nil {
+			return nil, err
+		}
+		if args["include_deleted"] != true && ex.dbex.isDeleted(tableInfo, record) {
+			return nil, nil
+		}
+		return ex.resolveOne(field.object, record, c)
+	case gqlCreateMutation, gqlUpdateMutation:
+		body, err := ex.input(tableInfo, args["input"])
+		if err != nil {
+			return nil, err
+		}
+		if err := ex.dbex.checkWrite(ex.sc, ex.req, table, body); err != nil {
+			return nil, err
+		}
+
+		if field.kind == gqlCreateMutation {
+			res, err := ex.dbex.changeRecord(ex.sc, ex.req, table, "", "create",
+				func(db sqlExecutor) (map[string]interface{}, error) {
+					return ex.dbex.insertRecord(ex.sc, db, table, body)
+				})
+			if err != nil {
+				return nil, err
+			}
+			ex.rows++
+			id = recordID(tableInfo, res)
+		} else {
+			res, err := ex.dbex.changeRecord(ex.sc, ex.req, table, id, "update",
+				func(db sqlExecutor) (map[string]interface{}, error) {
+					return ex.dbex.modifyRecord(ex.sc, db, table, id, body)
+				})
+			if err != nil {
+				return nil, err
+			}
+			ex.rows += res["updated"].(int64)
+			if res["updated"].(int64) == 0 {
+				return nil, nil
+			}
+		}
+
+		record, err := ex.dbex.fetchRecord(ex.sc, ex.dbex.conn(ex.req), table, tableInfo, id, false)
+		if err != nil || record == nil {
+			return nil, err
+		}
+		return ex.resolveOne(field.object, record, c)
+	case gqlDeleteMutation:
+		if err := ex.dbex.checkWrite(ex.sc, ex.req, table, nil); err != nil {
+			return nil, err
+		}
+		res, err := ex.dbex.changeRecord(ex.sc, ex.req, table, id, "delete",
+			func(db sqlExecutor) (map[string]interface{}, error) {
+				return ex.dbex.removeRecord(ex.sc, db, table, id)
+			})
+		if err != nil {
+			return nil, err
+		}
+		ex.rows += res["deleted"].(int64)
+		return res["deleted"], nil
+	}
+	return nil, fmt.Errorf("unknown field kind %d", field.kind)
+}
+
+//resolveOne одна запись с выбранными полями
+func (ex *gqlExec) resolveOne(ot *gqlObjectType, record map[string]interface{},
+	c *gqlCollected) (interface{}, error) {
+	objects, err := ex.resolveObjects(ot, []map[string]interface{}{record},
+		c.subSelections())
+	if err != nil {
+		return nil, err
+	}
+	return objects[0], nil
+}
+
+//input тело записи из аргумента input
+func (ex *gqlExec) input(tableInfo []*Column, v interface{}) (map[string]interface{}, error) {
+	body, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, gqlBadRequest("input must be an object")
+	}
+	for name := range body {
+		if findColumn(tableInfo, name) == nil {
+			return nil, gqlBadRequest("unknown column %s", name)
+		}
+	}
+	return body, nil
+}
+
+//gqlFilterValue значение фильтра в виде строки из ?where=
+func gqlFilterValue(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case json.Number:
+		return x.String(), true
+	case bool:
+		return strconv.FormatBool(x), true
+	}
+	return "", false
+}
+
+//list выборка для Query.{table}: аргументы переводятся в параметры
+//листинга и разбираются тем же parseListQuery
+func (ex *gqlExec) list(ot *gqlObjectType, tableInfo []*Column,
+	args map[string]interface{}) ([]map[string]interface{}, error) {
+	query := url.Values{}
+	if args["filter"] != nil {
+		filter, ok := args["filter"].(map[string]interface{})
+		if !ok {
+			return nil, gqlBadRequest("filter must be an object")
+		}
+		columns := make([]string, 0, len(filter))
+		for column := range filter {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+
+		for _, column := range columns {
+			conds, ok := filter[column].(map[string]interface{})
+			if !ok {
+				return nil, gqlBadRequest("filter of %s must be an object", column)
+			}
+			ops := make([]string, 0, len(conds))
+			for op := range conds {
+				ops = append(ops, op)
+			}
+			sort.Strings(ops)
+
+			for _, op := range ops {
+				if op == "is_null" {
+					switch conds[op] {
+					case true:
+						query.Add("where", column+":null")
+					case false:
+						query.Add("where", column+":notnull")
+					default:
+						return nil, gqlBadRequest("is_null of %s must be boolean", column)
+					}
+					continue
+				}
+				if _, ok := whereOperators[op]; !ok {
+					return nil, gqlBadRequest("unknown operator %s", op)
+				}
+				value, ok := gqlFilterValue(conds[op])
+				if !ok {
+					return nil, gqlBadRequest("invalid value of %s.%s", column, op)
+				}
+				query.Add("where", column+":"+op+":"+value)
+			}
+		}
+	}
+
+	switch order := args["order"].(type) {
+	case nil:
+	case string:
+		query.Set("order", order)
+	case []interface{}:
+		names := make([]string, 0, len(order))
+		for _, name := range order {
+			s, ok := name.(string)
+			if !ok {
+				return nil, gqlBadRequest("order must be a list of strings")
+			}
+			names = append(names, s)
+		}
+		query.Set("order", strings.Join(names, ","))
+	default:
+		return nil, gqlBadRequest("order must be a list of strings")
+	}
+	for _, name := range []string{"limit", "offset"} {
+		if n, ok := args[name].(json.Number); ok {
+			query.Set(name, n.String())
+		} else if args[name] != nil {
+			return nil, gqlBadRequest("%s must be an integer", name)
+		}
+	}
+	if args["include_deleted"] == true {
+		query.Set("include_deleted", "1")
+	}
+
+	lq, err := ex.dbex.parseListQuery(ot.policy.visible(tableInfo), query)
+	if err != nil {
+		return nil, APIError{http.StatusBadRequest, err}
+	}
+	ex.dbex.hideDeleted(lq, tableInfo, query)
+
+	sc := ex.sc
+	limit, offset, err := listLimits(query, sc.configs[ot.table])
+	if err != nil {
+		return nil, err
+	}
+	sqlReq := lq.selectSQL(ex.dbex.dialect, sc.dbTable(ot.table)) +
+		" LIMIT " + lq.args.add(limit) + " OFFSET " + lq.args.add(offset)
+	rows, err := ex.dbex.conn(ex.req).Query(sqlReq, lq.args.values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return ex.dbex.readDBData(rows, tableInfo)
+}
+
+//resolveObjects строит объекты ответа по записям. Связи раскрываются
+//одним запросом на все записи через expandRecords
+func (ex *gqlExec) resolveObjects(ot *gqlObjectType, records []map[string]interface{},
+	selections []*gqlSelection) ([]*gqlResult, error) {
+	if err := ex.req.Context().Err(); err != nil {
+		return nil, err
+	}
+	fields := ex.collectFields(ot, selections)
+	nested := make(map[string][]*gqlResult)
+	expanded := make(map[*ForeignKey]bool)
+	for _, c := range fields {
+		if c.field == nil || c.field.kind != gqlRelationField {
+			continue
+		}
+		fk := c.field.fk
+		if !expanded[fk] {
+			if err := ex.dbex.expandRecords(ex.sc, ex.dbex.conn(ex.req), records,
+				[]*ForeignKey{fk}, false); err != nil {
+				return nil, err
+			}
+			expanded[fk] = true
+		}
+
+		related := make([]map[string]interface{}, 0, len(records))
+		positions := make([]int, 0, len(records))
+		for i, record := range records {
+			if row, ok := record[fk.Relation()].(map[string]interface{}); ok {
+				related = append(related, row)
+				positions = append(positions, i)
+			}
+		}
+		objects, err := ex.resolveObjects(c.field.object, related, c.subSelections())
+		if err != nil {
+			return nil, err
+		}
+		nested[c.key] = make([]*gqlResult, len(records))
+		for j, i := range positions {
+			nested[c.key][i] = objects[j]
+		}
+	}
+
+	results := make([]*gqlResult, 0, len(records))
+	for i, record := range records {
+		obj := newGQLResult()
+		for _, c := range fields {
+			switch {
+			case c.field == nil:
+				obj.set(c.key, ot.name)
+			case c.field.kind == gqlRelationField:
+				//nil-указатель в interface{} дал бы не null
+				if related := nested[c.key][i]; related != nil {
+					obj.set(c.key, related)
+				} else {
+					obj.set(c.key, nil)
+				}
+			default:
+				obj.set(c.key, record[c.field.name])
+			}
+		}
+		results = append(results, obj)
+	}
+	return results, nil
+}
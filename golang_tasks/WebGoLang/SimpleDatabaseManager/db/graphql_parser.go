@@ -0,0 +1,699 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//gqlTokenKind вид лексемы GraphQL
+type gqlTokenKind int
+
+const (
+	gqlEOF gqlTokenKind = iota
+	gqlPunct
+	gqlName
+	gqlInt
+	gqlFloat
+	gqlString
+)
+
+//gqlToken лексема с позицией для сообщений об ошибках
+type gqlToken struct {
+	kind  gqlTokenKind
+	value string
+	line  int
+	col   int
+}
+
+//gqlLexer разбивает документ на лексемы, запятые и комментарии пропускает
+type gqlLexer struct {
+	src  string
+	pos  int
+	line int
+	//lineStart позиция начала текущей строки
+	lineStart int
+}
+
+func (lx *gqlLexer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at %d:%d: %s", lx.line, lx.pos-lx.lineStart+1,
+		fmt.Sprintf(format, args...))
+}
+
+//skip пропускает пробелы, переводы строк, запятые и комментарии
+func (lx *gqlLexer) skip() {
+	for lx.pos < len(lx.src) {
+		switch c := lx.src[lx.pos]; {
+		case c == '\n':
+			lx.pos++
+			lx.line++
+			lx.lineStart = lx.pos
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			lx.pos++
+		case c == '#':
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		case strings.HasPrefix(lx.src[lx.pos:], "\ufeff"):
+			lx.pos += len("\ufeff")
+		default:
+			return
+		}
+	}
+}
+
+func (lx *gqlLexer) next() (*gqlToken, error) {
+	lx.skip()
+	tok := &gqlToken{line: lx.line, col: lx.pos - lx.lineStart + 1}
+	if lx.pos >= len(lx.src) {
+		return tok, nil
+	}
+
+	c := lx.src[lx.pos]
+	switch {
+	case strings.HasPrefix(lx.src[lx.pos:], "..."):
+		tok.kind, tok.value = gqlPunct, "..."
+		lx.pos += 3
+	case strings.IndexByte("!$&():=@[]{}|", c) != -1:
+		tok.kind, tok.value = gqlPunct, string(c)
+		lx.pos++
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		start := lx.pos
+		for lx.pos < len(lx.src) && isWordByte(lx.src[lx.pos]) {
+			lx.pos++
+		}
+		tok.kind, tok.value = gqlName, lx.src[start:lx.pos]
+	case c == '-' || c >= '0' && c <= '9':
+		return lx.number(tok)
+	case c == '"':
+		value, err := lx.str()
+		if err != nil {
+			return nil, err
+		}
+		tok.kind, tok.value = gqlString, value
+	default:
+		return nil, lx.errorf("unexpected character %q", c)
+	}
+	return tok, nil
+}
+
+//number читает Int или Float: -12, 1.5, 2e10
+func (lx *gqlLexer) number(tok *gqlToken) (*gqlToken, error) {
+	start := lx.pos
+	digits := func() int {
+		from := lx.pos
+		for lx.pos < len(lx.src) && lx.src[lx.pos] >= '0' && lx.src[lx.pos] <= '9' {
+			lx.pos++
+		}
+		return lx.pos - from
+	}
+
+	tok.kind = gqlInt
+	if lx.src[lx.pos] == '-' {
+		lx.pos++
+	}
+	if n := digits(); n == 0 || n > 1 && lx.src[lx.pos-n] == '0' {
+		return nil, lx.errorf("invalid number")
+	}
+	if lx.pos < len(lx.src) && lx.src[lx.pos] == '.' {
+		lx.pos++
+		tok.kind = gqlFloat
+		if digits() == 0 {
+			return nil, lx.errorf("invalid number")
+		}
+	}
+	if lx.pos < len(lx.src) && (lx.src[lx.pos] == 'e' || lx.src[lx.pos] == 'E') {
+		lx.pos++
+		tok.kind = gqlFloat
+		if lx.pos < len(lx.src) && (lx.src[lx.pos] == '+' || lx.src[lx.pos] == '-') {
+			lx.pos++
+		}
+		if digits() == 0 {
+			return nil, lx.errorf("invalid number")
+		}
+	}
+	//1abc - не число и не имя
+	if lx.pos < len(lx.src) && (isWordByte(lx.src[lx.pos]) || lx.src[lx.pos] == '.') {
+		return nil, lx.errorf("invalid number")
+	}
+	tok.value = lx.src[start:lx.pos]
+	return tok, nil
+}
+
+//str читает строку "..." с экранированием или блочную строку """..."""
+func (lx *gqlLexer) str() (string, error) {
+	if strings.HasPrefix(lx.src[lx.pos:], `"""`) {
+		end := strings.Index(lx.src[lx.pos+3:], `"""`)
+		if end == -1 {
+			return "", lx.errorf("unterminated string")
+		}
+		value := lx.src[lx.pos+3 : lx.pos+3+end]
+		lx.line += strings.Count(value, "\n")
+		if idx := strings.LastIndexByte(value, '\n'); idx != -1 {
+			lx.lineStart = lx.pos + 3 + idx + 1
+		}
+		lx.pos += end + 6
+		return strings.TrimSpace(value), nil
+	}
+
+	buf := strings.Builder{}
+	for i := lx.pos + 1; i < len(lx.src); i++ {
+		c := lx.src[i]
+		switch {
+		case c == '"':
+			lx.pos = i + 1
+			return buf.String(), nil
+		case c == '\n':
+			return "", lx.errorf("unterminated string")
+		case c != '\\':
+			buf.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i >= len(lx.src) {
+			break
+		}
+		switch lx.src[i] {
+		case '"', '\\', '/':
+			buf.WriteByte(lx.src[i])
+		case 'b':
+			buf.WriteByte('\b')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'u':
+			if i+5 > len(lx.src) {
+				return "", lx.errorf("invalid escape")
+			}
+			code, err := strconv.ParseUint(lx.src[i+1:i+5], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(code)) {
+				return "", lx.errorf("invalid escape")
+			}
+			buf.WriteRune(rune(code))
+			i += 4
+		default:
+			return "", lx.errorf("invalid escape")
+		}
+	}
+	return "", lx.errorf("unterminated string")
+}
+
+//gqlValueKind вид значения аргумента
+type gqlValueKind int
+
+const (
+	gqlVariable gqlValueKind = iota
+	gqlIntValue
+	gqlFloatValue
+	gqlStringValue
+	gqlBoolValue
+	gqlNullValue
+	gqlEnumValue
+	gqlListValue
+	gqlObjectValue
+)
+
+//gqlValue значение аргумента из документа, для переменной raw - её имя
+type gqlValue struct {
+	kind   gqlValueKind
+	raw    string
+	list   []*gqlValue
+	fields map[string]*gqlValue
+}
+
+//gqlType тип переменной: Name, [Type] или Type!
+type gqlType struct {
+	name    string
+	elem    *gqlType
+	nonNull bool
+}
+
+func (gt *gqlType) String() string {
+	s := gt.name
+	if gt.elem != nil {
+		s = "[" + gt.elem.String() + "]"
+	}
+	if gt.nonNull {
+		s += "!"
+	}
+	return s
+}
+
+//gqlDirective директива @skip(if: ...) или @include(if: ...)
+type gqlDirective struct {
+	name string
+	args map[string]*gqlValue
+}
+
+//gqlSelection поле, ...Fragment или ... on Type { } из набора полей
+type gqlSelection struct {
+	alias      string
+	name       string
+	args       map[string]*gqlValue
+	directives []*gqlDirective
+	selections []*gqlSelection
+
+	//fragment имя фрагмента для ...Fragment
+	fragment string
+	//inline - ... on Type { }, typeCond может быть пустым
+	inline   bool
+	typeCond string
+}
+
+//key имя поля в ответе
+func (sel *gqlSelection) key() string {
+	if sel.alias != "" {
+		return sel.alias
+	}
+	return sel.name
+}
+
+//gqlVarDef объявление переменной операции
+type gqlVarDef struct {
+	name string
+	typ  *gqlType
+	def  *gqlValue
+}
+
+//gqlOperation query или mutation
+type gqlOperation struct {
+	kind       string
+	name       string
+	vars       []*gqlVarDef
+	selections []*gqlSelection
+}
+
+//gqlFragment именованный фрагмент
+type gqlFragment struct {
+	name       string
+	typeCond   string
+	selections []*gqlSelection
+}
+
+//gqlDocument разобранный запрос
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+//gqlParser разбор документа рекурсивным спуском
+type gqlParser struct {
+	lx  *gqlLexer
+	tok *gqlToken
+}
+
+//parseGraphQL разбирает документ с операциями и фрагментами
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{lx: &gqlLexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	doc := &gqlDocument{fragments: make(map[string]*gqlFragment)}
+	for p.tok.kind != gqlEOF {
+		switch {
+		case p.peek(gqlPunct, "{"):
+			selections, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations,
+				&gqlOperation{kind: "query", selections: selections})
+		case p.peek(gqlName, "query") || p.peek(gqlName, "mutation"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.peek(gqlName, "fragment"):
+			fragment, err := p.fragment()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := doc.fragments[fragment.name]; ok {
+				return nil, fmt.Errorf("fragment %s is defined twice", fragment.name)
+			}
+			doc.fragments[fragment.name] = fragment
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("no operations in document")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) advance() error {
+	tok, err := p.lx.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *gqlParser) peek(kind gqlTokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.tok.kind == gqlEOF {
+		return fmt.Errorf("syntax error at %d:%d: unexpected end of document",
+			p.tok.line, p.tok.col)
+	}
+	return fmt.Errorf("syntax error at %d:%d: unexpected %q",
+		p.tok.line, p.tok.col, p.tok.value)
+}
+
+//expect пропускает обязательный знак препинания
+func (p *gqlParser) expect(punct string) error {
+	if !p.peek(gqlPunct, punct) {
+		return p.unexpected()
+	}
+	return p.advance()
+}
+
+//skipPunct пропускает необязательный знак препинания, true - он был
+func (p *gqlParser) skipPunct(punct string) (bool, error) {
+	if !p.peek(gqlPunct, punct) {
+		return false, nil
+	}
+	return true, p.advance()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != gqlName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.advance()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.tok.value}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == gqlName {
+		op.name = p.tok.value
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+
+	if ok, err := p.skipPunct("("); err != nil {
+		return nil, err
+	} else if ok {
+		for !p.peek(gqlPunct, ")") {
+			def, err := p.varDef()
+			if err != nil {
+				return nil, err
+			}
+			op.vars = append(op.vars, def)
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+
+	selections, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = selections
+	return op, nil
+}
+
+func (p *gqlParser) varDef() (*gqlVarDef, error) {
+	if err := p.expect("$"); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	typ, err := p.typeRef()
+	if err != nil {
+		return nil, err
+	}
+
+	def := &gqlVarDef{name: name, typ: typ}
+	if ok, err := p.skipPunct("="); err != nil {
+		return nil, err
+	} else if ok {
+		if def.def, err = p.value(true); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+func (p *gqlParser) typeRef() (*gqlType, error) {
+	typ := &gqlType{}
+	if ok, err := p.skipPunct("["); err != nil {
+		return nil, err
+	} else if ok {
+		if typ.elem, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	} else if typ.name, err = p.name(); err != nil {
+		return nil, err
+	}
+
+	ok, err := p.skipPunct("!")
+	typ.nonNull = ok
+	return typ, err
+}
+
+func (p *gqlParser) fragment() (*gqlFragment, error) {
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if name == "on" {
+		return nil, fmt.Errorf("fragment can not be named on")
+	}
+	if !p.peek(gqlName, "on") {
+		return nil, p.unexpected()
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	typeCond, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	selections, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	return &gqlFragment{name: name, typeCond: typeCond, selections: selections}, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	selections := make([]*gqlSelection, 0)
+	for !p.peek(gqlPunct, "}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, sel)
+	}
+	if len(selections) == 0 {
+		return nil, p.unexpected()
+	}
+	return selections, p.advance()
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	sel := &gqlSelection{}
+	var err error
+	if ok, err := p.skipPunct("..."); err != nil {
+		return nil, err
+	} else if ok {
+		if p.tok.kind == gqlName && p.tok.value != "on" {
+			sel.fragment = p.tok.value
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+
+		sel.inline = true
+		if p.peek(gqlName, "on") {
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+			if sel.typeCond, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		sel.selections, err = p.selectionSet()
+		return sel, err
+	}
+
+	if sel.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if ok, err := p.skipPunct(":"); err != nil {
+		return nil, err
+	} else if ok {
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if sel.args, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.peek(gqlPunct, "{") {
+		if sel.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) arguments() (map[string]*gqlValue, error) {
+	args := make(map[string]*gqlValue)
+	if ok, err := p.skipPunct("("); err != nil || !ok {
+		return args, err
+	}
+	for !p.peek(gqlPunct, ")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if _, ok := args[name]; ok {
+			return nil, fmt.Errorf("argument %s is given twice", name)
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.advance()
+}
+
+func (p *gqlParser) directives() ([]*gqlDirective, error) {
+	directives := make([]*gqlDirective, 0)
+	for p.peek(gqlPunct, "@") {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, &gqlDirective{name: name, args: args})
+	}
+	return directives, nil
+}
+
+//value разбирает значение, в constant переменные запрещены
+func (p *gqlParser) value(constant bool) (*gqlValue, error) {
+	tok := p.tok
+	v := &gqlValue{raw: tok.value}
+	switch {
+	case p.peek(gqlPunct, "$") && !constant:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		return &gqlValue{kind: gqlVariable, raw: name}, nil
+	case p.peek(gqlPunct, "["):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		v.kind = gqlListValue
+		v.list = make([]*gqlValue, 0)
+		for !p.peek(gqlPunct, "]") {
+			item, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			v.list = append(v.list, item)
+		}
+	case p.peek(gqlPunct, "{"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		v.kind = gqlObjectValue
+		v.fields = make(map[string]*gqlValue)
+		for !p.peek(gqlPunct, "}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if _, ok := v.fields[name]; ok {
+				return nil, fmt.Errorf("field %s is given twice", name)
+			}
+			if v.fields[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+	case tok.kind == gqlInt:
+		v.kind = gqlIntValue
+	case tok.kind == gqlFloat:
+		v.kind = gqlFloatValue
+	case tok.kind == gqlString:
+		v.kind = gqlStringValue
+	case tok.kind == gqlName && (tok.value == "true" || tok.value == "false"):
+		v.kind = gqlBoolValue
+	case tok.kind == gqlName && tok.value == "null":
+		v.kind = gqlNullValue
+	case tok.kind == gqlName:
+		v.kind = gqlEnumValue
+	default:
+		return nil, p.unexpected()
+	}
+	return v, p.advance()
+}
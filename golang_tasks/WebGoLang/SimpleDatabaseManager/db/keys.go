@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//keySeparator разделяет части составного ключа в URL: /{table}/{k1},{k2}.
+//Запятая внутри части передаётся как %2C
+const keySeparator = ","
+
+//primaryKeys столбцы primary key в порядке их следования в таблице
+func primaryKeys(tableInfo []*Column) []*Column {
+	keys := make([]*Column, 0, 1)
+	for _, info := range tableInfo {
+		if info.Key == "PRI" {
+			keys = append(keys, info)
+		}
+	}
+	return keys
+}
+
+//isAutoIncrement значение столбца генерирует сама база
+func (c *Column) isAutoIncrement() bool {
+	return strings.Contains(strings.ToLower(c.Extra), "auto_increment")
+}
+
+//keyValues разбирает id из URL в значения столбцов primary key. id
+//приходит нераскодированным: части составного ключа идут через запятую
+//в порядке столбцов таблицы и раскодируются каждая отдельно, ключ из
+//одного столбца не делится
+func keyValues(tableInfo []*Column, id string) ([]*Column, []interface{}, error) {
+	keys := primaryKeys(tableInfo)
+	if len(keys) == 0 {
+		return nil, nil, APIError{http.StatusBadRequest,
+			fmt.Errorf("table has no primary key")}
+	}
+
+	parts := []string{id}
+	if len(keys) > 1 {
+		parts = strings.Split(id, keySeparator)
+	}
+	if len(parts) != len(keys) {
+		return nil, nil, APIError{http.StatusBadRequest,
+			fmt.Errorf("invalid primary key")}
+	}
+
+	values := make([]interface{}, 0, len(keys))
+	for i, key := range keys {
+		part, err := url.PathUnescape(parts[i])
+		if err != nil {
+			return nil, nil, APIError{http.StatusBadRequest,
+				fmt.Errorf("invalid primary key")}
+		}
+		v, err := parseQueryValue(part, key)
+		if err != nil {
+			return nil, nil, APIError{http.StatusBadRequest, err}
+		}
+		values = append(values, v)
+	}
+	return keys, values, nil
+}
+
+//keyCondition собирает условие WHERE на запись по id из URL
+func (dbex *DBExplorer) keyCondition(tableInfo []*Column, id string,
+	args *sqlArgs) (string, error) {
+	keys, values, err := keyValues(tableInfo, id)
+	if err != nil {
+		return "", err
+	}
+
+	conds := make([]string, 0, len(keys))
+	for i, key := range keys {
+		conds = append(conds, dbex.dialect.Quote(key.dbName())+" = "+args.add(values[i]))
+	}
+	return strings.Join(conds, " AND "), nil
+}
+
+//recordID собирает id записи для URL из значений её ключа, в том же
+//виде, в каком его разбирает keyValues
+func recordID(tableInfo []*Column, record map[string]interface{}) string {
+	parts := make([]string, 0, 1)
+	for _, key := range primaryKeys(tableInfo) {
+		part := url.PathEscape(fmt.Sprint(record[key.Field]))
+		parts = append(parts, strings.Replace(part, keySeparator, "%2C", -1))
+	}
+	return strings.Join(parts, keySeparator)
+}
@@ -4,8 +4,11 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -19,6 +22,30 @@ var (
 )
 
 func main() {
+	schemaPoll := flag.Duration("schema-poll", 0,
+		"как часто перечитывать схему базы, 0 - не перечитывать")
+	queryTimeout := flag.Duration("query-timeout", 0,
+		"таймаут запросов к базе на один http-запрос, 0 - без таймаута")
+	authConfig := flag.String("auth", "",
+		"JSON-файл с ключами доступа и политикой таблиц, пусто - доступ открыт")
+	auditTable := flag.String("audit-table", "",
+		"таблица для журнала изменений, создаётся при старте")
+	auditFile := flag.String("audit-file", "",
+		"файл для журнала изменений, по JSON-строке на изменение")
+	softDelete := flag.String("soft-delete-column", "deleted_at",
+		"столбец мягкого удаления, пусто - удалять записи физически")
+	configFile := flag.String("config", "",
+		"YAML или JSON с видимостью и именами таблиц и столбцов, пусто - всё как в базе")
+	cacheSize := flag.Int64("cache-size", 0,
+		"сколько байт ответов на чтение держать в кэше, 0 - без кэша")
+	cacheTTL := flag.Duration("cache-ttl", 30*time.Second,
+		"сколько живёт ответ в кэше")
+	legacyRoutes := flag.Bool("legacy-routes", true,
+		"оставить старые маршруты PUT /{table}/ и POST /{table}/{id}")
+	secretFile := flag.String("secret-file", "",
+		"файл с ключом для ETag, пусто - случайный ключ на время работы")
+	flag.Parse()
+
 	db, err := sql.Open("mysql", DSN)
 	err = db.Ping() // вот тут будет первое подключение к базе
 	if err != nil {
@@ -29,6 +56,50 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	handler.QueryTimeout = *queryTimeout
+	handler.SoftDeleteColumn = *softDelete
+	handler.LegacyRoutes = *legacyRoutes
+	if *secretFile != "" {
+		handler.Secret, err = ioutil.ReadFile(*secretFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if *cacheSize > 0 {
+		handler.Cache = NewResponseCache(*cacheSize, *cacheTTL)
+	}
+	if *configFile != "" {
+		cfg, err := LoadConfig(*configFile)
+		if err != nil {
+			panic(err)
+		}
+		if err := handler.ApplyConfig(cfg); err != nil {
+			panic(err)
+		}
+	}
+	if *authConfig != "" {
+		handler.Auth, err = LoadAuthConfig(*authConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
+	switch {
+	case *auditTable != "":
+		err = handler.EnableAudit(&AuditTable{Name: *auditTable})
+	case *auditFile != "":
+		var sink *AuditFile
+		sink, err = OpenAuditFile(*auditFile)
+		if err == nil {
+			defer sink.Close()
+			err = handler.EnableAudit(sink)
+		}
+	}
+	if err != nil {
+		panic(err)
+	}
+	if *schemaPoll > 0 {
+		defer handler.WatchSchema(*schemaPoll)()
+	}
 
 	fmt.Println("starting server at :8082")
 	http.ListenAndServe(":8082", handler)
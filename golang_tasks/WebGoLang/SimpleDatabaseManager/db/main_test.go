@@ -1,19 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"database/sql"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"bytes"
+	"context"
+	"database/sql/driver"
 	"encoding/json"
+	"html"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	sqlite3 "github.com/mattn/go-sqlite3"
 )
 
 // CaseResponse
@@ -26,13 +38,50 @@ type Case struct {
 	Status int
 	Result interface{}
 	Body   interface{}
+	// дополнительные заголовки запроса, например X-API-Key
+	Headers map[string]string
 }
 
 var (
 	client = &http.Client{Timeout: time.Second}
+
+	// по-умолчанию тесты гоняются на sqlite в памяти процесса
+	// чтобы прогнать их на MySQL из main.go: TEST_DB_DRIVER=mysql go test
+	testDriver = os.Getenv("TEST_DB_DRIVER")
 )
 
+// OpenTestDB открывает базу, на которой гоняются тесты
+func OpenTestDB() *sql.DB {
+	if testDriver == "" {
+		testDriver = "sqlite3"
+	}
+
+	dsn := DSN
+	if testDriver == "sqlite3" {
+		dsn = ":memory:"
+	}
+
+	db, err := sql.Open(testDriver, dsn)
+	if err != nil {
+		panic(err)
+	}
+	// у каждого соединения с :memory: своя база, поэтому соединение одно
+	if testDriver == "sqlite3" {
+		db.SetMaxOpenConns(1)
+	}
+	err = db.Ping()
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
 func PrepareTestApis(db *sql.DB) {
+	if testDriver == "sqlite3" {
+		prepareQueries(db, sqliteTestApis)
+		return
+	}
+
 	qs := []string{
 		`DROP TABLE IF EXISTS items;`,
 
@@ -64,6 +113,39 @@ func PrepareTestApis(db *sql.DB) {
 (1,	'rvasily',	'love',	'rvasily@example.com',	'none',	NULL);`,
 	}
 
+	prepareQueries(db, qs)
+}
+
+var sqliteTestApis = []string{
+	`DROP TABLE IF EXISTS items;`,
+
+	`CREATE TABLE items (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  title varchar(255) NOT NULL,
+  description text NOT NULL,
+  updated varchar(255) DEFAULT NULL
+);`,
+
+	`INSERT INTO items (id, title, description, updated) VALUES
+(1,	'database/sql',	'Рассказать про базы данных',	'rvasily'),
+(2,	'memcache',	'Рассказать про мемкеш с примером использования',	NULL);`,
+
+	`DROP TABLE IF EXISTS users;`,
+
+	`CREATE TABLE users (
+  user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+  login varchar(255) NOT NULL,
+  password varchar(255) NOT NULL,
+  email varchar(255) NOT NULL,
+  info text NOT NULL,
+  updated varchar(255) DEFAULT NULL
+);`,
+
+	`INSERT INTO users (user_id, login, password, email, info, updated) VALUES
+(1,	'rvasily',	'love',	'rvasily@example.com',	'none',	NULL);`,
+}
+
+func prepareQueries(db *sql.DB, qs []string) {
 	for _, q := range qs {
 		_, err := db.Exec(q)
 		if err != nil {
@@ -77,20 +159,11 @@ func CleanupTestApis(db *sql.DB) {
 		`DROP TABLE IF EXISTS items;`,
 		`DROP TABLE IF EXISTS users;`,
 	}
-	for _, q := range qs {
-		_, err := db.Exec(q)
-		if err != nil {
-			panic(err)
-		}
-	}
+	prepareQueries(db, qs)
 }
 
 func TestApis(t *testing.T) {
-	db, err := sql.Open("mysql", DSN)
-	err = db.Ping()
-	if err != nil {
-		panic(err)
-	}
+	db := OpenTestDB()
 
 	PrepareTestApis(db)
 
@@ -499,70 +572,3604 @@ func TestApis(t *testing.T) {
 	runCases(t, ts, db, cases)
 }
 
-func runCases(t *testing.T, ts *httptest.Server, db *sql.DB, cases []Case) {
-	for idx, item := range cases {
-		var (
-			err      error
-			result   interface{}
-			expected interface{}
-			req      *http.Request
-		)
+// StartTestApis готовит базу и поднимает сервер для отдельных тестов
+func StartTestApis() (*sql.DB, *httptest.Server) {
+	db := OpenTestDB()
+	PrepareTestApis(db)
 
-		caseName := fmt.Sprintf("case %d: [%s] %s %s", idx, item.Method, item.Path, item.Query)
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		panic(err)
+	}
+	return db, httptest.NewServer(handler)
+}
 
-		// если у вас случилась это ошибка - значит вы не делаете где-то rows.Close и у вас текут соединения с базой
-		// если такое случилось на первом тесте - значит вы не закрываете коннект где-то при иницаилизации в NewDbExplorer
-		if db.Stats().OpenConnections != 1 {
-			t.Fatalf("[%s] you have %d open connections, must be 1", caseName, db.Stats().OpenConnections)
-		}
+func TestListFilters(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
 
-		if item.Method == "" || item.Method == http.MethodGet {
-			req, err = http.NewRequest(item.Method, ts.URL+item.Path+"?"+item.Query, nil)
-		} else {
-			data, err := json.Marshal(item.Body)
-			if err != nil {
-				panic(err)
-			}
-			reqBody := bytes.NewReader(data)
-			req, err = http.NewRequest(item.Method, ts.URL+item.Path, reqBody)
-			req.Header.Add("Content-Type", "application/json")
-		}
+	cases := []Case{
+		Case{
+			Path:  "/items",
+			Query: "where=title:eq:memcache&fields=id,title",
+			Result: CR{
+				"response": CR{
+					"records": []CR{
+						CR{
+							"id":    2,
+							"title": "memcache",
+						},
+					},
+				},
+			},
+		},
+		Case{
+			Path:  "/items",
+			Query: "where=id:gte:1&where=updated:notnull&fields=title,id",
+			Result: CR{
+				"response": CR{
+					"records": []CR{
+						CR{
+							"id":    1,
+							"title": "database/sql",
+						},
+					},
+				},
+			},
+		},
+		Case{
+			Path:  "/items",
+			Query: "order=-id&fields=id",
+			Result: CR{
+				"response": CR{
+					"records": []CR{
+						CR{"id": 2},
+						CR{"id": 1},
+					},
+				},
+			},
+		},
+		Case{
+			Path:   "/items",
+			Query:  "order=-unknown",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "unknown column unknown",
+			},
+		},
+		Case{
+			Path:   "/items",
+			Query:  "where=id:drop:1",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "unknown operator drop",
+			},
+		},
+		Case{
+			Path:   "/items",
+			Query:  "where=id:gt:one",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "field id have invalid type",
+			},
+		},
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			t.Fatalf("[%s] request error: %v", caseName, err)
-			continue
-		}
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
+	runCases(t, ts, db, cases)
+}
 
-		// fmt.Printf("[%s] body: %s\n", caseName, string(body))
-		if item.Status == 0 {
-			item.Status = http.StatusOK
-		}
+// itemsCursor курсор на запись items с заданным id
+func itemsCursor(id int) string {
+	return encodeCursor([]*Column{&Column{Field: "id"}},
+		map[string]interface{}{"id": id})
+}
 
-		if resp.StatusCode != item.Status {
-			t.Fatalf("[%s] expected http status %v, got %v", caseName, item.Status, resp.StatusCode)
-			continue
-		}
+func TestListPagination(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
 
-		err = json.Unmarshal(body, &result)
-		if err != nil {
-			t.Fatalf("[%s] cant unpack json: %v", caseName, err)
-			continue
-		}
+	cases := []Case{
+		Case{
+			Path:  "/items",
+			Query: "cursor=&limit=1&fields=title&total=1",
+			Result: CR{
+				"response": CR{
+					"total":       2,
+					"next_cursor": itemsCursor(1),
+					"records": []CR{
+						CR{
+							"id":    1,
+							"title": "database/sql",
+						},
+					},
+				},
+			},
+		},
+		Case{
+			Path:  "/items",
+			Query: "cursor=" + itemsCursor(1) + "&limit=1&fields=title",
+			Result: CR{
+				"response": CR{
+					"next_cursor": nil,
+					"records": []CR{
+						CR{
+							"id":    2,
+							"title": "memcache",
+						},
+					},
+				},
+			},
+		},
+		Case{
+			Path:  "/items",
+			Query: "limit=1&offset=1&total=1&where=id:gt:0&fields=id",
+			Result: CR{
+				"response": CR{
+					"total": 2,
+					"records": []CR{
+						CR{"id": 2},
+					},
+				},
+			},
+		},
+		Case{
+			Path:   "/items",
+			Query:  "cursor=&order=title",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "order is not supported with cursor",
+			},
+		},
+		Case{
+			Path:   "/items",
+			Query:  "cursor=broken",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "invalid cursor",
+			},
+		},
+		Case{
+			Path:   "/items",
+			Query:  "cursor=&limit=0",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "limit must be positive with cursor",
+			},
+		},
+	}
 
-		// reflect.DeepEqual не работает если нам приходят разные типы
-		// а там приходят разные типы (string VS interface{}) по сравнению с тем что в ожидаемом результате
-		// этот маленький грязный хак конвертит данные сначала в json, а потом обратно в interface - получаем совместимые результаты
-		// не используйте это в продакшен-коде - надо явно писать что ожидается интерфейс или использовать другой подход с точным форматом ответа
-		data, err := json.Marshal(item.Result)
-		json.Unmarshal(data, &expected)
+	runCases(t, ts, db, cases)
 
-		if !reflect.DeepEqual(result, expected) {
-			t.Fatalf("[%s] results not match\nGot : %#v\nWant: %#v", caseName, result, expected)
-			continue
+	// limit=0 - только total, ссылок на ту же страницу нет
+	for _, query := range []string{"limit=0", "limit=0&offset=1&total=1"} {
+		status, header, body := rawRequest(t, http.MethodGet, ts.URL+"/items?"+query, "", "")
+		if status != http.StatusOK || strings.Contains(body, "title") || len(header["Link"]) != 0 {
+			t.Errorf("[%s] unexpected response %d %v %s", query, status, header["Link"], body)
 		}
 	}
+}
+
+func TestBatch(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+
+	cases := []Case{
+		Case{
+			Path:   "/_batch",
+			Method: http.MethodPost,
+			Body: []CR{
+				CR{"op": "create", "table": "items", "body": CR{
+					"title":       "batch",
+					"description": "",
+				}},
+				CR{"op": "update", "table": "users", "id": 1, "body": CR{
+					"updated": "batch",
+				}},
+				CR{"op": "delete", "table": "items", "id": "2"},
+			},
+			Result: CR{
+				"response": CR{
+					"results": []CR{
+						CR{"id": 3},
+						CR{"updated": 1},
+						CR{"deleted": 1},
+					},
+				},
+			},
+		},
+		// вторая операция падает - первая тоже не должна примениться
+		Case{
+			Path:   "/_batch",
+			Method: http.MethodPost,
+			Status: http.StatusBadRequest,
+			Body: []CR{
+				CR{"op": "delete", "table": "items", "id": 1},
+				CR{"op": "update", "table": "items", "id": 1, "body": CR{
+					"title": 42,
+				}},
+			},
+			Result: CR{
+				"error": "field title have invalid type",
+				"index": 1,
+			},
+		},
+		Case{
+			Path:  "/items",
+			Query: "fields=id",
+			Result: CR{
+				"response": CR{
+					"records": []CR{
+						CR{"id": 1},
+						CR{"id": 3},
+					},
+				},
+			},
+		},
+		Case{
+			Path:   "/_batch",
+			Method: http.MethodPost,
+			Status: http.StatusNotFound,
+			Body: []CR{
+				CR{"op": "create", "table": "unknown_table"},
+			},
+			Result: CR{
+				"error": "unknown table",
+				"index": 0,
+			},
+		},
+	}
 
+	runCases(t, ts, db, cases)
+}
+
+func TestTypes(t *testing.T) {
+	db := OpenTestDB()
+	prepareQueries(db, []string{
+		`DROP TABLE IF EXISTS typed;`,
+		`CREATE TABLE typed (
+  id INTEGER NOT NULL PRIMARY KEY,
+  code varchar(4) NOT NULL,
+  price decimal(10,2) NOT NULL,
+  active tinyint(1) NOT NULL,
+  counter bigint unsigned DEFAULT NULL,
+  created datetime DEFAULT NULL,
+  day date DEFAULT NULL,
+  payload json DEFAULT NULL,
+  data blob
+);`,
+	})
+	defer prepareQueries(db, []string{`DROP TABLE IF EXISTS typed;`})
+
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		panic(err)
+	}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	cases := []Case{
+		Case{
+			Path:   "/typed/",
+			Method: http.MethodPut,
+			Body: CR{
+				"code":    "abcd",
+				"price":   12.5,
+				"active":  true,
+				"counter": 4294967296,
+				"created": "2020-01-02T03:04:05Z",
+				"day":     "2020-01-02",
+				"payload": CR{"a": 1},
+				"data":    "aGk=",
+			},
+			Result: CR{
+				"response": CR{
+					"id": 1,
+				},
+			},
+		},
+		Case{
+			Path: "/typed/1",
+			Result: CR{
+				"response": CR{
+					"record": CR{
+						"id":      1,
+						"code":    "abcd",
+						"price":   12.5,
+						"active":  true,
+						"counter": 4294967296,
+						"created": "2020-01-02T03:04:05Z",
+						"day":     "2020-01-02",
+						"payload": CR{"a": 1},
+						"data":    "aGk=",
+					},
+				},
+			},
+		},
+		Case{
+			Path:   "/typed/1",
+			Method: http.MethodPost,
+			Status: http.StatusBadRequest,
+			Body: CR{
+				"code": "abcde",
+			},
+			Result: CR{
+				"error": "field code is too long",
+			},
+		},
+		Case{
+			Path:   "/typed/1",
+			Method: http.MethodPost,
+			Status: http.StatusBadRequest,
+			Body: CR{
+				"counter": -1,
+			},
+			Result: CR{
+				"error": "field counter is out of range",
+			},
+		},
+		Case{
+			Path:   "/typed/1",
+			Method: http.MethodPost,
+			Status: http.StatusBadRequest,
+			Body: CR{
+				"price": 1.234,
+			},
+			Result: CR{
+				"error": "field price is out of range",
+			},
+		},
+		Case{
+			Path:   "/typed/1",
+			Method: http.MethodPost,
+			Status: http.StatusBadRequest,
+			Body: CR{
+				"day": "yesterday",
+			},
+			Result: CR{
+				"error": "field day have invalid type",
+			},
+		},
+	}
+
+	runCases(t, ts, db, cases)
+}
+
+func TestPrimaryKeys(t *testing.T) {
+	db := OpenTestDB()
+	PrepareTestApis(db)
+	prepareQueries(db, []string{
+		`DROP TABLE IF EXISTS memberships;`,
+		`CREATE TABLE memberships (
+  user_id INTEGER NOT NULL,
+  group_id INTEGER NOT NULL,
+  role varchar(255) NOT NULL,
+  PRIMARY KEY (user_id, group_id)
+);`,
+		`INSERT INTO memberships (user_id, group_id, role) VALUES
+(1, 1, 'owner'),
+(1, 2, 'member');`,
+		`DROP TABLE IF EXISTS notes;`,
+		`CREATE TABLE notes (
+  body text NOT NULL
+);`,
+		`DROP TABLE IF EXISTS tags;`,
+		`CREATE TABLE tags (
+  name varchar(255) NOT NULL,
+  PRIMARY KEY (name)
+);`,
+		`INSERT INTO tags (name) VALUES ('a,b'), ('c/d');`,
+		`DROP TABLE IF EXISTS labels;`,
+		`CREATE TABLE labels (
+  scope varchar(255) NOT NULL,
+  name varchar(255) NOT NULL,
+  PRIMARY KEY (scope, name)
+);`,
+		`INSERT INTO labels (scope, name) VALUES ('x,y', 'z%');`,
+		`DROP TABLE IF EXISTS counters;`,
+		`CREATE TABLE counters (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  hits INTEGER NOT NULL DEFAULT 0
+);`,
+	})
+	defer CleanupTestApis(db)
+	defer prepareQueries(db, []string{
+		`DROP TABLE IF EXISTS memberships;`,
+		`DROP TABLE IF EXISTS notes;`,
+		`DROP TABLE IF EXISTS tags;`,
+		`DROP TABLE IF EXISTS labels;`,
+		`DROP TABLE IF EXISTS counters;`,
+	})
+
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		panic(err)
+	}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	cases := []Case{
+		Case{
+			Path: "/memberships/1,2",
+			Result: CR{
+				"response": CR{
+					"record": CR{
+						"user_id":  1,
+						"group_id": 2,
+						"role":     "member",
+					},
+				},
+			},
+		},
+		Case{
+			Path:   "/memberships/",
+			Method: http.MethodPut,
+			Body: CR{
+				"user_id":  2,
+				"group_id": 1,
+				"role":     "member",
+			},
+			Result: CR{
+				"response": CR{
+					"user_id":  2,
+					"group_id": 1,
+				},
+			},
+		},
+		Case{
+			Path:   "/memberships/2,1",
+			Method: http.MethodPost,
+			Body: CR{
+				"role": "owner",
+			},
+			Result: CR{
+				"response": CR{
+					"updated": 1,
+				},
+			},
+		},
+		Case{
+			Path:   "/memberships/1,1",
+			Method: http.MethodDelete,
+			Result: CR{
+				"response": CR{
+					"deleted": 1,
+				},
+			},
+		},
+		Case{
+			Path:  "/memberships",
+			Query: "cursor=&limit=1",
+			Result: CR{
+				"response": CR{
+					"next_cursor": encodeCursor(
+						[]*Column{&Column{Field: "user_id"}, &Column{Field: "group_id"}},
+						map[string]interface{}{"user_id": 1, "group_id": 2}),
+					"records": []CR{
+						CR{
+							"user_id":  1,
+							"group_id": 2,
+							"role":     "member",
+						},
+					},
+				},
+			},
+		},
+		Case{
+			Path:   "/memberships/1",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "invalid primary key",
+			},
+		},
+		// ключ из одного столбца не делится по запятой, %2F не делит путь
+		Case{
+			Path:   "/tags/a,b",
+			Result: CR{"response": CR{"record": CR{"name": "a,b"}}},
+		},
+		Case{
+			Path:   "/tags/c%2Fd",
+			Result: CR{"response": CR{"record": CR{"name": "c/d"}}},
+		},
+		// части составного ключа раскодируются по отдельности
+		Case{
+			Path:   "/labels/x%2Cy,z%25",
+			Result: CR{"response": CR{"record": CR{"scope": "x,y", "name": "z%"}}},
+		},
+		Case{
+			Path:   "/labels/x,y,z%25",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "invalid primary key",
+			},
+		},
+		Case{
+			Path:   "/notes/1",
+			Method: http.MethodDelete,
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "table has no primary key",
+			},
+		},
+		// ключ users называется user_id, а не id
+		Case{
+			Path:   "/users/1",
+			Method: http.MethodDelete,
+			Result: CR{
+				"response": CR{
+					"deleted": 1,
+				},
+			},
+		},
+		// все столбцы по-умолчанию: INSERT без списка столбцов
+		Case{
+			Path:   "/counters",
+			Method: http.MethodPost,
+			Body:   CR{},
+			Result: CR{
+				"response": CR{
+					"id": 1,
+				},
+			},
+		},
+		Case{
+			Path: "/counters/1",
+			Result: CR{
+				"response": CR{
+					"record": CR{
+						"id":   1,
+						"hits": 0,
+					},
+				},
+			},
+		},
+	}
+
+	runCases(t, ts, db, cases)
+}
+
+func TestRelations(t *testing.T) {
+	db := OpenTestDB()
+	prepareQueries(db, []string{
+		`DROP TABLE IF EXISTS posts;`,
+		`DROP TABLE IF EXISTS authors;`,
+		`CREATE TABLE authors (
+  id INTEGER NOT NULL PRIMARY KEY,
+  name varchar(255) NOT NULL
+);`,
+		`CREATE TABLE posts (
+  id INTEGER NOT NULL PRIMARY KEY,
+  author_id INTEGER DEFAULT NULL,
+  title varchar(255) NOT NULL,
+  FOREIGN KEY (author_id) REFERENCES authors (id)
+);`,
+		`INSERT INTO authors (id, name) VALUES (1, 'rvasily'), (2, 'nobody');`,
+		`INSERT INTO posts (id, author_id, title) VALUES
+(1, 1, 'database/sql'),
+(2, NULL, 'draft'),
+(3, 1, 'memcache');`,
+	})
+	defer prepareQueries(db, []string{
+		`DROP TABLE IF EXISTS posts;`,
+		`DROP TABLE IF EXISTS authors;`,
+	})
+
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		panic(err)
+	}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	author := CR{"id": 1, "name": "rvasily"}
+	cases := []Case{
+		Case{
+			Path: "/authors/_meta",
+			Result: CR{
+				"response": CR{
+					"table":        "authors",
+					"foreign_keys": []CR{},
+					"referenced_by": []CR{
+						CR{
+							"table":      "posts",
+							"name":       handler.schema().foreignKeys["posts"][0].Name,
+							"column":     "author_id",
+							"ref_column": "id",
+						},
+					},
+				},
+			},
+		},
+		Case{
+			Path:  "/posts/1",
+			Query: "expand=author",
+			Result: CR{
+				"response": CR{
+					"record": CR{
+						"id":        1,
+						"author_id": 1,
+						"author":    author,
+						"title":     "database/sql",
+					},
+				},
+			},
+		},
+		Case{
+			Path:  "/posts",
+			Query: "expand=author&fields=id,author_id",
+			Result: CR{
+				"response": CR{
+					"records": []CR{
+						CR{"id": 1, "author_id": 1, "author": author},
+						CR{"id": 2, "author_id": nil, "author": nil},
+						CR{"id": 3, "author_id": 1, "author": author},
+					},
+				},
+			},
+		},
+		Case{
+			Path:  "/authors/1/posts",
+			Query: "fields=id,title&order=-id",
+			Result: CR{
+				"response": CR{
+					"records": []CR{
+						CR{"id": 3, "title": "memcache"},
+						CR{"id": 1, "title": "database/sql"},
+					},
+				},
+			},
+		},
+		Case{
+			Path: "/authors/2/posts",
+			Result: CR{
+				"response": CR{
+					"records": []CR{},
+				},
+			},
+		},
+		Case{
+			Path:   "/authors/3/posts",
+			Status: http.StatusNotFound,
+			Result: CR{
+				"error": "record not found",
+			},
+		},
+		Case{
+			Path:   "/posts/1",
+			Query:  "expand=editor",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "unknown relation editor",
+			},
+		},
+	}
+
+	runCases(t, ts, db, cases)
+
+	// связь по скрытому от роли столбцу не раскрывается и не показывается
+	handler.Auth = &AuthConfig{
+		APIKeys: map[string]*Identity{
+			"reader": &Identity{Subject: "bob", Role: "reader"},
+			"guest":  &Identity{Subject: "eve", Role: "guest"},
+		},
+		Roles: map[string]*RolePolicy{
+			"reader": &RolePolicy{Tables: map[string]*TablePolicy{
+				"*":     &TablePolicy{Read: true},
+				"posts": &TablePolicy{Read: true, Hidden: []string{"author_id"}},
+			}},
+			"guest": &RolePolicy{Tables: map[string]*TablePolicy{
+				"authors": &TablePolicy{Read: true},
+			}},
+		},
+	}
+	for _, key := range []string{"reader", "guest"} {
+		runCases(t, ts, db, []Case{
+			Case{
+				Path:    "/authors/_meta",
+				Headers: map[string]string{"X-API-Key": key},
+				Result: CR{
+					"response": CR{
+						"table":         "authors",
+						"foreign_keys":  []CR{},
+						"referenced_by": []CR{},
+					},
+				},
+			},
+		})
+	}
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:    "/posts/1",
+			Query:   "expand=author",
+			Headers: map[string]string{"X-API-Key": "reader"},
+			Status:  http.StatusBadRequest,
+			Result: CR{
+				"error": "unknown relation author",
+			},
+		},
+		Case{
+			Path:    "/posts",
+			Query:   "expand=author",
+			Headers: map[string]string{"X-API-Key": "reader"},
+			Status:  http.StatusBadRequest,
+			Result: CR{
+				"error": "unknown relation author",
+			},
+		},
+		Case{
+			Path:    "/authors/1/posts",
+			Headers: map[string]string{"X-API-Key": "reader"},
+			Status:  http.StatusNotFound,
+			Result: CR{
+				"error": "unknown relation",
+			},
+		},
+		Case{
+			Path:    "/posts/_meta",
+			Headers: map[string]string{"X-API-Key": "reader"},
+			Result: CR{
+				"response": CR{
+					"table":         "posts",
+					"foreign_keys":  []CR{},
+					"referenced_by": []CR{},
+				},
+			},
+		},
+	})
+}
+
+func TestSchema(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+
+	cases := []Case{
+		Case{
+			Path: "/items/_schema",
+			Result: CR{
+				"response": CR{
+					"table":       "items",
+					"primary_key": []string{"id"},
+					"columns": []CR{
+						CR{"field": "id", "type": "int(11)", "null": "NO", "key": "PRI",
+							"default": "", "extra": "auto_increment", "kind": "int"},
+						CR{"field": "title", "type": "varchar(255)", "null": "NO", "key": "",
+							"default": "", "extra": "", "kind": "string", "length": 255},
+						CR{"field": "description", "type": "text", "null": "NO", "key": "",
+							"default": "", "extra": "", "kind": "string", "length": 65535},
+						CR{"field": "updated", "type": "varchar(255)", "null": "YES", "key": "",
+							"default": "", "extra": "", "kind": "string", "length": 255},
+					},
+				},
+			},
+		},
+	}
+	if testDriver == "sqlite3" {
+		// в SQLite тип столбца хранится так, как его написали в CREATE TABLE
+		cases[0].Result.(CR)["response"].(CR)["columns"].([]CR)[0]["type"] = "integer"
+	}
+	runCases(t, ts, db, cases)
+
+	resp, err := client.Get(ts.URL + "/_openapi.json")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	doc := struct {
+		Paths      map[string]map[string]interface{}
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]CR
+				Required   []string
+			}
+		}
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("cant unpack json: %v", err)
+	}
+
+	for path, methods := range map[string][]string{
+		"/":              {"get"},
+		"/items":         {"get"},
+		"/items/":        {"put"},
+		"/items/{id}":    {"get", "post", "delete"},
+		"/users/_schema": {"get"},
+	} {
+		for _, method := range methods {
+			if _, ok := doc.Paths[path][method]; !ok {
+				t.Fatalf("no %s %s in openapi paths", method, path)
+			}
+		}
+	}
+
+	input := doc.Components.Schemas["items_input"]
+	if _, ok := input.Properties["id"]; ok {
+		t.Fatalf("auto increment id must not be in items_input")
+	}
+	if !reflect.DeepEqual(input.Required, []string{"title", "description"}) {
+		t.Fatalf("items_input required: %v", input.Required)
+	}
+	if input.Properties["title"]["maxLength"] != float64(255) {
+		t.Fatalf("items_input title: %v", input.Properties["title"])
+	}
+
+	//в PATCH все поля необязательны, ключ не меняется
+	patch := doc.Components.Schemas["items_patch"]
+	if _, ok := patch.Properties["id"]; ok || len(patch.Required) != 0 {
+		t.Fatalf("items_patch: %+v", patch)
+	}
+	if patch.Properties["updated"]["nullable"] != true || patch.Properties["title"]["nullable"] != nil {
+		t.Fatalf("items_patch nullable: %v", patch.Properties)
+	}
+	op, _ := doc.Paths["/items/{id}"]["patch"].(map[string]interface{})
+	if !strings.Contains(fmt.Sprint(op["requestBody"]), "#/components/schemas/items_patch") {
+		t.Fatalf("patch request body: %v", op["requestBody"])
+	}
+	op, _ = doc.Paths["/items/{id}"]["put"].(map[string]interface{})
+	responses, _ := op["responses"].(map[string]interface{})
+	for _, status := range []string{"200", "201"} {
+		if _, ok := responses[status]; !ok {
+			t.Fatalf("no %s response of put: %v", status, responses)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+	defer prepareQueries(db, []string{`DROP TABLE IF EXISTS tags;`})
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:   "/tags",
+			Status: http.StatusNotFound,
+			Result: CR{
+				"error": "unknown table",
+			},
+		},
+	})
+
+	prepareQueries(db, []string{
+		`CREATE TABLE tags (
+  id INTEGER NOT NULL PRIMARY KEY,
+  name varchar(255) NOT NULL
+);`,
+		`INSERT INTO tags (id, name) VALUES (1, 'golang');`,
+		`ALTER TABLE items ADD COLUMN tag_id INTEGER DEFAULT NULL;`,
+		`DROP TABLE users;`,
+	})
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:   "/_reload",
+			Method: http.MethodPost,
+			Result: CR{
+				"response": CR{
+					"added_tables":    []string{"tags"},
+					"removed_tables":  []string{"users"},
+					"added_columns":   CR{"items": []string{"tag_id"}},
+					"removed_columns": CR{},
+					"changed_columns": CR{},
+				},
+			},
+		},
+		Case{
+			Path: "/tags/1",
+			Result: CR{
+				"response": CR{
+					"record": CR{
+						"id":   1,
+						"name": "golang",
+					},
+				},
+			},
+		},
+		Case{
+			Path:   "/users/1",
+			Status: http.StatusNotFound,
+			Result: CR{
+				"error": "unknown table",
+			},
+		},
+	})
+}
+
+func TestRouter(t *testing.T) {
+	router := NewRouter()
+	echo := func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		keys := make([]string, 0, len(params))
+		for key, value := range params {
+			keys = append(keys, key+"="+value)
+		}
+		w.Write([]byte(r.Method + " " + strings.Join(keys, "&")))
+	}
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if info := routeFrom(r.Context()); info != nil {
+				w.Header().Set("X-Route", info.URL)
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	router.addSimpleHandler("/users/me", "GET", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("me"))
+	})
+	router.addAdvancedHandler("/users/{id:int}", "GET", echo)
+	router.addAdvancedHandler("/users/{login:[a-z-]+}", "GET", echo)
+	router.addAdvancedHandler("/posts/{slug}", "GET", echo)
+	router.addAdvancedHandler("/posts/{slug}", "POST", echo)
+	router.addAdvancedHandler("/files/{path...}", "GET", echo)
+	router.addSimpleHandler("/db/_batch", "POST", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("batch"))
+	})
+	router.addAdvancedHandler("/db/{table}", "GET", echo)
+	router.addAdvancedHandler("/db/{table}/_meta", "GET", echo)
+	router.addAdvancedHandler("/db/{table}/{id}", "POST", echo)
+
+	errs := []error{
+		router.addAdvancedHandler("/posts/{slug}", "GET", echo),
+		router.addAdvancedHandler("/bad/{id:[}", "GET", echo),
+		router.addAdvancedHandler("/bad/{path...}/tail", "GET", echo),
+		router.addAdvancedHandler("/bad", "GET", echo),
+		router.addSimpleHandler("/bad/{id}", "GET", nil),
+	}
+	for idx, err := range errs {
+		if err == nil {
+			t.Errorf("registration %d: expected error", idx)
+		}
+	}
+
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	cases := []struct {
+		Method string
+		Path   string
+		Status int
+		Body   string
+		Allow  string
+		Route  string
+	}{
+		{"GET", "/users/me", 200, "me", "", "/users/me"},
+		{"GET", "/users/42", 200, "GET id=42", "", "/users/{id:int}"},
+		{"GET", "/users/john-doe", 200, "GET login=john-doe", "", "/users/{login:[a-z-]+}"},
+		{"GET", "/users/John", 404, `{"code":"not_found","error":"not found"}`, "", ""},
+		{"GET", "/posts/hello-world", 200, "GET slug=hello-world", "", "/posts/{slug}"},
+		{"POST", "/posts/hello-world", 200, "POST slug=hello-world", "", "/posts/{slug}"},
+		{"GET", "/files/a/b/c.txt", 200, "GET path=a/b/c.txt", "", "/files/{path...}"},
+		{"HEAD", "/users/42", 200, "", "", "/users/{id:int}"},
+		{"DELETE", "/posts/x", 405, `{"code":"method_not_allowed","error":"method not allowed"}`, "GET, HEAD, OPTIONS, POST", ""},
+		{"OPTIONS", "/posts/x", 204, "", "GET, HEAD, OPTIONS, POST", ""},
+		{"GET", "/posts", 404, `{"code":"not_found","error":"not found"}`, "", ""},
+		// служебные сегменты не попадают в параметры, даже если метод не тот
+		{"POST", "/db/_batch", 200, "batch", "", "/db/_batch"},
+		{"GET", "/db/_batch", 405, `{"code":"method_not_allowed","error":"method not allowed"}`, "OPTIONS, POST", ""},
+		{"GET", "/db/items", 200, "GET table=items", "", "/db/{table}"},
+		{"POST", "/db/items/_meta", 405, `{"code":"method_not_allowed","error":"method not allowed"}`, "GET, HEAD, OPTIONS", ""},
+	}
+	for idx, item := range cases {
+		caseName := fmt.Sprintf("case %d: [%s] %s", idx, item.Method, item.Path)
+		req, _ := http.NewRequest(item.Method, ts.URL+item.Path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("[%s] request error: %v", caseName, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != item.Status {
+			t.Errorf("[%s] expected http status %v, got %v", caseName, item.Status, resp.StatusCode)
+		}
+		if string(body) != item.Body {
+			t.Errorf("[%s] expected body %q, got %q", caseName, item.Body, string(body))
+		}
+		if allow := resp.Header.Get("Allow"); allow != item.Allow {
+			t.Errorf("[%s] expected Allow %q, got %q", caseName, item.Allow, allow)
+		}
+		if route := resp.Header.Get("X-Route"); route != item.Route {
+			t.Errorf("[%s] expected route %q, got %q", caseName, item.Route, route)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	db := OpenTestDB()
+	PrepareTestApis(db)
+	defer CleanupTestApis(db)
+
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		panic(err)
+	}
+
+	config, err := ioutil.TempFile("", "auth*.json")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(config.Name())
+	config.WriteString(`{
+  "api_keys": {"admin-key": {"sub": "ci", "role": "admin"}},
+  "token_secret": "s3cret",
+  "roles": {
+    "admin": {"admin": true, "tables": {
+      "*": {"read": true, "write": true},
+      "users": {"read": true, "write": true, "read_only": ["login"]}
+    }},
+    "viewer": {"tables": {
+      "users": {"read": true, "hidden": ["password"]}
+    }}
+  }
+}`)
+	config.Close()
+
+	handler.Auth, err = LoadAuthConfig(config.Name())
+	if err != nil {
+		t.Fatalf("auth config error: %v", err)
+	}
+
+	// в ошибке нет ни ключа, ни его части
+	broken, err := ioutil.TempFile("", "auth*.json")
+	if err != nil {
+		panic(err)
+	}
+	defer os.Remove(broken.Name())
+	broken.WriteString(`{"api_keys": {"secret-key-123": {"sub": "ci", "role": "nobody"}}}`)
+	broken.Close()
+	_, err = LoadAuthConfig(broken.Name())
+	if err == nil || strings.Contains(err.Error(), "secret") ||
+		!strings.HasSuffix(err.Error(), "of ci: unknown role nobody") {
+		t.Errorf("expected unknown role error without the key, got %v", err)
+	}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	admin := map[string]string{"X-API-Key": "admin-key"}
+	viewer := map[string]string{"Authorization": "Bearer " +
+		SignToken("s3cret", &Identity{Subject: "bob", Role: "viewer"})}
+	expired := map[string]string{"Authorization": "Bearer " +
+		SignToken("s3cret", &Identity{Subject: "bob", Role: "viewer", Expires: 1})}
+	forged := map[string]string{"Authorization": "Bearer " +
+		SignToken("other", &Identity{Subject: "bob", Role: "admin"})}
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:   "/",
+			Status: http.StatusUnauthorized,
+			Result: CR{
+				"error": "unauthorized",
+			},
+		},
+		Case{
+			Path:    "/",
+			Headers: map[string]string{"X-API-Key": "wrong"},
+			Status:  http.StatusUnauthorized,
+			Result: CR{
+				"error": "invalid api key",
+			},
+		},
+		Case{
+			Path:    "/",
+			Headers: expired,
+			Status:  http.StatusUnauthorized,
+			Result: CR{
+				"error": "token expired",
+			},
+		},
+		Case{
+			Path:    "/",
+			Headers: forged,
+			Status:  http.StatusUnauthorized,
+			Result: CR{
+				"error": "invalid token",
+			},
+		},
+		Case{
+			Path:    "/",
+			Headers: viewer,
+			Result: CR{
+				"response": CR{
+					"tables": []string{"users"},
+				},
+			},
+		},
+		Case{
+			Path:    "/items",
+			Headers: viewer,
+			Status:  http.StatusForbidden,
+			Result: CR{
+				"error": "access to table items denied",
+			},
+		},
+		Case{
+			Path:    "/users/1",
+			Headers: viewer,
+			Result: CR{
+				"response": CR{
+					"record": CR{
+						"user_id": 1,
+						"login":   "rvasily",
+						"email":   "rvasily@example.com",
+						"info":    "none",
+						"updated": nil,
+					},
+				},
+			},
+		},
+		Case{
+			Path:    "/users",
+			Query:   "where=password:eq:love",
+			Headers: viewer,
+			Status:  http.StatusBadRequest,
+			Result: CR{
+				"error": "unknown column password",
+			},
+		},
+		Case{
+			Path:    "/users/1",
+			Method:  http.MethodPost,
+			Headers: viewer,
+			Status:  http.StatusForbidden,
+			Body: CR{
+				"info": "hacked",
+			},
+			Result: CR{
+				"error": "access to table users denied",
+			},
+		},
+		Case{
+			Path:    "/users/1",
+			Method:  http.MethodPost,
+			Headers: admin,
+			Status:  http.StatusForbidden,
+			Body: CR{
+				"login": "root",
+			},
+			Result: CR{
+				"error": "field login is read-only",
+			},
+		},
+		Case{
+			Path:    "/users/1",
+			Method:  http.MethodPost,
+			Headers: admin,
+			Body: CR{
+				"info": "admin",
+			},
+			Result: CR{
+				"response": CR{
+					"updated": 1,
+				},
+			},
+		},
+		Case{
+			Path:    "/users/1",
+			Method:  http.MethodDelete,
+			Headers: viewer,
+			Status:  http.StatusForbidden,
+			Result: CR{
+				"error": "access to table users denied",
+			},
+		},
+		Case{
+			Path:    "/_batch",
+			Method:  http.MethodPost,
+			Headers: viewer,
+			Status:  http.StatusForbidden,
+			Body: []CR{
+				CR{"op": "delete", "table": "users", "id": 1},
+			},
+			Result: CR{
+				"error": "access to table users denied",
+				"index": 0,
+			},
+		},
+		Case{
+			Path:    "/_reload",
+			Method:  http.MethodPost,
+			Headers: viewer,
+			Status:  http.StatusForbidden,
+			Result: CR{
+				"error": "forbidden",
+			},
+		},
+		Case{
+			Path:    "/items/2",
+			Headers: admin,
+			Result: CR{
+				"response": CR{
+					"record": CR{
+						"id":          2,
+						"title":       "memcache",
+						"description": "Рассказать про мемкеш с примером использования",
+						"updated":     nil,
+					},
+				},
+			},
+		},
+	})
+
+	//описание API строится по правам того, кто его запрашивает
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/_openapi.json", nil)
+	req.Header.Set("Authorization", viewer["Authorization"])
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("openapi request error: %v", err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	doc := struct {
+		Paths      map[string]map[string]interface{}
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]CR
+			}
+		}
+	}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("cant unpack json: %v", err)
+	}
+	if _, ok := doc.Paths["/users/{id}"]["get"]; !ok {
+		t.Errorf("no GET /users/{id} in viewer openapi")
+	}
+	for path, method := range map[string]string{
+		"/items":      "get",
+		"/users":      "post",
+		"/users/{id}": "delete",
+		"/_query":     "post",
+		"/_reload":    "post",
+	} {
+		if _, ok := doc.Paths[path][method]; ok {
+			t.Errorf("unexpected %s %s in viewer openapi", method, path)
+		}
+	}
+	if _, ok := doc.Components.Schemas["users"].Properties["password"]; ok {
+		t.Errorf("hidden column in viewer openapi")
+	}
+	for _, name := range []string{"items", "users_input", "users_patch"} {
+		if _, ok := doc.Components.Schemas[name]; ok {
+			t.Errorf("unexpected schema %s in viewer openapi", name)
+		}
+	}
+}
+
+// syncBuffer буфер для лога, в который пишет горутина сервера
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+// events разбирает строки лога
+func (sb *syncBuffer) events() []CR {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	events := make([]CR, 0)
+	for _, line := range strings.Split(strings.TrimSpace(sb.buf.String()), "\n") {
+		event := CR{}
+		if err := json.Unmarshal([]byte(line), &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestErrors(t *testing.T) {
+	db := OpenTestDB()
+	PrepareTestApis(db)
+	defer CleanupTestApis(db)
+
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		panic(err)
+	}
+	logs := &syncBuffer{}
+	handler.Logger = log.New(logs, "", 0)
+	handler.router.addSimpleHandler("/_panic", "GET", func(w http.ResponseWriter, r *http.Request) {
+		var rows *sql.Rows
+		rows.Next()
+	})
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:   "/_panic",
+			Status: http.StatusInternalServerError,
+			Result: CR{
+				"error": "internal error",
+				"code":  "internal",
+			},
+		},
+		Case{
+			Path:   "/items/",
+			Method: http.MethodPut,
+			Body:   "not an object",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "invalid json",
+			},
+		},
+		Case{
+			Path:   "/items/1",
+			Method: http.MethodPost,
+			Body: CR{
+				"title": "db",
+			},
+			Headers: map[string]string{"X-Request-ID": "req-42"},
+			Result: CR{
+				"response": CR{
+					"updated": 1,
+				},
+			},
+		},
+	})
+
+	events := logs.events()
+	if len(events) != 4 {
+		t.Fatalf("expected 4 log events, got %d: %v", len(events), events)
+	}
+	if events[0]["event"] != "panic" || events[0]["stack"] == nil {
+		t.Errorf("expected panic event, got %v", events[0])
+	}
+	if events[1]["event"] != "access" || events[1]["status"] != 500.0 ||
+		events[1]["route"] != "/_panic" || events[1]["error"] == nil {
+		t.Errorf("unexpected access log for panic: %v", events[1])
+	}
+	if events[2]["status"] != 400.0 || events[2]["route"] != "/{table}/" {
+		t.Errorf("unexpected access log for invalid json: %v", events[2])
+	}
+	update := events[3]
+	if update["request_id"] != "req-42" || update["route"] != "/{table}/{id}" ||
+		update["method"] != "POST" || update["rows_affected"] != 1.0 ||
+		update["latency_ms"] == nil {
+		t.Errorf("unexpected access log for update: %v", update)
+	}
+
+	resp, err := client.Get(ts.URL + "/items/1")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("X-Request-ID") == "" {
+		t.Errorf("expected generated X-Request-ID")
+	}
+}
+
+// slowDelay задержка каждого запроса slowsqlite в наносекундах
+var slowDelay int64
+
+// slowRowDelay задержка каждой строки выборки slowsqlite в наносекундах
+var slowRowDelay int64
+
+// slowDriver sqlite, который перед каждым запросом ждёт slowDelay,
+// но, как настоящая база, бросает запрос при отмене контекста
+type slowDriver struct{}
+
+type slowConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (slowDriver) Open(name string) (driver.Conn, error) {
+	conn, err := (&sqlite3.SQLiteDriver{}).Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &slowConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+func (c *slowConn) wait(ctx context.Context) error {
+	select {
+	case <-time.After(time.Duration(atomic.LoadInt64(&slowDelay))):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *slowConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	if err != nil || atomic.LoadInt64(&slowRowDelay) == 0 {
+		return rows, err
+	}
+	return slowRows{rows}, nil
+}
+
+// slowRows строки, каждая из которых читается slowRowDelay
+type slowRows struct {
+	driver.Rows
+}
+
+func (r slowRows) Next(dest []driver.Value) error {
+	time.Sleep(time.Duration(atomic.LoadInt64(&slowRowDelay)))
+	return r.Rows.Next(dest)
+}
+
+func (c *slowConn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+	if err := c.wait(ctx); err != nil {
+		return nil, err
+	}
+	return c.SQLiteConn.ExecContext(ctx, query, args)
+}
+
+func init() {
+	sql.Register("slowsqlite", slowDriver{})
+}
+
+func TestTimeouts(t *testing.T) {
+	// прерванная транзакция закрывает соединение, а с ним пропала бы
+	// и база в памяти, поэтому база в файле
+	dir, err := ioutil.TempDir("", "slowsqlite")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("slowsqlite", dir+"/test.db")
+	if err != nil {
+		panic(err)
+	}
+	db.SetMaxOpenConns(1)
+	prepareQueries(db, sqliteTestApis)
+	defer db.Close()
+
+	handler, err := NewDbExplorerDialect(db, SQLiteDialect{})
+	if err != nil {
+		panic(err)
+	}
+	handler.RouteTimeouts = map[string]time.Duration{
+		"GET /{table}": 20 * time.Millisecond,
+	}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	atomic.StoreInt64(&slowDelay, int64(200*time.Millisecond))
+	defer atomic.StoreInt64(&slowDelay, 0)
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:   "/items",
+			Status: http.StatusGatewayTimeout,
+			Result: CR{
+				"error": "query timeout",
+				"code":  "timeout",
+			},
+		},
+		// у маршрута своего таймаута нет, а общий не задан
+		Case{
+			Path: "/items/2",
+			Result: CR{
+				"response": CR{
+					"record": CR{
+						"id":          2,
+						"title":       "memcache",
+						"description": "Рассказать про мемкеш с примером использования",
+						"updated":     nil,
+					},
+				},
+			},
+		},
+	})
+
+	handler.QueryTimeout = 20 * time.Millisecond
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:   "/items/2",
+			Method: http.MethodPost,
+			Body: CR{
+				"title": "slow",
+			},
+			Status: http.StatusGatewayTimeout,
+			Result: CR{
+				"error": "query timeout",
+				"code":  "timeout",
+			},
+		},
+		Case{
+			Path:   "/_batch",
+			Method: http.MethodPost,
+			Body: []CR{
+				CR{"op": "delete", "table": "items", "id": 1},
+			},
+			Status: http.StatusGatewayTimeout,
+			Result: CR{
+				"error": "query timeout",
+				"code":  "timeout",
+				"index": 0,
+			},
+		},
+	})
+
+	// прерванные запросы ничего не поменяли
+	atomic.StoreInt64(&slowDelay, 0)
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM items WHERE title = 'slow' OR id = 1").Scan(&count)
+	if err != nil {
+		t.Fatalf("count error: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected only item 1 to stay untouched, got %d rows", count)
+	}
+
+	// выгрузка дольше QueryTimeout, но каждая строка укладывается в него
+	prepareQueries(db, []string{
+		`INSERT INTO items (id, title, description) VALUES (3, 'a', ''), (4, 'b', '');`,
+	})
+	handler.QueryTimeout = 100 * time.Millisecond
+	export := func() (int, string, string) {
+		resp, err := client.Get(ts.URL + "/items/_export?fields=id")
+		if err != nil {
+			t.Fatalf("export request error: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), resp.Trailer.Get("X-Export-Error")
+	}
+	atomic.StoreInt64(&slowRowDelay, int64(40*time.Millisecond))
+	status, body, exportErr := export()
+	if status != http.StatusOK || exportErr != "" || strings.Count(body, "\n") != 4 ||
+		strings.Contains(body, "error") {
+		t.Errorf("slow export: got %d %q, X-Export-Error %q", status, body, exportErr)
+	}
+
+	// строка не пришла за QueryTimeout: выгрузка обрывается записью об ошибке
+	atomic.StoreInt64(&slowRowDelay, int64(150*time.Millisecond))
+	defer atomic.StoreInt64(&slowRowDelay, 0)
+	status, body, exportErr = export()
+	if status != http.StatusOK || exportErr != "query timeout" ||
+		!strings.HasSuffix(body, `{"code":"timeout","error":"query timeout"}`+"\n") {
+		t.Errorf("stalled export: got %d %q, X-Export-Error %q", status, body, exportErr)
+	}
+}
+
+// rawRequest запрос с телом не в JSON, ответ отдаётся как есть
+func rawRequest(t *testing.T, method, url, contentType, body string) (int, http.Header, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("[%s %s] request error: %v", method, url, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("[%s %s] request error: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header, string(data)
+}
+
+func TestExportImport(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+
+	status, header, body := rawRequest(t, "GET", ts.URL+"/items/_export?format=csv", "", "")
+	expected := "id,title,description,updated\n" +
+		"1,database/sql,Рассказать про базы данных,rvasily\n" +
+		"2,memcache,Рассказать про мемкеш с примером использования,\n"
+	if status != http.StatusOK || body != expected {
+		t.Errorf("csv export: got %d %q", status, body)
+	}
+	if header.Get("Content-Type") != "text/csv; charset=utf-8" ||
+		header.Get("Content-Disposition") != `attachment; filename="items.csv"` {
+		t.Errorf("csv export: unexpected headers %v", header)
+	}
+
+	status, _, body = rawRequest(t, "GET",
+		ts.URL+"/items/_export?where=id:gte:2&fields=id,title", "", "")
+	if status != http.StatusOK || body != `{"id":2,"title":"memcache"}`+"\n" {
+		t.Errorf("ndjson export: got %d %q", status, body)
+	}
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:   "/items/_export",
+			Query:  "format=xml",
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error": "unknown format xml",
+			},
+		},
+	})
+
+	status, _, body = rawRequest(t, "POST", ts.URL+"/items/_import?batch=1", "text/csv",
+		"title,description,updated\n"+
+			"csv one,first,\n"+
+			"\"csv, two\",\"second \"\"quoted\"\"\",someone\n"+
+			"too,few\n")
+	expectedImport := `{"response":{"aborted":false,"errors":[{"line":4,"error":"invalid csv"}],"failed":1,"inserted":2}}`
+	if status != http.StatusOK || body != expectedImport {
+		t.Errorf("csv import: got %d %s", status, body)
+	}
+
+	status, _, body = rawRequest(t, "POST", ts.URL+"/items/_import", "",
+		`{"title": "ndjson", "description": "third"}`+"\n"+
+			"\n"+
+			`{"title": 5, "description": "bad type"}`+"\n"+
+			`{"description": "no title"}`+"\n"+
+			`{"title": `+"\n")
+	expectedImport = `{"response":{"aborted":false,"errors":[` +
+		`{"line":3,"error":"field title have invalid type"},` +
+		`{"line":4,"error":"field title is not nullable"},` +
+		`{"line":5,"error":"invalid json"}],"failed":3,"inserted":1}}`
+	if status != http.StatusOK || body != expectedImport {
+		t.Errorf("ndjson import: got %d %s", status, body)
+	}
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:  "/items",
+			Query: "where=id:gt:2&fields=id,title,description,updated",
+			Result: CR{
+				"response": CR{
+					"records": []CR{
+						CR{"id": 3, "title": "csv one", "description": "first", "updated": nil},
+						CR{"id": 4, "title": "csv, two", "description": `second "quoted"`, "updated": "someone"},
+						CR{"id": 5, "title": "ndjson", "description": "third", "updated": nil},
+					},
+				},
+			},
+		},
+	})
+
+	// столбцы, которых нет в таблице, не пропускаются молча
+	status, _, body = rawRequest(t, "POST", ts.URL+"/items/_import", "text/csv",
+		"title,description,color\n"+
+			"csv three,fourth,red\n")
+	expectedImport = `{"response":{"aborted":false,"errors":[` +
+		`{"line":2,"error":"unknown column color"}],"failed":1,"inserted":0}}`
+	if status != http.StatusOK || body != expectedImport {
+		t.Errorf("csv import with unknown column: got %d %s", status, body)
+	}
+	status, _, body = rawRequest(t, "POST", ts.URL+"/items/_import", "",
+		`{"title": "ndjson", "description": "fourth", "size": 1, "color": "red"}`+"\n")
+	expectedImport = `{"response":{"aborted":false,"errors":[` +
+		`{"line":1,"error":"unknown column color, size"}],"failed":1,"inserted":0}}`
+	if status != http.StatusOK || body != expectedImport {
+		t.Errorf("ndjson import with unknown column: got %d %s", status, body)
+	}
+
+	// ошибка базы откатывает только текущую пачку
+	defer prepareQueries(db, []string{`DROP TABLE IF EXISTS tags;`})
+	prepareQueries(db, []string{
+		`CREATE TABLE tags (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name varchar(255) NOT NULL UNIQUE
+);`,
+	})
+	if status, _, body := rawRequest(t, "POST", ts.URL+"/_reload", "", ""); status != http.StatusOK {
+		t.Fatalf("reload: got %d %s", status, body)
+	}
+
+	status, _, body = rawRequest(t, "POST", ts.URL+"/tags/_import?batch=2", "",
+		`{"name": "a"}`+"\n"+
+			`{"name": "b"}`+"\n"+
+			`{"name": "c"}`+"\n"+
+			`{"name": "a"}`+"\n")
+	expectedImport = `{"response":{"aborted":true,"errors":[` +
+		`{"line":4,"error":"insert failed, batch rolled back"}],"failed":2,"inserted":2}}`
+	if status != http.StatusOK || body != expectedImport {
+		t.Errorf("aborted import: got %d %s", status, body)
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM tags").Scan(&count); err != nil || count != 2 {
+		t.Errorf("expected 2 tags after rollback, got %d (%v)", count, err)
+	}
+}
+
+func TestETags(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+
+	conditional := func(method, path, header, value string, body string) (int, http.Header) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set(header, value)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("[%s %s] request error: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header
+	}
+
+	status, header, _ := rawRequest(t, "GET", ts.URL+"/items/1", "", "")
+	etag := header.Get("ETag")
+	if status != http.StatusOK || len(etag) != 34 || etag[0] != '"' {
+		t.Fatalf("expected ETag on record, got %d %q", status, etag)
+	}
+
+	if status, _ := conditional("GET", "/items/1", "If-None-Match", etag, ""); status != http.StatusNotModified {
+		t.Errorf("If-None-Match with current etag: got %d", status)
+	}
+	if status, _ := conditional("GET", "/items/1", "If-None-Match", `"x", W/`+etag, ""); status != http.StatusNotModified {
+		t.Errorf("If-None-Match with weak etag in list: got %d", status)
+	}
+	if status, _ := conditional("GET", "/items/2", "If-None-Match", etag, ""); status != http.StatusOK {
+		t.Errorf("If-None-Match with other record etag: got %d", status)
+	}
+
+	status, header = conditional("POST", "/items/1", "If-Match", etag, `{"title": "new title"}`)
+	newETag := header.Get("ETag")
+	if status != http.StatusOK || newETag == "" || newETag == etag {
+		t.Fatalf("update with If-Match: got %d, etag %q", status, newETag)
+	}
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Method:  http.MethodPost,
+			Path:    "/items/1",
+			Headers: map[string]string{"If-Match": etag},
+			Body:    CR{"title": "lost update"},
+			Status:  http.StatusPreconditionFailed,
+			Result:  CR{"error": "record was modified"},
+		},
+		Case{
+			Method:  http.MethodDelete,
+			Path:    "/items/1",
+			Headers: map[string]string{"If-Match": etag},
+			Status:  http.StatusPreconditionFailed,
+			Result:  CR{"error": "record was modified"},
+		},
+		Case{
+			Method:  http.MethodDelete,
+			Path:    "/items/100500",
+			Headers: map[string]string{"If-Match": "*"},
+			Status:  http.StatusPreconditionFailed,
+			Result:  CR{"error": "record was modified"},
+		},
+		Case{
+			Path: "/items/1",
+			Result: CR{
+				"response": CR{
+					"record": CR{
+						"id":          1,
+						"title":       "new title",
+						"description": "Рассказать про базы данных",
+						"updated":     "rvasily",
+					},
+				},
+			},
+		},
+		Case{
+			Method:  http.MethodDelete,
+			Path:    "/items/1",
+			Headers: map[string]string{"If-Match": newETag},
+			Result:  CR{"response": CR{"deleted": 1}},
+		},
+	})
+
+	// версия - HMAC с ключом сервера: с тем же ключом она та же, с другим другая
+	etags := make([]string, 0, 3)
+	for _, secret := range []string{"a", "a", "b"} {
+		handler, err := NewDbExplorer(db)
+		if err != nil {
+			panic(err)
+		}
+		handler.Secret = []byte(secret)
+		server := httptest.NewServer(handler)
+		_, header, _ := rawRequest(t, "GET", server.URL+"/items/2", "", "")
+		server.Close()
+		etags = append(etags, header.Get("ETag"))
+	}
+	if etags[0] == "" || etags[0] != etags[1] || etags[0] == etags[2] {
+		t.Errorf("expected etag to depend on Secret only, got %q", etags)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	db := OpenTestDB()
+	PrepareTestApis(db)
+	defer CleanupTestApis(db)
+	defer db.Exec("DROP TABLE IF EXISTS audit_log")
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	file, err := OpenAuditFile(dir + "/audit.jsonl")
+	if err != nil {
+		panic(err)
+	}
+	defer file.Close()
+
+	for _, sink := range []AuditSink{nil, file, &AuditTable{Name: "audit_log"}} {
+		handler, err := NewDbExplorer(db)
+		if err != nil {
+			panic(err)
+		}
+		handler.Auth = &AuthConfig{
+			APIKeys: map[string]*Identity{"key": &Identity{Subject: "alice", Role: "editor"}},
+			Roles: map[string]*RolePolicy{"editor": &RolePolicy{
+				Tables: map[string]*TablePolicy{
+					"*": &TablePolicy{Read: true, Write: true, Hidden: []string{"updated"}},
+				},
+			}},
+		}
+		ts := httptest.NewServer(handler)
+		headers := map[string]string{"X-API-Key": "key", "X-Request-ID": "audit-1"}
+
+		if sink == nil {
+			runCases(t, ts, db, []Case{
+				Case{
+					Path:    "/items/1/_history",
+					Headers: headers,
+					Status:  http.StatusNotFound,
+					Result:  CR{"error": "audit is disabled"},
+				},
+			})
+			ts.Close()
+			continue
+		}
+		if err := handler.EnableAudit(sink); err != nil {
+			t.Fatalf("enable audit: %v", err)
+		}
+
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/items/",
+			strings.NewReader(`{"title": "audit", "description": "d"}`))
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		created := CR{}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("create request error: %v", err)
+		}
+		json.NewDecoder(resp.Body).Decode(&created)
+		resp.Body.Close()
+		id := created["response"].(map[string]interface{})["id"].(float64)
+		path := fmt.Sprintf("/items/%v", id)
+
+		runCases(t, ts, db, []Case{
+			Case{
+				Method:  http.MethodPost,
+				Path:    path,
+				Headers: headers,
+				Body:    CR{"title": "changed"},
+				Result:  CR{"response": CR{"updated": 1}},
+			},
+			Case{
+				Method:  http.MethodPost,
+				Path:    "/_batch",
+				Headers: headers,
+				Body:    []CR{CR{"op": "delete", "table": "items", "id": id}},
+				Result:  CR{"response": CR{"results": []CR{CR{"deleted": 1}}}},
+			},
+			Case{
+				Path:    "/",
+				Headers: headers,
+				Result:  CR{"response": CR{"tables": []string{"items", "users"}}},
+			},
+			Case{
+				Path:    "/items/100500/_history",
+				Headers: headers,
+				Result:  CR{"response": CR{"history": []CR{}}},
+			},
+		})
+
+		req, _ = http.NewRequest(http.MethodGet, ts.URL+path+"/_history", nil)
+		req.Header.Set("X-API-Key", "key")
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatalf("history request error: %v", err)
+		}
+		result := struct {
+			Response struct {
+				History []*AuditEntry `json:"history"`
+			} `json:"response"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		ts.Close()
+
+		history := result.Response.History
+		if len(history) != 3 {
+			t.Fatalf("[%T] expected 3 history entries, got %d", sink, len(history))
+		}
+		inserted := CR{"id": id, "title": "audit", "description": "d"}
+		changed := CR{"id": id, "title": "changed", "description": "d"}
+		expected := []struct {
+			action        string
+			before, after map[string]interface{}
+		}{
+			{"create", nil, inserted},
+			{"update", inserted, changed},
+			{"delete", changed, nil},
+		}
+		for i, entry := range history {
+			if entry.Action != expected[i].action || entry.Key != fmt.Sprint(id) ||
+				entry.Table != "items" || entry.Subject != "alice" ||
+				entry.Role != "editor" || entry.RequestID != "audit-1" ||
+				entry.Time.IsZero() {
+				t.Errorf("[%T] entry %d: unexpected %+v", sink, i, entry)
+			}
+			if !reflect.DeepEqual(entry.Before, expected[i].before) ||
+				!reflect.DeepEqual(entry.After, expected[i].after) {
+				t.Errorf("[%T] entry %d: got before %v after %v", sink, i,
+					entry.Before, entry.After)
+			}
+		}
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+	defer db.Exec("DROP TABLE IF EXISTS notes")
+
+	prepareQueries(db, []string{
+		`CREATE TABLE notes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  body varchar(255) NOT NULL,
+  deleted_at datetime DEFAULT NULL
+);`,
+		`INSERT INTO notes (id, body) VALUES (1, 'first'), (2, 'second');`,
+	})
+	if status, _, body := rawRequest(t, "POST", ts.URL+"/_reload", "", ""); status != http.StatusOK {
+		t.Fatalf("reload: got %d %s", status, body)
+	}
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Method: http.MethodDelete,
+			Path:   "/notes/1",
+			Result: CR{"response": CR{"deleted": 1}},
+		},
+		Case{
+			// повторное удаление ничего не меняет
+			Method: http.MethodDelete,
+			Path:   "/notes/1",
+			Result: CR{"response": CR{"deleted": 0}},
+		},
+		Case{
+			Path:   "/notes/1",
+			Status: http.StatusNotFound,
+			Result: CR{"error": "record not found"},
+		},
+		Case{
+			Path: "/notes",
+			Result: CR{"response": CR{"records": []CR{
+				CR{"id": 2, "body": "second", "deleted_at": nil},
+			}}},
+		},
+		Case{
+			Path:   "/notes",
+			Query:  "include_deleted=1&fields=id",
+			Result: CR{"response": CR{"records": []CR{CR{"id": 1}, CR{"id": 2}}}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/notes/1",
+			Body:   CR{"body": "edited"},
+			Result: CR{"response": CR{"updated": 0}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/notes/1/_restore",
+			Result: CR{"response": CR{"restored": 1}},
+		},
+		Case{
+			Path: "/notes/1",
+			Result: CR{"response": CR{"record": CR{
+				"id": 1, "body": "first", "deleted_at": nil,
+			}}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/notes/1/_restore",
+			Result: CR{"response": CR{"restored": 0}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/items/1/_restore",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "table has no soft delete"},
+		},
+	})
+
+	var deletedAt sql.NullString
+	rawRequest(t, "DELETE", ts.URL+"/notes/2", "", "")
+	err := db.QueryRow("SELECT deleted_at FROM notes WHERE id = 2").Scan(&deletedAt)
+	if err != nil || !deletedAt.Valid {
+		t.Errorf("expected note 2 to stay with deleted_at set, got %v (%v)", deletedAt, err)
+	}
+
+	status, _, body := rawRequest(t, "GET", ts.URL+"/notes/2?include_deleted=1", "", "")
+	if status != http.StatusOK || !strings.Contains(body, `"deleted_at":"`) {
+		t.Errorf("include_deleted record: got %d %s", status, body)
+	}
+
+	// PUT на удалённую запись восстанавливает её
+	runCases(t, ts, db, []Case{
+		Case{
+			Method: http.MethodPut,
+			Path:   "/notes/2",
+			Body:   CR{"body": "again"},
+			Result: CR{"response": CR{"created": false}},
+		},
+		Case{
+			Path: "/notes/2",
+			Result: CR{"response": CR{"record": CR{
+				"id": 2, "body": "again", "deleted_at": nil,
+			}}},
+		},
+	})
+
+	// удалённая запись не раскрывается через expand без include_deleted=1
+	defer db.Exec("DROP TABLE IF EXISTS comments")
+	prepareQueries(db, []string{
+		`CREATE TABLE comments (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  note_id INTEGER NOT NULL,
+  FOREIGN KEY (note_id) REFERENCES notes (id)
+);`,
+		`INSERT INTO comments (id, note_id) VALUES (1, 1), (2, 2);`,
+		`UPDATE notes SET deleted_at = '2020-01-01 00:00:00' WHERE id = 1;`,
+	})
+	if status, _, body := rawRequest(t, "POST", ts.URL+"/_reload", "", ""); status != http.StatusOK {
+		t.Fatalf("reload: got %d %s", status, body)
+	}
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:  "/comments",
+			Query: "expand=note&fields=id,note_id",
+			Result: CR{"response": CR{"records": []CR{
+				CR{"id": 1, "note_id": 1, "note": nil},
+				CR{"id": 2, "note_id": 2, "note": CR{"id": 2, "body": "again", "deleted_at": nil}},
+			}}},
+		},
+		Case{
+			Path:  "/comments/1",
+			Query: "expand=note",
+			Result: CR{"response": CR{"record": CR{
+				"id": 1, "note_id": 1, "note": nil,
+			}}},
+		},
+		Case{
+			Path:  "/comments/1",
+			Query: "expand=note&include_deleted=1",
+			Result: CR{"response": CR{"record": CR{
+				"id": 1, "note_id": 1,
+				"note": CR{"id": 1, "body": "first", "deleted_at": "2020-01-01T00:00:00Z"},
+			}}},
+		},
+	})
+}
+
+// sseEvent одно событие из потока text/event-stream
+type sseEvent struct {
+	id, event, data string
+}
+
+// readEvent читает из потока следующее событие, комментарии пропускает
+func readEvent(t *testing.T, reader *bufio.Reader) sseEvent {
+	ev := sseEvent{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && ev.event != "":
+			return ev
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+
+	// поток живёт дольше таймаута общего клиента
+	stream := func(lastEventID string) (*bufio.Reader, func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/items/_changes", nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatalf("changes request error: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK ||
+			resp.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("changes: got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(resp.Body), func() {
+			cancel()
+			resp.Body.Close()
+		}
+	}
+
+	reader, stop := stream("")
+	rawRequest(t, "PUT", ts.URL+"/items/", "application/json",
+		`{"title": "new", "description": "d"}`)
+	rawRequest(t, "POST", ts.URL+"/items/1", "application/json", `{"title": "t"}`)
+	// ничего не изменилось - события нет
+	rawRequest(t, "POST", ts.URL+"/items/100500", "application/json", `{"title": "t"}`)
+	rawRequest(t, "POST", ts.URL+"/_batch", "application/json",
+		`[{"op": "delete", "table": "items", "id": 2}]`)
+	rawRequest(t, "DELETE", ts.URL+"/users/1", "", "")
+
+	expected := []struct{ id, event, key string }{
+		{"1", "created", "3"},
+		{"2", "updated", "1"},
+		{"3", "deleted", "2"},
+	}
+	for _, want := range expected {
+		ev := readEvent(t, reader)
+		got := &ChangeEvent{}
+		json.Unmarshal([]byte(ev.data), got)
+		if ev.id != want.id || ev.event != want.event || got.Type != want.event ||
+			got.Table != "items" || got.Key != want.key || got.Time.IsZero() {
+			t.Errorf("expected %v, got %v", want, ev)
+		}
+	}
+	stop()
+
+	// переподключение досылает пропущенное
+	reader, stop = stream("1")
+	for _, want := range []string{"2", "3"} {
+		if ev := readEvent(t, reader); ev.id != want {
+			t.Errorf("resume: expected event %s, got %v", want, ev)
+		}
+	}
+	stop()
+
+	// идентификаторы из прошлой жизни сервера
+	reader, stop = stream("100500")
+	if ev := readEvent(t, reader); ev.event != "reset" || ev.id != "" {
+		t.Errorf("expected reset event, got %v", ev)
+	}
+	stop()
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:    "/items/_changes",
+			Headers: map[string]string{"Last-Event-ID": "abc"},
+			Status:  http.StatusBadRequest,
+			Result:  CR{"error": "invalid Last-Event-ID"},
+		},
+		Case{
+			Path:   "/unknown_table/_changes",
+			Status: http.StatusNotFound,
+			Result: CR{"error": "unknown table"},
+		},
+	})
+}
+
+func TestQuery(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_query",
+			Body: CR{
+				"sql": "SELECT i.id, i.title, u.login AS author FROM items i " +
+					"JOIN users u ON u.user_id = i.id WHERE i.id = ?",
+				"args": []interface{}{1},
+			},
+			Result: CR{"response": CR{
+				"columns": []string{"id", "title", "author"},
+				"records": []CR{
+					CR{"id": 1, "title": "database/sql", "author": "rvasily"},
+				},
+				"truncated": false,
+			}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_query",
+			Body:   CR{"sql": "SELECT id FROM items ORDER BY id -- first page;", "limit": 1},
+			Result: CR{"response": CR{
+				"columns":   []string{"id"},
+				"records":   []CR{CR{"id": 1}},
+				"truncated": true,
+			}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_query",
+			Body:   CR{"sql": "SELECT 'a; DELETE FROM items' AS s"},
+			Result: CR{"response": CR{
+				"columns":   []string{"s"},
+				"records":   []CR{CR{"s": "a; DELETE FROM items"}},
+				"truncated": false,
+			}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_query",
+			Body:   CR{"sql": "SELECT 1; DELETE FROM items"},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "only one statement is allowed"},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_query",
+			Body:   CR{"sql": "UPDATE items SET title = 'x'"},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "only SELECT queries are allowed"},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_query",
+			Body:   CR{"sql": "WITH d AS (DELETE FROM items RETURNING *) SELECT * FROM d"},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "forbidden keyword DELETE"},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_query",
+			Body:   CR{"sql": "SELECT i.id, u.user_id AS id FROM items i, users u"},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "duplicate column id, use AS"},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_query",
+			Body:   CR{"sql": "   "},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "empty query"},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_query",
+			Body:   CR{"sql": "SELECT 1 AS [a']; DELETE FROM items; SELECT 1 AS [']"},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "only one statement is allowed"},
+		},
+	})
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM items").Scan(&count); err != nil || count == 0 {
+		t.Errorf("items must stay untouched, got %d (%v)", count, err)
+	}
+
+	mysql, postgres, sqlite := MySQLDialect{}, PostgresDialect{}, SQLiteDialect{}
+	checks := []struct {
+		sql     string
+		dialect Dialect
+		err     string
+	}{
+		{"SELECT * FROM items FOR UPDATE", sqlite, "forbidden keyword UPDATE"},
+		{"SELECT * FROM items FOR SHARE", postgres, "forbidden keyword SHARE"},
+		{"SELECT * INTO OUTFILE '/tmp/x' FROM items", mysql, "forbidden keyword INTO"},
+		{"SELECT SLEEP(100)", mysql, "forbidden keyword SLEEP"},
+		{"SELECT GET_LOCK('x', 10)", mysql, "forbidden keyword GET_LOCK"},
+		{"SELECT pg_advisory_lock(1)", postgres, "forbidden keyword PG_ADVISORY_LOCK"},
+		{"SELECT pg_try_advisory_xact_lock(1)", postgres, "forbidden keyword PG_TRY_ADVISORY_XACT_LOCK"},
+		{"SELECT load_extension('x')", sqlite, "forbidden keyword LOAD_EXTENSION"},
+		{"SELECT 1 /*! ; DROP TABLE items */", mysql, "executable comments are not allowed"},
+		{"SELECT 1 # ; DROP TABLE items", mysql, ""},
+		{"SELECT 1 # ; DROP TABLE items", sqlite, "only one statement is allowed"},
+		{"SELECT 1;", sqlite, ""},
+		{"SELECT 1; -- DROP TABLE items", sqlite, "only one statement is allowed"},
+		{`SELECT 'a\'; DROP TABLE items; SELECT ''`, sqlite, "only one statement is allowed"},
+		{`SELECT 'a\'; DROP TABLE items; SELECT 1'`, mysql, ""},
+		{"SELECT $$; DROP$$, $1", postgres, ""},
+		{"SELECT $$; DROP$$, $1", sqlite, "only one statement is allowed"},
+		{"SELECT `update` FROM items", mysql, ""},
+		{"SELECT [update] FROM items", sqlite, ""},
+		{"SELECT 'unterminated", sqlite, "unterminated quote"},
+		//обходы через кавычки, которых в диалекте нет или которые он понимает иначе
+		{"SELECT 1 AS $t$ FROM items INTO OUTFILE '/tmp/x' -- $t$", mysql, "forbidden keyword INTO"},
+		{"SELECT 1 AS $t$ FROM items FOR UPDATE -- $t$", mysql, "forbidden keyword UPDATE"},
+		{"SELECT 1 AS [a']; DELETE FROM items; SELECT 1 AS [']", sqlite, "only one statement is allowed"},
+		{"SELECT 1 AS `a\\`; DELETE FROM items; SELECT 1 AS `", mysql, "only one statement is allowed"},
+		{"SELECT 1 --'\n, '; DELETE FROM items; -- '", mysql, "only one statement is allowed"},
+		{`SELECT E'\'' ; DELETE FROM items; --'`, postgres, "only one statement is allowed"},
+		{"SELECT /* /* */ 'x */ ; DELETE FROM items; --'", postgres, "only one statement is allowed"},
+		{"SELECT 1 AS a$b$, 1; DELETE FROM items; SELECT $b$", postgres, "only one statement is allowed"},
+	}
+	for _, check := range checks {
+		err := checkReadOnly(check.sql, check.dialect)
+		if (err == nil && check.err != "") || (err != nil && err.Error() != check.err) {
+			t.Errorf("[%s] %s: expected %q, got %v", check.dialect.Name(), check.sql, check.err, err)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:  "/items/_aggregate",
+			Query: "group_by=updated&count=*&sum=id&avg=id&max=title",
+			Result: CR{"response": CR{"records": []CR{
+				CR{"updated": nil, "count": 1, "sum_id": 2, "avg_id": 2, "max_title": "memcache"},
+				CR{"updated": "rvasily", "count": 1, "sum_id": 1, "avg_id": 1, "max_title": "database/sql"},
+			}}},
+		},
+		Case{
+			Path:   "/items/_aggregate",
+			Query:  "count=*,updated&min=id&where=id:gte:1",
+			Result: CR{"response": CR{"records": []CR{CR{"count": 2, "count_updated": 1, "min_id": 1}}}},
+		},
+		Case{
+			Path:   "/items/_aggregate",
+			Query:  "count=*&where=title:eq:nothing",
+			Result: CR{"response": CR{"records": []CR{CR{"count": 0}}}},
+		},
+		Case{
+			Path:   "/items/_aggregate",
+			Query:  "group_by=updated&count=*&limit=1",
+			Result: CR{"response": CR{"records": []CR{CR{"updated": nil, "count": 1}}}},
+		},
+		Case{
+			Path:   "/items/_aggregate",
+			Query:  "sum=title",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "column title is not numeric"},
+		},
+		Case{
+			Path:   "/items/_aggregate",
+			Query:  "group_by=nope&count=*",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "unknown column nope"},
+		},
+		Case{
+			Path:   "/items/_aggregate",
+			Query:  "group_by=updated",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "nothing to aggregate"},
+		},
+		Case{
+			Path:   "/items/_aggregate",
+			Query:  "count=*&where=id:bad:1",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "unknown operator bad"},
+		},
+		Case{
+			Path:   "/items/_aggregate",
+			Query:  "count=*&count=*",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "duplicate column count"},
+		},
+	})
+
+	// агрегат не должен затирать столбец группировки с тем же именем
+	columns := []*Column{
+		&Column{Field: "count", Type: "int"},
+		&Column{Field: "sum_price", Type: "int"},
+		&Column{Field: "price", Type: "int"},
+	}
+	for query, want := range map[string]string{
+		"group_by=count&count=*":       "duplicate column count",
+		"group_by=sum_price&sum=price": "duplicate column sum_price",
+		"group_by=count&sum=price":     "",
+	} {
+		values, _ := url.ParseQuery(query)
+		_, _, err := parseAggregates(columns, values)
+		if (err == nil && want != "") || (err != nil && err.Error() != want) {
+			t.Errorf("%s: expected %q, got %v", query, want, err)
+		}
+	}
+}
+
+func runCases(t *testing.T, ts *httptest.Server, db *sql.DB, cases []Case) {
+	for idx, item := range cases {
+		var (
+			err      error
+			result   interface{}
+			expected interface{}
+			req      *http.Request
+		)
+
+		caseName := fmt.Sprintf("case %d: [%s] %s %s", idx, item.Method, item.Path, item.Query)
+
+		// если у вас случилась это ошибка - значит вы не делаете где-то rows.Close и у вас текут соединения с базой
+		// если такое случилось на первом тесте - значит вы не закрываете коннект где-то при иницаилизации в NewDbExplorer
+		if db.Stats().OpenConnections != 1 {
+			t.Fatalf("[%s] you have %d open connections, must be 1", caseName, db.Stats().OpenConnections)
+		}
+
+		if item.Method == "" || item.Method == http.MethodGet {
+			req, err = http.NewRequest(item.Method, ts.URL+item.Path+"?"+item.Query, nil)
+		} else {
+			data, err := json.Marshal(item.Body)
+			if err != nil {
+				panic(err)
+			}
+			reqBody := bytes.NewReader(data)
+			req, err = http.NewRequest(item.Method, ts.URL+item.Path, reqBody)
+			req.Header.Add("Content-Type", "application/json")
+		}
+		for key, value := range item.Headers {
+			req.Header.Set(key, value)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("[%s] request error: %v", caseName, err)
+			continue
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+
+		// fmt.Printf("[%s] body: %s\n", caseName, string(body))
+		if item.Status == 0 {
+			item.Status = http.StatusOK
+		}
+
+		if resp.StatusCode != item.Status {
+			t.Fatalf("[%s] expected http status %v, got %v", caseName, item.Status, resp.StatusCode)
+			continue
+		}
+
+		err = json.Unmarshal(body, &result)
+		if err != nil {
+			t.Fatalf("[%s] cant unpack json: %v", caseName, err)
+			continue
+		}
+
+		// reflect.DeepEqual не работает если нам приходят разные типы
+		// а там приходят разные типы (string VS interface{}) по сравнению с тем что в ожидаемом результате
+		// этот маленький грязный хак конвертит данные сначала в json, а потом обратно в interface - получаем совместимые результаты
+		// не используйте это в продакшен-коде - надо явно писать что ожидается интерфейс или использовать другой подход с точным форматом ответа
+		data, err := json.Marshal(item.Result)
+		json.Unmarshal(data, &expected)
+
+		// код ошибки однозначно следует из статуса, в кейсах его не дублируем
+		if exp, ok := expected.(map[string]interface{}); ok {
+			if _, isErr := exp["error"]; isErr {
+				if _, hasCode := exp["code"]; !hasCode {
+					exp["code"] = APIError{HTTPStatus: item.Status}.Code()
+				}
+			}
+		}
+
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("[%s] results not match\nGot : %#v\nWant: %#v", caseName, result, expected)
+			continue
+		}
+	}
+
+}
+
+func TestUI(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+
+	noRedirect := &http.Client{
+		Timeout: time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	submit := func(path string, form url.Values) (int, string) {
+		resp, err := noRedirect.PostForm(ts.URL+path, form)
+		if err != nil {
+			t.Fatalf("[POST %s] request error: %v", path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Location") + string(data)
+	}
+	page := func(path string, status int, contains ...string) string {
+		code, header, body := rawRequest(t, http.MethodGet, ts.URL+path, "", "")
+		if code != status {
+			t.Fatalf("[GET %s] expected status %d, got %d: %s", path, status, code, body)
+		}
+		if status == http.StatusOK && !strings.HasPrefix(header.Get("Content-Type"), "text/html") {
+			t.Errorf("[GET %s] unexpected content type %s", path, header.Get("Content-Type"))
+		}
+		for _, s := range contains {
+			if !strings.Contains(body, s) {
+				t.Errorf("[GET %s] expected %q in page:\n%s", path, s, body)
+			}
+		}
+		return body
+	}
+	hidden := func(body string, name string) string {
+		m := regexp.MustCompile(`name="` + name + `" value="([^"]*)"`).FindStringSubmatch(body)
+		if m == nil {
+			t.Fatalf("no %s in form:\n%s", name, body)
+		}
+		return html.UnescapeString(m[1])
+	}
+
+	page("/_ui/", http.StatusOK, `href="/_ui/items"`, `href="/_ui/users"`)
+	page("/_ui/items", http.StatusOK, "database/sql", "memcache",
+		`href="/_ui/items/1"`, "1-2 of 2", `href="/_ui/items?order=id"`)
+	body := page("/_ui/items?where_column=id&where_op=eq&where_value=2",
+		http.StatusOK, "memcache", "1-1 of 1")
+	if strings.Contains(body, "database/sql") {
+		t.Errorf("filter was not applied:\n%s", body)
+	}
+	page("/_ui/items?order=-id", http.StatusOK, "&#9660;")
+	page("/_ui/items?where_column=id&where_op=eq&where_value=x",
+		http.StatusBadRequest, "field id have invalid type")
+	page("/_ui/nope", http.StatusNotFound)
+
+	//форма строится по метаданным столбцов
+	page("/_ui/items/_new", http.StatusOK,
+		`<input type="text" id="f_title" name="title" value="" maxlength="255" required>`,
+		`<textarea id="f_description" name="description" required>`,
+		`name="updated" value="" maxlength="255">`)
+	body = page("/_ui/items/_new", http.StatusOK)
+	if strings.Contains(body, `name="id"`) {
+		t.Errorf("autoincrement key in create form:\n%s", body)
+	}
+	body = page("/_ui/items/1", http.StatusOK, `name="id" value="1" step="1" readonly`,
+		`value="database/sql"`, "/_ui/items/1/_delete")
+	token := hidden(body, "csrf_token")
+
+	//формы без CSRF-токена не принимаются
+	status, body := submit("/_ui/items/_new", url.Values{"title": {"ui"}})
+	if status != http.StatusForbidden || !strings.Contains(body, "invalid csrf token") {
+		t.Errorf("create without csrf: unexpected response %d %s", status, body)
+	}
+	status, body = submit("/_ui/items/1/_delete", url.Values{"csrf_token": {"x"}})
+	if status != http.StatusForbidden {
+		t.Errorf("delete without csrf: unexpected response %d %s", status, body)
+	}
+
+	status, body = submit("/_ui/items/_new", url.Values{
+		"csrf_token":  {token},
+		"title":       {"ui"},
+		"description": {"из формы"},
+		"updated":     {""},
+	})
+	if status != http.StatusSeeOther || body != "/_ui/items" {
+		t.Fatalf("create: unexpected response %d %s", status, body)
+	}
+	var updated interface{}
+	var description string
+	db.QueryRow(`SELECT description, updated FROM items WHERE title = 'ui'`).
+		Scan(&description, &updated)
+	if description != "из формы" || updated != nil {
+		t.Errorf("create: unexpected record %q %v", description, updated)
+	}
+
+	//форма отправляет версию, которую показала, и не затирает чужие изменения
+	etag := hidden(page("/_ui/items/3", http.StatusOK), "etag")
+	db.Exec(`UPDATE items SET updated = 'other' WHERE id = 3`)
+	status, body = submit("/_ui/items/3", url.Values{
+		"csrf_token":  {token},
+		"etag":        {etag},
+		"title":       {"ui edited"},
+		"description": {"из формы"},
+	})
+	if status != http.StatusPreconditionFailed || !strings.Contains(body, "record was modified") {
+		t.Errorf("stale update: unexpected response %d %s", status, body)
+	}
+
+	etag = hidden(page("/_ui/items/3", http.StatusOK, `value="other"`), "etag")
+	status, body = submit("/_ui/items/3", url.Values{
+		"csrf_token":  {token},
+		"etag":        {etag},
+		"id":          {"100"},
+		"title":       {"ui edited"},
+		"description": {"из формы"},
+		"updated":     {"admin"},
+	})
+	if status != http.StatusSeeOther {
+		t.Fatalf("update: unexpected response %d %s", status, body)
+	}
+	page("/_ui/items/3", http.StatusOK, `value="ui edited"`, `value="admin"`)
+
+	//ошибка API показывается на форме вместе с введёнными значениями
+	status, body = submit("/_ui/users/1", url.Values{
+		"csrf_token": {token},
+		"login":      {strings.Repeat("x", 256)}, "password": {"x"}, "email": {"e"}, "info": {"i"},
+	})
+	if status != http.StatusBadRequest || !strings.Contains(body, "field login is too long") ||
+		!strings.Contains(body, `name="password" value="x"`) {
+		t.Errorf("update error: unexpected response %d %s", status, body)
+	}
+
+	status, body = submit("/_ui/items/3/_delete", url.Values{"csrf_token": {token}})
+	if status != http.StatusSeeOther {
+		t.Fatalf("delete: unexpected response %d %s", status, body)
+	}
+	page("/_ui/items/3", http.StatusNotFound)
+
+	//страницы админки не попадают в описание API
+	_, _, body = rawRequest(t, http.MethodGet, ts.URL+"/_openapi.json", "", "")
+	if strings.Contains(body, "/_ui") {
+		t.Errorf("ui routes in openapi document")
+	}
+}
+
+func TestUIAuth(t *testing.T) {
+	db := OpenTestDB()
+	PrepareTestApis(db)
+	defer CleanupTestApis(db)
+
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		t.Fatalf("cant create handler: %v", err)
+	}
+	err = handler.ApplyConfig(&Config{Tables: map[string]*TableConfig{
+		"users": &TableConfig{Columns: map[string]*ColumnConfig{
+			"password": &ColumnConfig{Access: accessWriteOnly},
+		}},
+	}})
+	if err != nil {
+		t.Fatalf("cant apply config: %v", err)
+	}
+	handler.Auth = &AuthConfig{
+		APIKeys: map[string]*Identity{"key": &Identity{Subject: "alice", Role: "editor"}},
+		Roles: map[string]*RolePolicy{"editor": &RolePolicy{
+			Tables: map[string]*TablePolicy{"*": &TablePolicy{Read: true, Write: true}},
+		}},
+	}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	do := func(method string, path string, form url.Values, password string) (int, http.Header, string) {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(form.Encode()))
+		if form != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if password != "" {
+			req.SetBasicAuth("admin", password)
+		}
+		resp, err := (&http.Transport{}).RoundTrip(req)
+		if err != nil {
+			t.Fatalf("[%s %s] request error: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header, string(data)
+	}
+
+	//браузер спрашивает пароль сам, API-ключ вводится паролем
+	status, header, _ := do(http.MethodGet, "/_ui/", nil, "")
+	if status != http.StatusUnauthorized || header.Get("WWW-Authenticate") != uiRealm {
+		t.Errorf("ui without credentials: unexpected response %d %v", status, header)
+	}
+	if status, _, _ = do(http.MethodGet, "/_ui/", nil, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("ui with wrong key: unexpected status %d", status)
+	}
+	if status, _, body := do(http.MethodGet, "/_ui/", nil, "key"); status != http.StatusOK {
+		t.Errorf("ui with key: unexpected response %d %s", status, body)
+	}
+	handler.Auth.TokenSecret = "secret"
+	token := SignToken("secret", &Identity{Subject: "bob", Role: "editor"})
+	if status, _, body := do(http.MethodGet, "/_ui/", nil, token); status != http.StatusOK {
+		t.Errorf("ui with token: unexpected response %d %s", status, body)
+	}
+	//в API Basic не принимается
+	status, header, _ = do(http.MethodGet, "/items", nil, "key")
+	if status != http.StatusUnauthorized || header.Get("WWW-Authenticate") != "" {
+		t.Errorf("api with basic: unexpected response %d %v", status, header)
+	}
+
+	//столбец только для записи есть в форме, но без значения
+	status, _, body := do(http.MethodGet, "/_ui/users/_new", nil, "key")
+	if status != http.StatusOK ||
+		!strings.Contains(body, `<input type="password" id="f_password" name="password" value="" maxlength="255" required>`) {
+		t.Fatalf("create form: unexpected response %d %s", status, body)
+	}
+	m := regexp.MustCompile(`name="csrf_token" value="([^"]*)"`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("no csrf token in form:\n%s", body)
+	}
+	csrf := m[1]
+	//токен привязан к тому, кто вошёл
+	status, _, _ = do(http.MethodPost, "/_ui/users/_new", url.Values{
+		"csrf_token": {csrf}, "login": {"x"}, "password": {"x"}, "email": {"x"}, "info": {"x"},
+	}, token)
+	if status != http.StatusForbidden {
+		t.Errorf("create with other user's csrf token: unexpected status %d", status)
+	}
+
+	status, _, body = do(http.MethodPost, "/_ui/users/_new", url.Values{
+		"csrf_token": {csrf}, "login": {"ui"}, "password": {"secret"}, "email": {"e"}, "info": {"i"},
+	}, "key")
+	if status != http.StatusSeeOther {
+		t.Fatalf("create: unexpected response %d %s", status, body)
+	}
+	var id int
+	var password string
+	db.QueryRow(`SELECT user_id, password FROM users WHERE login = 'ui'`).Scan(&id, &password)
+	if password != "secret" {
+		t.Errorf("create: unexpected password %q", password)
+	}
+
+	//пустое поле только для записи при редактировании значение не меняет
+	path := fmt.Sprintf("/_ui/users/%d", id)
+	status, _, body = do(http.MethodGet, path, nil, "key")
+	if status != http.StatusOK || strings.Contains(body, "secret") ||
+		strings.Contains(body, `name="password" value="" maxlength="255" required`) {
+		t.Errorf("edit form: unexpected response %d %s", status, body)
+	}
+	status, _, body = do(http.MethodPost, path, url.Values{
+		"csrf_token": {csrf}, "login": {"ui2"}, "password": {""}, "email": {"e"}, "info": {"i"},
+	}, "key")
+	if status != http.StatusSeeOther {
+		t.Fatalf("update: unexpected response %d %s", status, body)
+	}
+	db.QueryRow(`SELECT password FROM users WHERE user_id = ?`, id).Scan(&password)
+	if password != "secret" {
+		t.Errorf("update: password changed to %q", password)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+
+	gql := func(query string, variables CR) CR {
+		return CR{"query": query, "variables": variables}
+	}
+	badRequest := func(messages ...string) CR {
+		errs := make([]CR, 0, len(messages))
+		for _, message := range messages {
+			errs = append(errs, CR{"message": message, "extensions": CR{"code": "bad_request"}})
+		}
+		return CR{"errors": errs}
+	}
+	// каждый фрагмент раскрывает следующий дважды: 2^n полей id
+	fragments := func(n int) string {
+		res := ""
+		for i := 0; i < n; i++ {
+			res += fmt.Sprintf("\nfragment F%d on Items { ...F%d ...F%d }", i, i+1, i+1)
+		}
+		return res + fmt.Sprintf("\nfragment F%d on Items { id }", n)
+	}
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body: gql(`{
+  items(filter: {id: {gte: 1}}, order: ["-id"], limit: 1) { id title __typename }
+}`, nil),
+			Result: CR{"data": CR{"items": []CR{
+				CR{"id": 2, "title": "memcache", "__typename": "Items"},
+			}}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body: gql(`query Item($id: ID!, $full: Boolean = false) {
+  first: items_by_id(id: $id) { ...Short description @include(if: $full) }
+  missing: items_by_id(id: 100) { id }
+  users(filter: {login: {like: "rv%"}}) { user_id, login }
+}
+fragment Short on Items { title updated }`, CR{"id": 1}),
+			Result: CR{"data": CR{
+				"first":   CR{"title": "database/sql", "updated": "rvasily"},
+				"missing": nil,
+				"users":   []CR{CR{"user_id": 1, "login": "rvasily"}},
+			}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   gql(`{ items(filter: {updated: {is_null: true}}) { id ... on Items { title } } }`, nil),
+			Result: CR{"data": CR{"items": []CR{CR{"id": 2, "title": "memcache"}}}},
+		},
+		// мутации выполняются по порядку, каждая через те же проверки, что и REST
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body: gql(`mutation {
+  created: create_items(input: {title: "graphql", description: "из мутации"}) { id title updated }
+  updated: update_items(id: 3, input: {updated: "gql"}) { id updated }
+  invalid: update_items(id: 3, input: {title: 1}) { id }
+  deleted: delete_items(id: 3)
+  again: delete_items(id: 3)
+}`, nil),
+			Result: CR{
+				"data": CR{
+					"created": CR{"id": 3, "title": "graphql", "updated": nil},
+					"updated": CR{"id": 3, "updated": "gql"},
+					"invalid": nil,
+					"deleted": 1,
+					"again":   0,
+				},
+				"errors": []CR{CR{
+					"message":    "field title have invalid type",
+					"path":       []string{"invalid"},
+					"extensions": CR{"code": "bad_request"},
+				}},
+			},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   gql(`{ items(filter: {id: {eq: "x"}}) { id } users { login } }`, nil),
+			Result: CR{
+				"data": CR{"items": nil, "users": []CR{CR{"login": "rvasily"}}},
+				"errors": []CR{CR{
+					"message":    "field id have invalid type",
+					"path":       []string{"items"},
+					"extensions": CR{"code": "bad_request"},
+				}},
+			},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   gql(`mutation { create_items(input: {title: "x", nope: 1}) { id } }`, nil),
+			Result: CR{
+				"data": CR{"create_items": nil},
+				"errors": []CR{CR{
+					"message":    "unknown column nope",
+					"path":       []string{"create_items"},
+					"extensions": CR{"code": "bad_request"},
+				}},
+			},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   gql(`{ items { id nope } items_by_id { title { x } } __schema { types } }`, nil),
+			Status: http.StatusBadRequest,
+			Result: badRequest(
+				"unknown field nope on type Items",
+				"argument id of field Query.items_by_id is required",
+				"field Items.title has no subfields",
+				"introspection is not supported, schema is available at GET /_graphql",
+			),
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   gql(`query ($id: ID!) { items_by_id(id: $id) { id } }`, nil),
+			Status: http.StatusBadRequest,
+			Result: badRequest("variable $id of type ID! is required"),
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   gql(`{ items(limit: $n) { ...Missing } }`, nil),
+			Status: http.StatusBadRequest,
+			Result: badRequest("variable $n is not defined", "unknown fragment Missing"),
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   gql("{\n  items(limit: 1 { id }\n}", nil),
+			Status: http.StatusBadRequest,
+			Result: badRequest(`syntax error at 2:18: unexpected "{"`),
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   CR{"query": "query A { items { id } } query B { users { login } }"},
+			Status: http.StatusBadRequest,
+			Result: badRequest("operationName is required"),
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   gql("{ items(limit: 1) { ...F0 } }"+fragments(12), nil),
+			Result: CR{"data": CR{"items": []CR{CR{"id": 1}}}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   gql("{ items { ...F0 } }"+fragments(40), nil),
+			Status: http.StatusBadRequest,
+			Result: badRequest("query has more than 10000 fields"),
+		},
+	})
+
+	_, _, sdl := rawRequest(t, http.MethodGet, ts.URL+"/_graphql", "", "")
+	for _, part := range []string{
+		"\ntype Items {\n  id: BigInt!\n  title: String!\n  description: String!\n  updated: String\n}\n",
+		"\ninput ItemsInput {\n  id: BigInt\n",
+		"  items(filter: ItemsFilter, order: [String!], limit: Int, offset: Int, include_deleted: Boolean): [Items!]\n",
+		"  items_by_id(id: ID!, include_deleted: Boolean): Items\n",
+		"  update_users(id: ID!, input: UsersInput!): Users\n",
+	} {
+		if !strings.Contains(sdl, part) {
+			t.Errorf("expected %q in schema:\n%s", part, sdl)
+		}
+	}
+
+	// связи по внешним ключам - поля с записью, на которую они ссылаются
+	prepareQueries(db, []string{
+		`CREATE TABLE authors (
+  id INTEGER NOT NULL PRIMARY KEY,
+  name varchar(255) NOT NULL
+);`,
+		`CREATE TABLE posts (
+  id INTEGER NOT NULL PRIMARY KEY,
+  author_id INTEGER DEFAULT NULL,
+  title varchar(255) NOT NULL,
+  FOREIGN KEY (author_id) REFERENCES authors (id)
+);`,
+		`INSERT INTO authors (id, name) VALUES (1, 'rvasily');`,
+		`INSERT INTO posts (id, author_id, title) VALUES (1, 1, 'database/sql'), (2, NULL, 'draft');`,
+	})
+	defer prepareQueries(db, []string{
+		`DROP TABLE IF EXISTS posts;`,
+		`DROP TABLE IF EXISTS authors;`,
+	})
+	rawRequest(t, http.MethodPost, ts.URL+"/_reload", "", "")
+	runCases(t, ts, db, []Case{
+		Case{
+			Method: http.MethodPost,
+			Path:   "/_graphql",
+			Body:   gql(`{ posts(order: ["id"]) { title author { name } writer: author { id } } }`, nil),
+			Result: CR{"data": CR{"posts": []CR{
+				CR{"title": "database/sql", "author": CR{"name": "rvasily"}, "writer": CR{"id": 1}},
+				CR{"title": "draft", "author": nil, "writer": nil},
+			}}},
+		},
+	})
+
+	// схема строится по правам роли: скрытых столбцов и запрещённых мутаций в ней нет
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		panic(err)
+	}
+	handler.Auth = &AuthConfig{
+		APIKeys: map[string]*Identity{"key": &Identity{Subject: "bob", Role: "viewer"}},
+		Roles: map[string]*RolePolicy{"viewer": &RolePolicy{
+			Tables: map[string]*TablePolicy{
+				"users": &TablePolicy{Read: true, Hidden: []string{"password"}},
+			},
+		}},
+	}
+	viewer := httptest.NewServer(handler)
+	defer viewer.Close()
+	headers := map[string]string{"X-API-Key": "key"}
+
+	req, _ := http.NewRequest(http.MethodGet, viewer.URL+"/_graphql", nil)
+	req.Header.Set("X-API-Key", "key")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("schema request error: %v", err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, part := range []string{"password", "Items", "Mutation"} {
+		if strings.Contains(string(data), part) {
+			t.Errorf("unexpected %q in viewer schema:\n%s", part, data)
+		}
+	}
+	runCases(t, viewer, db, []Case{
+		Case{
+			Method:  http.MethodPost,
+			Path:    "/_graphql",
+			Headers: headers,
+			Body:    gql(`{ users { login password } }`, nil),
+			Status:  http.StatusBadRequest,
+			Result:  badRequest("unknown field password on type Users"),
+		},
+		Case{
+			Method:  http.MethodPost,
+			Path:    "/_graphql",
+			Headers: headers,
+			Body:    gql(`mutation { delete_users(id: 1) }`, nil),
+			Status:  http.StatusBadRequest,
+			Result:  badRequest("unknown field delete_users on type Mutation"),
+		},
+	})
+}
+
+func TestPatchUpsert(t *testing.T) {
+	db, ts := StartTestApis()
+	defer CleanupTestApis(db)
+	defer ts.Close()
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Method: http.MethodPatch,
+			Path:   "/items/1",
+			Body:   CR{"title": "sql", "updated": nil},
+			Result: CR{"response": CR{"updated": 1}},
+		},
+		Case{
+			Path: "/items/1",
+			Result: CR{"response": CR{"record": CR{
+				"id": 1, "title": "sql", "description": "Рассказать про базы данных", "updated": nil}}},
+		},
+		Case{
+			Method: http.MethodPatch,
+			Path:   "/items/1",
+			Body:   CR{"title": nil},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "field title have invalid type"},
+		},
+		Case{
+			Method: http.MethodPatch,
+			Path:   "/items/100",
+			Body:   CR{"title": "nothing"},
+			Result: CR{"response": CR{"updated": 0}},
+		},
+		Case{
+			// новая запись с ключом из URL
+			Method: http.MethodPut,
+			Path:   "/items/10",
+			Body:   CR{"title": "upsert", "description": "created"},
+			Status: http.StatusCreated,
+			Result: CR{"response": CR{"created": true}},
+		},
+		Case{
+			// вторая отправка обновляет ту же запись
+			Method: http.MethodPut,
+			Path:   "/items/10",
+			Body:   CR{"id": 10, "title": "upsert", "description": "replaced", "updated": "put"},
+			Result: CR{"response": CR{"created": false}},
+		},
+		Case{
+			Path: "/items/10",
+			Result: CR{"response": CR{"record": CR{
+				"id": 10, "title": "upsert", "description": "replaced", "updated": "put"}}},
+		},
+		Case{
+			Method: http.MethodPut,
+			Path:   "/items/10",
+			Body:   CR{"id": 11, "title": "upsert", "description": "replaced"},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "field id does not match id"},
+		},
+		Case{
+			// ключ в теле проверяется по типу столбца, строка для int не подходит
+			Method: http.MethodPut,
+			Path:   "/items/10",
+			Body:   CR{"id": "10", "title": "upsert", "description": "replaced"},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "field id does not match id"},
+		},
+		Case{
+			Method: http.MethodPut,
+			Path:   "/items/11",
+			Body:   CR{"title": "upsert"},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "field description is not nullable"},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/items",
+			Body:   CR{"title": "post", "description": "created"},
+			Result: CR{"response": CR{"id": 11}},
+		},
+		Case{
+			// старые маршруты пока работают
+			Method: http.MethodPost,
+			Path:   "/items/11",
+			Body:   CR{"title": "legacy"},
+			Result: CR{"response": CR{"updated": 1}},
+		},
+	})
+
+	status, header, _ := rawRequest(t, http.MethodPut, ts.URL+"/items/",
+		"application/json", `{"title": "legacy", "description": "put"}`)
+	if status != http.StatusOK || header.Get("Deprecation") != "true" {
+		t.Fatalf("legacy create: status %d, Deprecation %q", status, header.Get("Deprecation"))
+	}
+
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		panic(err)
+	}
+	handler.LegacyRoutes = false
+	legacyOff := httptest.NewServer(handler)
+	defer legacyOff.Close()
+
+	runCases(t, legacyOff, db, []Case{
+		Case{
+			Method: http.MethodPut,
+			Path:   "/items/",
+			Body:   CR{"title": "legacy", "description": "put"},
+			Status: http.StatusNotFound,
+			Result: CR{"error": "not found"},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/items/1",
+			Body:   CR{"title": "legacy"},
+			Status: http.StatusMethodNotAllowed,
+			Result: CR{"error": "method not allowed"},
+		},
+		Case{
+			Method: http.MethodPatch,
+			Path:   "/items/1",
+			Body:   CR{"description": "still works"},
+			Result: CR{"response": CR{"updated": 1}},
+		},
+	})
+	// выключенного маршрута нет и в Allow
+	for _, method := range []string{http.MethodPost, http.MethodOptions} {
+		_, header, _ := rawRequest(t, method, legacyOff.URL+"/items/1", "application/json", `{}`)
+		if allow := header.Get("Allow"); allow != "DELETE, GET, HEAD, OPTIONS, PATCH, PUT" {
+			t.Errorf("%s /items/1 with legacy routes off: Allow %q", method, allow)
+		}
+	}
+
+	// без Upsert в диалекте существующая запись обновляется через UPDATE
+	// только по ключу, чужие строки с тем же уникальным значением не трогаются
+	handler, err = NewDbExplorerDialect(db, noUpsertDialect{})
+	if err != nil {
+		panic(err)
+	}
+	noUpsert := httptest.NewServer(handler)
+	defer noUpsert.Close()
+
+	runCases(t, noUpsert, db, []Case{
+		Case{
+			Method: http.MethodPut,
+			Path:   "/items/2",
+			Body:   CR{"title": "no upsert", "description": "updated"},
+			Result: CR{"response": CR{"created": false}},
+		},
+		Case{
+			Path: "/items/2",
+			Result: CR{"response": CR{"record": CR{
+				"id": 2, "title": "no upsert", "description": "updated", "updated": nil}}},
+		},
+		Case{
+			Method: http.MethodPut,
+			Path:   "/items/20",
+			Body:   CR{"title": "no upsert", "description": "created"},
+			Status: http.StatusCreated,
+			Result: CR{"response": CR{"created": true}},
+		},
+		Case{
+			Method: http.MethodPut,
+			Path:   "/items/20",
+			Body:   CR{"id": 20},
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "field title is not nullable"},
+		},
+	})
+
+	price := &Column{Field: "price", Type: "decimal(6,2)"}
+	if !sameKey("1.50", "1.5", price) || sameKey("1.51", "1.5", price) {
+		t.Errorf("decimal keys must be compared as numbers")
+	}
+
+	// ON DUPLICATE KEY UPDATE меняет строку, только если совпал primary key
+	mysqlUpserts := []struct {
+		keys, columns []string
+		want          string
+	}{
+		{[]string{"id"}, []string{"title", "updated"},
+			" ON DUPLICATE KEY UPDATE `title` = IF(`id` <=> VALUES(`id`), VALUES(`title`), `title`)," +
+				" `updated` = IF(`id` <=> VALUES(`id`), VALUES(`updated`), `updated`)"},
+		{[]string{"a", "b"}, []string{"c"},
+			" ON DUPLICATE KEY UPDATE `c` = IF(`a` <=> VALUES(`a`) AND `b` <=> VALUES(`b`), VALUES(`c`), `c`)"},
+		{[]string{"id"}, nil, " ON DUPLICATE KEY UPDATE `id` = `id`"},
+	}
+	for _, check := range mysqlUpserts {
+		if got := (MySQLDialect{}).Upsert(check.keys, check.columns); got != check.want {
+			t.Errorf("mysql upsert %v %v: got %q, want %q", check.keys, check.columns, got, check.want)
+		}
+	}
+
+	merged := mergePatch(
+		map[string]interface{}{"a": "b", "c": map[string]interface{}{"d": "e", "f": "g"}},
+		map[string]interface{}{"a": "z", "c": map[string]interface{}{"f": nil}, "h": "i"})
+	want := map[string]interface{}{"a": "z", "c": map[string]interface{}{"d": "e"}, "h": "i"}
+	if !reflect.DeepEqual(merged, want) {
+		t.Fatalf("mergePatch: got %#v, want %#v", merged, want)
+	}
+}
+
+// noUpsertDialect SQLite без ON CONFLICT
+type noUpsertDialect struct {
+	SQLiteDialect
+}
+
+func (noUpsertDialect) Upsert(keys []string, columns []string) string { return "" }
+
+func TestConfig(t *testing.T) {
+	db := OpenTestDB()
+	PrepareTestApis(db)
+	defer CleanupTestApis(db)
+	prepareQueries(db, []string{
+		`DROP TABLE IF EXISTS posts;`,
+		`DROP TABLE IF EXISTS authors;`,
+		`CREATE TABLE authors (
+  id INTEGER NOT NULL PRIMARY KEY,
+  name varchar(255) NOT NULL
+);`,
+		`CREATE TABLE posts (
+  id INTEGER NOT NULL PRIMARY KEY,
+  author_id INTEGER DEFAULT NULL,
+  title varchar(255) NOT NULL,
+  FOREIGN KEY (author_id) REFERENCES authors (id)
+);`,
+		`INSERT INTO authors (id, name) VALUES (1, 'rvasily');`,
+		`INSERT INTO posts (id, author_id, title) VALUES (1, 1, 'database/sql');`,
+	})
+	defer prepareQueries(db, []string{
+		`DROP TABLE IF EXISTS posts;`,
+		`DROP TABLE IF EXISTS authors;`,
+	})
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/config.yaml"
+	ioutil.WriteFile(path, []byte(`
+deny_tables: [items]
+tables:
+  users:
+    name: accounts
+    default_limit: 1
+    max_limit: 2
+    cache_ttl: 30s
+    columns:
+      user_id: {name: id}
+      email: {name: mail}
+      password: {access: write_only}
+      updated: {access: hidden}
+  authors:
+    name: writers
+  posts:
+    columns:
+      author_id: {name: writer_id}
+      title: {access: read_only}
+`), 0600)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("load config: %v", err)
+	}
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		panic(err)
+	}
+	if err := handler.ApplyConfig(cfg); err != nil {
+		t.Fatalf("apply config: %v", err)
+	}
+	if ttl := handler.schema().configs["accounts"].CacheTTL; ttl != 30*time.Second {
+		t.Fatalf("cache_ttl: got %v", ttl)
+	}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:   "/",
+			Result: CR{"response": CR{"tables": []string{"accounts", "posts", "writers"}}},
+		},
+		Case{
+			Path:   "/items",
+			Status: http.StatusNotFound,
+			Result: CR{"error": "unknown table"},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/accounts",
+			Body:   CR{"login": "bob", "password": "secret", "mail": "bob@example.com", "info": "new"},
+			Result: CR{"response": CR{"id": 2}},
+		},
+		Case{
+			Method: http.MethodPost,
+			Path:   "/accounts",
+			Body:   CR{"login": "eve", "password": "secret", "mail": "eve@example.com", "info": "new"},
+			Result: CR{"response": CR{"id": 3}},
+		},
+		Case{
+			// default_limit
+			Path: "/accounts",
+			Result: CR{"response": CR{"records": []CR{
+				CR{"id": 1, "login": "rvasily", "mail": "rvasily@example.com", "info": "none"},
+			}}},
+		},
+		Case{
+			// max_limit, переименованные столбцы в fields, where и order
+			Path:  "/accounts",
+			Query: "limit=10&fields=id,mail&where=id:gte:2&order=-id",
+			Result: CR{"response": CR{"records": []CR{
+				CR{"id": 3, "mail": "eve@example.com"},
+				CR{"id": 2, "mail": "bob@example.com"},
+			}}},
+		},
+		Case{
+			// LIMIT -1 в SQLite отдал бы все записи в обход max_limit
+			Path:   "/accounts",
+			Query:  "limit=-1",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "limit must not be negative"},
+		},
+		Case{
+			Path:   "/accounts",
+			Query:  "offset=-1",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "offset must not be negative"},
+		},
+		Case{
+			Path:   "/accounts",
+			Query:  "where=password:eq:secret",
+			Status: http.StatusBadRequest,
+			Result: CR{"error": "unknown column password"},
+		},
+		Case{
+			Method: http.MethodPatch,
+			Path:   "/accounts/2",
+			Body:   CR{"password": "changed"},
+			Result: CR{"response": CR{"updated": 1}},
+		},
+		Case{
+			Path: "/accounts/2",
+			Result: CR{"response": CR{"record": CR{
+				"id": 2, "login": "bob", "mail": "bob@example.com", "info": "new"}}},
+		},
+		Case{
+			Method: http.MethodPatch,
+			Path:   "/accounts/2",
+			Body:   CR{"updated": "bob"},
+			Status: http.StatusForbidden,
+			Result: CR{"error": "field updated is read-only"},
+		},
+		Case{
+			Method: http.MethodPatch,
+			Path:   "/posts/1",
+			Body:   CR{"title": "changed"},
+			Status: http.StatusForbidden,
+			Result: CR{"error": "field title is read-only"},
+		},
+		Case{
+			Path:  "/posts/1",
+			Query: "expand=writer",
+			Result: CR{"response": CR{"record": CR{
+				"id": 1, "writer_id": 1, "title": "database/sql",
+				"writer": CR{"id": 1, "name": "rvasily"}}}},
+		},
+		Case{
+			Path: "/writers/1/posts",
+			Result: CR{"response": CR{"records": []CR{
+				CR{"id": 1, "writer_id": 1, "title": "database/sql"},
+			}}},
+		},
+	})
+
+	var password string
+	db.QueryRow("SELECT password FROM users WHERE user_id = 2").Scan(&password)
+	if password != "changed" {
+		t.Fatalf("write-only column: got %q", password)
+	}
+
+	for idx, item := range []struct {
+		config string
+		err    string
+	}{
+		{"tabels: {}", "field tabels not found"},
+		{"deny_tables: [nope]", "config: unknown table nope"},
+		{"tables: {nope: {}}", "config: unknown table nope"},
+		{"deny_tables: [items]\ntables: {items: {}}", "config: table items is not exposed"},
+		{"tables: {users: {columns: {nope: {}}}}", "config: table users: unknown column nope"},
+		{"tables: {users: {columns: {login: {access: secret}}}}",
+			`config: table users: column login: unknown access "secret", want read_only, write_only or hidden`},
+		{"tables: {users: {columns: {user_id: {access: hidden}}}}",
+			"config: table users: primary key user_id can not be hidden"},
+		{"tables: {users: {columns: {login: {name: email}}}}",
+			"config: table users: columns login and email have the same name email"},
+		{"tables: {users: {name: _users}}", `config: table users: invalid name "_users"`},
+		{"tables: {users: {default_limit: 10, max_limit: 5}}",
+			"config: table users: default_limit 10 is greater than max_limit 5"},
+	} {
+		ioutil.WriteFile(path, []byte(item.config), 0600)
+		cfg, err := LoadConfig(path)
+		if err == nil {
+			err = handler.ApplyConfig(cfg)
+		}
+		if err == nil || !strings.Contains(err.Error(), item.err) {
+			t.Fatalf("[%d] expected error %q, got %v", idx, item.err, err)
+		}
+	}
+	// после ошибки остаются прежние настройки
+	if _, ok := handler.schema().tablesInfo["accounts"]; !ok {
+		t.Fatalf("config was reset after failed apply")
+	}
+
+	// неудачное применение настроек не откатывает одновременную перезагрузку
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			handler.ApplyConfig(&Config{AllowTables: []string{"nope"}})
+		}()
+		go func() {
+			defer wg.Done()
+			handler.ReloadSchema()
+		}()
+	}
+	wg.Wait()
+	if _, ok := handler.schema().tablesInfo["accounts"]; !ok {
+		t.Fatalf("config was reset by concurrent apply")
+	}
+}
+
+func TestCache(t *testing.T) {
+	db := OpenTestDB()
+	PrepareTestApis(db)
+	defer CleanupTestApis(db)
+
+	handler, err := NewDbExplorer(db)
+	if err != nil {
+		panic(err)
+	}
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path:   "/_cache",
+			Status: http.StatusNotFound,
+			Result: CR{"error": "cache is disabled"},
+		},
+	})
+	handler.Cache = NewResponseCache(1<<20, time.Minute)
+
+	get := func(path string, want string, wantCache string) string {
+		status, header, body := rawRequest(t, http.MethodGet, ts.URL+path, "", "")
+		if status != http.StatusOK || header.Get("X-Cache") != wantCache ||
+			want != "" && !strings.Contains(body, want) {
+			t.Fatalf("[GET %s] status %d, X-Cache %q, body %s", path, status,
+				header.Get("X-Cache"), body)
+		}
+		return header.Get("ETag")
+	}
+
+	get("/items/1", "database/sql", "MISS")
+	// изменение в обход API не видно, пока ответ в кэше
+	db.Exec("UPDATE items SET title = 'stale' WHERE id = 1")
+	etag := get("/items/1", "database/sql", "HIT")
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/items/1", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("conditional request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified || resp.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("conditional request: status %d, X-Cache %q", resp.StatusCode,
+			resp.Header.Get("X-Cache"))
+	}
+
+	// параметры в другом порядке - тот же ответ
+	get("/items?limit=1&order=-id", "memcache", "MISS")
+	get("/items?order=-id&limit=1", "memcache", "HIT")
+	get("/users/1", "rvasily", "MISS")
+
+	// изменение через API сбрасывает ответы только своей таблицы
+	status, _, _ := rawRequest(t, http.MethodPatch, ts.URL+"/items/2",
+		"application/json", `{"title": "redis"}`)
+	if status != http.StatusOK {
+		t.Fatalf("patch: status %d", status)
+	}
+	get("/items/1", "stale", "MISS")
+	get("/items?order=-id&limit=1", "redis", "MISS")
+	get("/users/1", "rvasily", "HIT")
+
+	// ошибки не кэшируются
+	for i := 0; i < 2; i++ {
+		status, header, _ := rawRequest(t, http.MethodGet, ts.URL+"/items/100", "", "")
+		if status != http.StatusNotFound || header.Get("X-Cache") != "MISS" {
+			t.Fatalf("not found: status %d, X-Cache %q", status, header.Get("X-Cache"))
+		}
+	}
+
+	runCases(t, ts, db, []Case{
+		Case{
+			Path: "/_cache",
+			Result: CR{"response": CR{
+				"hits":          4,
+				"misses":        7,
+				"evictions":     0,
+				"invalidations": 2,
+				"entries":       3,
+				"bytes":         handler.Cache.Stats().Bytes,
+				"max_bytes":     1 << 20,
+			}},
+		},
+	})
+
+	// изменение записи сбрасывает и таблицы, которые на неё ссылаются:
+	// каскадное удаление и expand меняют их ответы
+	prepareQueries(db, []string{
+		`CREATE TABLE authors (
+  id INTEGER NOT NULL PRIMARY KEY,
+  name varchar(255) NOT NULL
+);`,
+		`CREATE TABLE posts (
+  id INTEGER NOT NULL PRIMARY KEY,
+  author_id INTEGER DEFAULT NULL,
+  title varchar(255) NOT NULL,
+  FOREIGN KEY (author_id) REFERENCES authors (id)
+);`,
+		`CREATE TABLE comments (
+  id INTEGER NOT NULL PRIMARY KEY,
+  post_id INTEGER DEFAULT NULL,
+  body varchar(255) NOT NULL,
+  FOREIGN KEY (post_id) REFERENCES posts (id)
+);`,
+		`INSERT INTO authors (id, name) VALUES (1, 'rvasily');`,
+		`INSERT INTO posts (id, author_id, title) VALUES (1, 1, 'database/sql');`,
+		`INSERT INTO comments (id, post_id, body) VALUES (1, 1, 'ok');`,
+	})
+	defer prepareQueries(db, []string{
+		`DROP TABLE IF EXISTS comments;`,
+		`DROP TABLE IF EXISTS posts;`,
+		`DROP TABLE IF EXISTS authors;`,
+	})
+	rawRequest(t, http.MethodPost, ts.URL+"/_reload", "", "")
+	get("/posts/1", "database/sql", "MISS")
+	get("/comments/1", "ok", "MISS")
+	get("/items/1", "stale", "MISS")
+	status, _, _ = rawRequest(t, http.MethodPatch, ts.URL+"/authors/1",
+		"application/json", `{"name": "vasily"}`)
+	if status != http.StatusOK {
+		t.Fatalf("patch: status %d", status)
+	}
+	get("/posts/1", "database/sql", "MISS")
+	get("/comments/1", "ok", "MISS")
+	get("/items/1", "stale", "HIT")
+	status, _, _ = rawRequest(t, http.MethodPatch, ts.URL+"/comments/1",
+		"application/json", `{"body": "fine"}`)
+	if status != http.StatusOK {
+		t.Fatalf("patch: status %d", status)
+	}
+	get("/posts/1", "database/sql", "HIT")
+
+	// LRU: при нехватке места вытесняется самый давний ответ
+	rc := NewResponseCache(100, time.Minute)
+	for _, key := range []string{"a", "b", "c"} {
+		rc.put(&cacheEntry{key: key, tables: []string{"items"},
+			body: bytes.Repeat([]byte("x"), 39)}, 0, time.Minute)
+		if key == "b" {
+			rc.get("a")
+		}
+	}
+	if rc.get("b") != nil || rc.get("a") == nil || rc.get("c") == nil {
+		t.Fatalf("lru: wrong entry evicted")
+	}
+	// ответ, прочитанный до изменения таблицы, в кэш не попадает
+	gen := rc.generation([]string{"items"})
+	rc.invalidate("items")
+	rc.put(&cacheEntry{key: "d", tables: []string{"items"}}, gen, time.Minute)
+	if rc.get("d") != nil {
+		t.Fatalf("stale response was cached")
+	}
+	// просроченный ответ не отдаётся
+	rc.put(&cacheEntry{key: "e"}, rc.generation(nil), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if rc.get("e") != nil {
+		t.Fatalf("expired response was returned")
+	}
+	if stats := rc.Stats(); stats.Evictions != 1 || stats.Invalidations != 2 || stats.Entries != 0 {
+		t.Fatalf("stats: %#v", stats)
+	}
 }
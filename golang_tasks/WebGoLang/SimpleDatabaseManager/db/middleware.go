@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"time"
+)
+
+//statusRecorder запоминает статус ответа и подробности для access-лога
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	//rows затронутые запросом строки, -1 - запрос ничего не менял
+	rows int64
+	err  error
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(data)
+}
+
+//Flush нужен потоковым ответам: выгрузке и событиям
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+func (rec *statusRecorder) recordError(err error) {
+	rec.err = err
+}
+
+func (rec *statusRecorder) recordRows(rows int64) {
+	if rec.rows < 0 {
+		rec.rows = 0
+	}
+	rec.rows += rows
+}
+
+//recordRows передаёт в access-лог количество затронутых строк
+func recordRows(w http.ResponseWriter, rows int64) {
+	if rec, ok := w.(interface{ recordRows(int64) }); ok {
+		rec.recordRows(rows)
+	}
+}
+
+//requestIDRe какие X-Request-ID клиента принимаем как есть
+var requestIDRe = regexp.MustCompile(`^[[:alnum:]._-]{1,64}$`)
+
+//requestIDFrom идентификатор запроса из контекста
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+//withRequestID берёт X-Request-ID клиента или выдаёт новый,
+//кладёт его в контекст и возвращает в заголовке ответа
+func (dbex *DBExplorer) withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if !requestIDRe.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, req.WithContext(
+			context.WithValue(req.Context(), requestIDKey, id)))
+	})
+}
+
+//withAccessLog пишет по строке лога на каждый запрос
+func (dbex *DBExplorer) withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, rows: -1}
+		next.ServeHTTP(rec, req)
+
+		fields := map[string]interface{}{
+			"request_id": requestIDFrom(req.Context()),
+			"method":     req.Method,
+			"path":       req.URL.Path,
+			"status":     rec.status,
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if info := routeFrom(req.Context()); info != nil {
+			fields["route"] = info.URL
+		}
+		if rec.rows >= 0 {
+			fields["rows_affected"] = rec.rows
+		}
+		if rec.err != nil {
+			fields["error"] = rec.err.Error()
+		}
+		dbex.logEvent("access", fields)
+	})
+}
+
+//withRecover превращает панику в хэндлере в ответ 500,
+//чтобы один упавший запрос не рвал соединение клиента
+func (dbex *DBExplorer) withRecover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			//клиент ушёл, отвечать некому
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			dbex.logEvent("panic", map[string]interface{}{
+				"request_id": requestIDFrom(req.Context()),
+				"panic":      fmt.Sprint(p),
+				"stack":      string(debug.Stack()),
+			})
+			if rec, ok := w.(*statusRecorder); ok && rec.status != 0 {
+				return
+			}
+			writeError(w, fmt.Errorf("panic: %v", p))
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
+
+//streamRoutes маршруты, держащие соединение открытым,
+//общий QueryTimeout на них не действует. Выгрузка сама следит,
+//чтобы каждая строка приходила из базы не дольше QueryTimeout
+var streamRoutes = map[string]bool{
+	"GET /{table}/_changes": true,
+	"GET /{table}/_export":  true,
+}
+
+//withTimeout ограничивает время запросов к базе: таймаут маршрута
+//из RouteTimeouts или общий QueryTimeout
+func (dbex *DBExplorer) withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		timeout := dbex.QueryTimeout
+		if info := routeFrom(req.Context()); info != nil {
+			if streamRoutes[info.Method+" "+info.URL] {
+				timeout = 0
+			}
+			if routeTimeout, ok := dbex.RouteTimeouts[info.Method+" "+info.URL]; ok {
+				timeout = routeTimeout
+			}
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+//logEvent пишет в лог событие одной JSON-строкой
+func (dbex *DBExplorer) logEvent(event string, fields map[string]interface{}) {
+	fields["event"] = event
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, _ := json.Marshal(fields)
+	dbex.Logger.Print(string(line))
+}
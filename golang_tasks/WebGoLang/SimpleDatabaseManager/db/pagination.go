@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//listCursor содержимое непрозрачного cursor/next_cursor
+type listCursor struct {
+	After []string `json:"after"`
+}
+
+//encodeCursor упаковывает значения primary key последней записи страницы
+func encodeCursor(keys []*Column, record map[string]interface{}) string {
+	lc := &listCursor{}
+	for _, key := range keys {
+		lc.After = append(lc.After, fmt.Sprint(record[key.Field]))
+	}
+	data, _ := json.Marshal(lc)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+//decodeCursor распаковывает cursor и приводит значения к типам ключа
+func decodeCursor(cursor string, keys []*Column) ([]interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	lc := &listCursor{}
+	if err := json.Unmarshal(data, lc); err != nil || len(lc.After) != len(keys) {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	after := make([]interface{}, 0, len(keys))
+	for i, key := range keys {
+		v, err := parseQueryValue(lc.After[i], key)
+		if err != nil {
+			return nil, err
+		}
+		after = append(after, v)
+	}
+	return after, nil
+}
+
+//applyCursor переводит выборку в режим keyset-пагинации по primary key:
+//записи идут по возрастанию ключа, начиная после значения из cursor
+func (lq *listQuery) applyCursor(dialect Dialect, tableInfo []*Column,
+	cursor string) ([]*Column, error) {
+	keys := primaryKeys(tableInfo)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("table has no primary key")
+	}
+	if len(lq.order) != 0 {
+		return nil, fmt.Errorf("order is not supported with cursor")
+	}
+
+	columns := make([]string, 0, len(keys))
+	for _, key := range keys {
+		columns = append(columns, dialect.Quote(key.dbName()))
+	}
+
+	if cursor != "" {
+		after, err := decodeCursor(cursor, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		placeholders := make([]string, 0, len(after))
+		for _, v := range after {
+			placeholders = append(placeholders, lq.args.add(v))
+		}
+		//составной ключ сравниваем как кортеж: (a, b) > (?, ?)
+		if len(keys) == 1 {
+			lq.where = append(lq.where, columns[0]+" > "+placeholders[0])
+		} else {
+			lq.where = append(lq.where, "("+strings.Join(columns, ", ")+") > ("+
+				strings.Join(placeholders, ", ")+")")
+		}
+	}
+
+	for _, column := range columns {
+		lq.order = append(lq.order, column+" ASC")
+	}
+
+	//без ключа в выборке не из чего будет сделать next_cursor
+	if len(lq.fields) != 0 {
+		for _, column := range columns {
+			found := false
+			for _, field := range lq.fields {
+				if field == column {
+					found = true
+					break
+				}
+			}
+			if !found {
+				lq.fields = append(lq.fields, column)
+			}
+		}
+	}
+	return keys, nil
+}
+
+//countSQL собирает SELECT COUNT(*) с текущими условиями where,
+//tableName - имя таблицы в базе
+func (lq *listQuery) countSQL(dialect Dialect, tableName string) string {
+	sqlReq := "SELECT COUNT(*) FROM " + dialect.Quote(tableName)
+	if len(lq.where) != 0 {
+		sqlReq += " WHERE " + strings.Join(lq.where, " AND ")
+	}
+	return sqlReq
+}
+
+//pageLink ссылка на ту же выборку с заменёнными параметрами
+func pageLink(req *http.Request, rel string, set map[string]string) string {
+	query := req.URL.Query()
+	for key, value := range set {
+		query.Set(key, value)
+	}
+
+	link := url.URL{Path: req.URL.Path, RawQuery: query.Encode()}
+	return "<" + link.String() + ">; rel=\"" + rel + "\""
+}
+
+//offsetLinks Link-заголовки для пагинации через limit/offset,
+//total < 0 значит, что общее количество записей не считали. С limit=0
+//(только total) ссылки вели бы на ту же страницу, поэтому их нет
+func offsetLinks(req *http.Request, limit, offset, got int, total int64) []string {
+	links := make([]string, 0, 2)
+	if limit == 0 {
+		return links
+	}
+	hasNext := got == limit
+	if total >= 0 {
+		hasNext = int64(offset+limit) < total
+	}
+	if hasNext {
+		links = append(links, pageLink(req, "next", map[string]string{
+			"limit":  strconv.Itoa(limit),
+			"offset": strconv.Itoa(offset + limit)}))
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, pageLink(req, "prev", map[string]string{
+			"limit":  strconv.Itoa(limit),
+			"offset": strconv.Itoa(prev)}))
+	}
+	return links
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+//sqlArgs копит аргументы запроса и выдаёт под них плейсхолдеры диалекта
+type sqlArgs struct {
+	dialect Dialect
+	values  []interface{}
+}
+
+//add добавляет аргумент и возвращает его плейсхолдер
+func (sa *sqlArgs) add(v interface{}) string {
+	sa.values = append(sa.values, v)
+	return sa.dialect.Placeholder(len(sa.values))
+}
+
+//whereOperators операторы, доступные в ?where=column:op:value
+var whereOperators = map[string]string{
+	"eq":   "=",
+	"ne":   "<>",
+	"gt":   ">",
+	"gte":  ">=",
+	"lt":   "<",
+	"lte":  "<=",
+	"like": "LIKE",
+}
+
+//listQuery разобранные параметры выборки для getListFrom
+type listQuery struct {
+	fields []string
+	where  []string
+	order  []string
+	args   *sqlArgs
+}
+
+//findColumn ищет метаданные столбца по имени
+func findColumn(tableInfo []*Column, name string) *Column {
+	for _, info := range tableInfo {
+		if info.Field == name {
+			return info
+		}
+	}
+	return nil
+}
+
+//findDBColumn ищет метаданные столбца по имени в базе
+func findDBColumn(tableInfo []*Column, name string) *Column {
+	for _, info := range tableInfo {
+		if info.dbName() == name {
+			return info
+		}
+	}
+	return nil
+}
+
+//parseListQuery разбирает fields, where и order, проверяя столбцы по tableInfo
+func (dbex *DBExplorer) parseListQuery(tableInfo []*Column,
+	query url.Values) (*listQuery, error) {
+	lq := &listQuery{
+		args: &sqlArgs{dialect: dbex.dialect},
+	}
+
+	if fields := query.Get("fields"); fields != "" {
+		for _, name := range strings.Split(fields, ",") {
+			info := findColumn(tableInfo, name)
+			if info == nil {
+				return nil, fmt.Errorf("unknown column %s", name)
+			}
+			lq.fields = append(lq.fields, dbex.dialect.Quote(info.dbName()))
+		}
+	}
+
+	for _, cond := range query["where"] {
+		parts := strings.SplitN(cond, ":", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid where %s", cond)
+		}
+
+		info := findColumn(tableInfo, parts[0])
+		if info == nil {
+			return nil, fmt.Errorf("unknown column %s", parts[0])
+		}
+		column := dbex.dialect.Quote(info.dbName())
+
+		switch parts[1] {
+		case "null":
+			lq.where = append(lq.where, column+" IS NULL")
+			continue
+		case "notnull":
+			lq.where = append(lq.where, column+" IS NOT NULL")
+			continue
+		}
+
+		op, ok := whereOperators[parts[1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown operator %s", parts[1])
+		}
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid where %s", cond)
+		}
+
+		v, err := parseQueryValue(parts[2], info)
+		if err != nil {
+			return nil, err
+		}
+		lq.where = append(lq.where, column+" "+op+" "+lq.args.add(v))
+	}
+
+	if order := query.Get("order"); order != "" {
+		for _, name := range strings.Split(order, ",") {
+			direction := " ASC"
+			if strings.HasPrefix(name, "-") {
+				direction = " DESC"
+				name = name[1:]
+			}
+			info := findColumn(tableInfo, name)
+			if info == nil {
+				return nil, fmt.Errorf("unknown column %s", name)
+			}
+			lq.order = append(lq.order, dbex.dialect.Quote(info.dbName())+direction)
+		}
+	}
+
+	return lq, nil
+}
+
+//selectSQL собирает SELECT по таблице с учётом fields, where и order,
+//tableName - имя таблицы в базе
+func (lq *listQuery) selectSQL(dialect Dialect, tableName string) string {
+	columns := "*"
+	if len(lq.fields) != 0 {
+		columns = strings.Join(lq.fields, ", ")
+	}
+
+	sqlReq := "SELECT " + columns + " FROM " + dialect.Quote(tableName)
+	if len(lq.where) != 0 {
+		sqlReq += " WHERE " + strings.Join(lq.where, " AND ")
+	}
+	if len(lq.order) != 0 {
+		sqlReq += " ORDER BY " + strings.Join(lq.order, ", ")
+	}
+	return sqlReq
+}
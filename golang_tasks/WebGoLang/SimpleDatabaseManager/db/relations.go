@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//ForeignKey внешний ключ Column -> RefTable.RefColumn
+type ForeignKey struct {
+	Name      string `json:"name"`
+	Column    string `json:"column"`
+	RefTable  string `json:"ref_table"`
+	RefColumn string `json:"ref_column"`
+}
+
+//Relation имя, под которым связь раскрывается в ?expand=:
+//author_id раскрывается в author, остальные столбцы под своим именем
+func (fk *ForeignKey) Relation() string {
+	if strings.HasSuffix(fk.Column, "_id") && len(fk.Column) > len("_id") {
+		return strings.TrimSuffix(fk.Column, "_id")
+	}
+	return fk.Column
+}
+
+//loadForeignKeys читает внешние ключи всех таблиц схемы
+func (sc *dbSchema) loadForeignKeys(dialect Dialect, db sqlExecutor) error {
+	for tableName := range sc.tablesInfo {
+		fks, err := dialect.ForeignKeys(db, tableName)
+		if err != nil {
+			return fmt.Errorf("foreign keys read from %s error: %v", tableName, err)
+		}
+
+		//SQLite не пишет столбец, если ссылка идёт на primary key
+		for _, fk := range fks {
+			if fk.RefColumn != "" {
+				continue
+			}
+			if keys := primaryKeys(sc.tablesInfo[fk.RefTable]); len(keys) == 1 {
+				fk.RefColumn = keys[0].Field
+			}
+		}
+		sc.foreignKeys[tableName] = fks
+	}
+	return nil
+}
+
+//parseExpand разбирает ?expand=author,category в список внешних ключей
+func (dbex *DBExplorer) parseExpand(sc *dbSchema, tableName string,
+	expand []string) ([]*ForeignKey, error) {
+	fks := make([]*ForeignKey, 0)
+	for _, names := range expand {
+		for _, name := range strings.Split(names, ",") {
+			var found *ForeignKey
+			for _, fk := range sc.foreignKeys[tableName] {
+				if fk.Relation() == name {
+					found = fk
+					break
+				}
+			}
+			if found == nil {
+				return nil, APIError{http.StatusBadRequest,
+					fmt.Errorf("unknown relation %s", name)}
+			}
+			fks = append(fks, found)
+		}
+	}
+	return fks, nil
+}
+
+//expandRecords подставляет в записи связанные строки, на каждую связь
+//уходит один запрос с IN по всем значениям внешнего ключа. Мягко
+//удалённые строки подставляются как null, если не withDeleted
+func (dbex *DBExplorer) expandRecords(sc *dbSchema, db sqlExecutor,
+	records []map[string]interface{}, fks []*ForeignKey, withDeleted bool) error {
+	for _, fk := range fks {
+		refInfo, ok := sc.tablesInfo[fk.RefTable]
+		if !ok {
+			return fmt.Errorf("unknown table %s", fk.RefTable)
+		}
+
+		args := &sqlArgs{dialect: dbex.dialect}
+		placeholders := make([]string, 0, len(records))
+		seen := make(map[string]bool)
+		for _, record := range records {
+			v := record[fk.Column]
+			if v == nil || seen[fmt.Sprint(v)] {
+				continue
+			}
+			seen[fmt.Sprint(v)] = true
+			placeholders = append(placeholders, args.add(v))
+		}
+
+		related := make(map[string]map[string]interface{})
+		if len(placeholders) != 0 {
+			sqlReq := "SELECT * FROM " + dbex.quoteTable(sc, fk.RefTable) +
+				" WHERE " + dbex.dialect.Quote(dbColumn(refInfo, fk.RefColumn)) +
+				" IN (" + strings.Join(placeholders, ", ") + ")"
+			if column := dbex.softDeleteColumn(refInfo); column != nil && !withDeleted {
+				sqlReq += " AND " + dbex.dialect.Quote(column.dbName()) + " IS NULL"
+			}
+			rows, err := db.Query(sqlReq, args.values...)
+			if err != nil {
+				return err
+			}
+			refData, err := dbex.readDBData(rows, refInfo)
+			rows.Close()
+			if err != nil {
+				return err
+			}
+			for _, row := range refData {
+				related[fmt.Sprint(row[fk.RefColumn])] = row
+			}
+		}
+
+		for _, record := range records {
+			var row interface{}
+			if v := record[fk.Column]; v != nil {
+				if r, ok := related[fmt.Sprint(v)]; ok {
+					row = r
+				}
+			}
+			record[fk.Relation()] = row
+		}
+	}
+	return nil
+}
+
+//tableMeta отдаёт внешние ключи таблицы и ссылки на неё из других таблиц.
+//Связи из таблиц, которые роль не читает, и по скрытым от неё столбцам
+//не показываются
+func (dbex *DBExplorer) tableMeta(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	tableName := params["table"]
+	sc := dbex.schema()
+	if _, ok := sc.tablesInfo[tableName]; !ok {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	tp, err := dbex.checkRead(sc, req, tableName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	referencedBy := make([]map[string]interface{}, 0)
+	for otherTable, fks := range sc.foreignKeys {
+		other := dbex.tablePolicy(sc, req, otherTable)
+		for _, fk := range fks {
+			if fk.RefTable != tableName || !other.Read || other.isHidden(fk.Column) {
+				continue
+			}
+			referencedBy = append(referencedBy, map[string]interface{}{
+				"table":      otherTable,
+				"name":       fk.Name,
+				"column":     fk.Column,
+				"ref_column": fk.RefColumn,
+			})
+		}
+	}
+	sort.Slice(referencedBy, func(i, j int) bool {
+		return fmt.Sprint(referencedBy[i]["table"], referencedBy[i]["column"]) <
+			fmt.Sprint(referencedBy[j]["table"], referencedBy[j]["column"])
+	})
+
+	foreignKeys := make([]*ForeignKey, 0, len(sc.foreignKeys[tableName]))
+	for _, fk := range sc.foreignKeys[tableName] {
+		if !tp.isHidden(fk.Column) {
+			foreignKeys = append(foreignKeys, fk)
+		}
+	}
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": map[string]interface{}{
+			"table":         tableName,
+			"foreign_keys":  foreignKeys,
+			"referenced_by": referencedBy}})
+	w.Write(jsonRes)
+}
+
+//getRelated отдаёт записи related, ссылающиеся на запись table/id,
+//например GET /users/1/items. Если ссылок несколько, нужную выбирают ?via=column
+func (dbex *DBExplorer) getRelated(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	tableName := params["table"]
+	tableInfo, ok := sc.tablesInfo[tableName]
+	relatedName := params["related"]
+	relatedInfo, relatedOk := sc.tablesInfo[relatedName]
+	if !ok || !relatedOk {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	if _, err := dbex.checkRead(sc, req, tableName); err != nil {
+		writeError(w, err)
+		return
+	}
+	tp, err := dbex.checkRead(sc, req, relatedName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	via := req.URL.Query().Get("via")
+	var found *ForeignKey
+	for _, fk := range sc.foreignKeys[relatedName] {
+		if fk.RefTable == tableName && (via == "" || via == fk.Column) &&
+			!tp.isHidden(fk.Column) {
+			found = fk
+			break
+		}
+	}
+	if found == nil {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown relation")})
+		return
+	}
+
+	args := &sqlArgs{dialect: dbex.dialect}
+	cond, err := dbex.keyCondition(tableInfo, params["id"], args)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	//ссылка может идти не на primary key, поэтому значение берём из самой записи
+	refColumn := dbex.dialect.Quote(dbColumn(tableInfo, found.RefColumn))
+	rows, err := dbex.conn(req).Query("SELECT "+refColumn+
+		" FROM "+dbex.quoteTable(sc, tableName)+" WHERE "+cond, args.values...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var refValue interface{}
+	exists := rows.Next()
+	if exists {
+		err = rows.Scan(&refValue)
+	}
+	rows.Close()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !exists {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("record not found")})
+		return
+	}
+
+	lq, err := dbex.parseListQuery(tp.visible(relatedInfo), req.URL.Query())
+	if err != nil {
+		writeError(w, APIError{http.StatusBadRequest, err})
+		return
+	}
+	lq.where = append(lq.where,
+		dbex.dialect.Quote(dbColumn(relatedInfo, found.Column))+" = "+lq.args.add(refValue))
+	dbex.hideDeleted(lq, relatedInfo, req.URL.Query())
+	dbex.serveList(w, req, sc, relatedName, relatedInfo, lq)
+}
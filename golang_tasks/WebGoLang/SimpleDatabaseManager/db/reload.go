@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//dbSchema метаданные базы. После загрузки не меняется,
+//при перезагрузке подменяется целиком
+type dbSchema struct {
+	tablesInfo  map[string][]*Column
+	foreignKeys map[string][]*ForeignKey
+
+	//dbTables имена в базе переименованных в Config таблиц
+	dbTables map[string]string
+	//configs настройки таблиц из Config
+	configs map[string]*TableConfig
+	//access ограничения столбцов из Config
+	access map[string]*TablePolicy
+}
+
+//schema текущий снимок метаданных. Запрос берёт его один раз и передаёт
+//дальше: перезагрузка между двумя вызовами смешала бы два снимка
+func (dbex *DBExplorer) schema() *dbSchema {
+	dbex.schemaMu.RLock()
+	defer dbex.schemaMu.RUnlock()
+	return dbex.current
+}
+
+//loadSchema читает из базы таблицы, столбцы и внешние ключи и применяет
+//к ним настройки cfg, nil - всё как в базе
+func (dbex *DBExplorer) loadSchema(db sqlExecutor, cfg *Config) (*dbSchema, error) {
+	sc := &dbSchema{
+		tablesInfo:  make(map[string][]*Column),
+		foreignKeys: make(map[string][]*ForeignKey),
+	}
+
+	tables, err := dbex.dialect.Tables(db)
+	if err != nil {
+		return nil, fmt.Errorf("tables open error: %v", err)
+	}
+
+	for _, tableName := range tables {
+		//журнал изменений ведёт сам DBExplorer, через API он не виден
+		if tableName == dbex.auditTable() {
+			continue
+		}
+		columns, err := dbex.dialect.Columns(db, tableName)
+		if err != nil {
+			return nil, fmt.Errorf("columns read from %s error: %v", tableName, err)
+		}
+		for _, column := range columns {
+			column.typ = parseColumnType(column.Type)
+		}
+		sc.tablesInfo[tableName] = columns
+	}
+
+	if err := sc.loadForeignKeys(dbex.dialect, db); err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		if err := cfg.apply(sc); err != nil {
+			return nil, err
+		}
+	}
+	return sc, nil
+}
+
+//SchemaDiff изменения схемы после перезагрузки
+type SchemaDiff struct {
+	AddedTables    []string            `json:"added_tables"`
+	RemovedTables  []string            `json:"removed_tables"`
+	AddedColumns   map[string][]string `json:"added_columns"`
+	RemovedColumns map[string][]string `json:"removed_columns"`
+	ChangedColumns map[string][]string `json:"changed_columns"`
+}
+
+//Empty схема не поменялась
+func (sd *SchemaDiff) Empty() bool {
+	return len(sd.AddedTables) == 0 && len(sd.RemovedTables) == 0 &&
+		len(sd.AddedColumns) == 0 && len(sd.RemovedColumns) == 0 &&
+		len(sd.ChangedColumns) == 0
+}
+
+//diffSchemas сравнивает два снимка схемы
+func diffSchemas(old, cur *dbSchema) *SchemaDiff {
+	sd := &SchemaDiff{
+		AddedTables:    make([]string, 0),
+		RemovedTables:  make([]string, 0),
+		AddedColumns:   make(map[string][]string),
+		RemovedColumns: make(map[string][]string),
+		ChangedColumns: make(map[string][]string),
+	}
+
+	for tableName := range old.tablesInfo {
+		if _, ok := cur.tablesInfo[tableName]; !ok {
+			sd.RemovedTables = append(sd.RemovedTables, tableName)
+		}
+	}
+	for tableName, columns := range cur.tablesInfo {
+		oldColumns, ok := old.tablesInfo[tableName]
+		if !ok {
+			sd.AddedTables = append(sd.AddedTables, tableName)
+			continue
+		}
+
+		for _, column := range columns {
+			oldColumn := findColumn(oldColumns, column.Field)
+			switch {
+			case oldColumn == nil:
+				sd.AddedColumns[tableName] = append(sd.AddedColumns[tableName],
+					column.Field)
+			case oldColumn.Type != column.Type || oldColumn.Null != column.Null ||
+				oldColumn.Key != column.Key || oldColumn.Default != column.Default ||
+				oldColumn.Extra != column.Extra:
+				sd.ChangedColumns[tableName] = append(sd.ChangedColumns[tableName],
+					column.Field)
+			}
+		}
+		for _, oldColumn := range oldColumns {
+			if findColumn(columns, oldColumn.Field) == nil {
+				sd.RemovedColumns[tableName] = append(sd.RemovedColumns[tableName],
+					oldColumn.Field)
+			}
+		}
+	}
+
+	sort.Strings(sd.AddedTables)
+	sort.Strings(sd.RemovedTables)
+	return sd
+}
+
+//ReloadSchema перечитывает схему базы и атомарно подменяет метаданные,
+//запросы, уже начатые со старым снимком, дорабатывают с ним
+func (dbex *DBExplorer) ReloadSchema() (*SchemaDiff, error) {
+	return dbex.reload(context.Background())
+}
+
+//reload перечитывает схему запросами с контекстом ctx
+func (dbex *DBExplorer) reload(ctx context.Context) (*SchemaDiff, error) {
+	//две перезагрузки одновременно могли бы подменить схему более старой
+	dbex.reloadMu.Lock()
+	defer dbex.reloadMu.Unlock()
+	return dbex.reloadLocked(ctx, dbex.config)
+}
+
+//reloadLocked перечитывает схему с настройками cfg, вызывается под reloadMu
+func (dbex *DBExplorer) reloadLocked(ctx context.Context, cfg *Config) (*SchemaDiff, error) {
+	sc, err := dbex.loadSchema(withContext(ctx, dbex.DB), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dbex.schemaMu.Lock()
+	old := dbex.current
+	dbex.current = sc
+	dbex.schemaMu.Unlock()
+	//в ответах могли остаться старые столбцы и имена
+	if dbex.Cache != nil {
+		dbex.Cache.Purge()
+	}
+
+	diff := diffSchemas(old, sc)
+	if !diff.Empty() {
+		dbex.logEvent("schema_reload", map[string]interface{}{
+			"added_tables":    diff.AddedTables,
+			"removed_tables":  diff.RemovedTables,
+			"added_columns":   diff.AddedColumns,
+			"removed_columns": diff.RemovedColumns,
+			"changed_columns": diff.ChangedColumns,
+		})
+	}
+	return diff, nil
+}
+
+//WatchSchema перечитывает схему раз в interval, пока не вызовут stop
+func (dbex *DBExplorer) WatchSchema(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := dbex.ReloadSchema(); err != nil {
+					dbex.logEvent("schema_reload_error", map[string]interface{}{
+						"error": err.Error(),
+					})
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+//reloadSchema перезагружает схему по POST /_reload и отдаёт изменения
+func (dbex *DBExplorer) reloadSchema(w http.ResponseWriter, req *http.Request) {
+	if !dbex.isAdmin(req) {
+		writeError(w, APIError{http.StatusForbidden, fmt.Errorf("forbidden")})
+		return
+	}
+
+	diff, err := dbex.reload(req.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": diff})
+	w.Write(jsonRes)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//Middleware обёртка над хэндлером, применяется ко всем запросам роутера
+type Middleware func(http.Handler) http.Handler
+
+//RouteInfo шаблон URL и метод зарегистрированного маршрута
+type RouteInfo struct {
+	URL    string
+	Method string
+}
+
+//paramTypes встроенные ограничения параметров: {id:int}
+var paramTypes = map[string]string{
+	"int":   `-?[0-9]+`,
+	"uint":  `[0-9]+`,
+	"alpha": `[[:alpha:]]+`,
+	"alnum": `[[:alnum:]]+`,
+	"uuid":  `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+}
+
+//rawParams параметры, которые отдаются хэндлеру без раскодирования:
+//части составного ключа в {id} раскодирует keyValues, чтобы запятая
+//в значении не путалась с разделителем частей
+var rawParams = map[string]bool{"id": true}
+
+//route хэндлер одного метода на узле дерева
+type route struct {
+	info    *RouteInfo
+	handler func(http.ResponseWriter, *http.Request, map[string]string)
+	//enabled проверяется при каждом запросе, nil - маршрут включён всегда
+	enabled func() bool
+}
+
+//active включён ли маршрут сейчас
+func (r *route) active() bool {
+	return r.enabled == nil || r.enabled()
+}
+
+//routeNode узел дерева маршрутов, одному узлу соответствует один сегмент пути
+type routeNode struct {
+	//segment исходный текст сегмента из шаблона
+	segment string
+	//name имя параметра, пусто для статического сегмента
+	name string
+	//re ограничение параметра, nil - любой непустой сегмент
+	re *regexp.Regexp
+
+	static map[string]*routeNode
+	//params проверяются в порядке регистрации
+	params   []*routeNode
+	catchAll *routeNode
+
+	routes map[string]*route
+}
+
+func newRouteNode(segment string) *routeNode {
+	return &routeNode{
+		segment: segment,
+		static:  make(map[string]*routeNode),
+		params:  make([]*routeNode, 0),
+		routes:  make(map[string]*route),
+	}
+}
+
+//Router роутер на дереве сегментов: статические сегменты, параметры
+//{name}, {name:int}, {name:regexp} и хвост {name...}
+type Router struct {
+	root        *routeNode
+	middlewares []Middleware
+	//все маршруты в порядке регистрации, нужны для описания API
+	registered []*RouteInfo
+}
+
+//NewRouter создаёт Router
+func NewRouter() *Router {
+	return &Router{
+		root:        newRouteNode(""),
+		middlewares: make([]Middleware, 0),
+		registered:  make([]*RouteInfo, 0),
+	}
+}
+
+//Routes список зарегистрированных маршрутов
+func (rt *Router) Routes() []*RouteInfo {
+	return rt.registered
+}
+
+//Use добавляет middleware, первый добавленный выполняется первым
+func (rt *Router) Use(mws ...Middleware) {
+	rt.middlewares = append(rt.middlewares, mws...)
+}
+
+//Вешает просто хэндлер без параметров
+func (rt *Router) addSimpleHandler(url string, method string,
+	handler func(http.ResponseWriter, *http.Request)) error {
+	if strings.Contains(url, "{") {
+		return fmt.Errorf("Use addAdvancedHandler() for routes with parameters")
+	}
+	return rt.add(url, method, nil,
+		func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+			handler(w, r)
+		})
+}
+
+//Будет парсить параметры в {} в структуру
+func (rt *Router) addAdvancedHandler(url string, method string,
+	handler func(http.ResponseWriter, *http.Request, map[string]string)) error {
+	if !strings.Contains(url, "{") {
+		return fmt.Errorf("Use addSimpleHandler() for simple routes")
+	}
+	return rt.add(url, method, nil, handler)
+}
+
+//addOptionalHandler вешает хэндлер, который работает, пока enabled
+//возвращает true. Выключенного маршрута как будто нет: он не подходит
+//по методу и не попадает в Allow
+func (rt *Router) addOptionalHandler(url string, method string, enabled func() bool,
+	handler func(http.ResponseWriter, *http.Request, map[string]string)) error {
+	return rt.add(url, method, enabled, handler)
+}
+
+//add прокладывает в дереве путь по сегментам шаблона url
+func (rt *Router) add(url string, method string, enabled func() bool,
+	handler func(http.ResponseWriter, *http.Request, map[string]string)) error {
+	segments := splitPath(url)
+	node := rt.root
+	for i, segment := range segments {
+		child, err := node.child(segment, i == len(segments)-1)
+		if err != nil {
+			return fmt.Errorf("route %s: %v", url, err)
+		}
+		node = child
+	}
+
+	if _, ok := node.routes[method]; ok {
+		return fmt.Errorf("Route already exist")
+	}
+	info := &RouteInfo{URL: url, Method: method}
+	node.routes[method] = &route{info: info, handler: handler, enabled: enabled}
+	rt.registered = append(rt.registered, info)
+	return nil
+}
+
+//child находит или создаёт дочерний узел для сегмента шаблона
+func (n *routeNode) child(segment string, last bool) (*routeNode, error) {
+	if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+		if _, ok := n.static[segment]; !ok {
+			n.static[segment] = newRouteNode(segment)
+		}
+		return n.static[segment], nil
+	}
+
+	inner := segment[1 : len(segment)-1]
+	if strings.HasSuffix(inner, "...") {
+		if !last {
+			return nil, fmt.Errorf("catch-all %s must be the last segment", segment)
+		}
+		if n.catchAll == nil {
+			n.catchAll = newRouteNode(segment)
+			n.catchAll.name = strings.TrimSuffix(inner, "...")
+		} else if n.catchAll.segment != segment {
+			return nil, fmt.Errorf("catch-all %s conflicts with %s",
+				segment, n.catchAll.segment)
+		}
+		return n.catchAll, nil
+	}
+
+	for _, param := range n.params {
+		if param.segment == segment {
+			return param, nil
+		}
+	}
+
+	param := newRouteNode(segment)
+	param.name = inner
+	if idx := strings.Index(inner, ":"); idx != -1 {
+		param.name = inner[:idx]
+		pattern := inner[idx+1:]
+		if builtin, ok := paramTypes[pattern]; ok {
+			pattern = builtin
+		}
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid param %s: %v", segment, err)
+		}
+		param.re = re
+	}
+	n.params = append(n.params, param)
+	return param, nil
+}
+
+//splitPath делит путь на сегменты, "/" - один пустой сегмент
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+//routeMatch результат поиска маршрута
+type routeMatch struct {
+	method string
+	route  *route
+	params map[string]string
+	//allowed методы узлов, подошедших по пути, но не по методу
+	allowed map[string]bool
+}
+
+//lookup обходит дерево: статический сегмент важнее параметра,
+//параметр важнее хвоста. Если у подошедшего узла нет нужного метода,
+//поиск продолжается в следующих ветках, кроме служебных сегментов
+//с префиксом "_": они не бывают значением параметра, поэтому
+//GET /_batch получает 405, а не GET /{table}. segments - раскодированные
+//сегменты пути, raw - они же в том виде, в каком пришли в URL
+func (n *routeNode) lookup(segments []string, raw []string, params []string,
+	m *routeMatch) bool {
+	if len(segments) == 0 {
+		return n.matchMethod(params, m)
+	}
+
+	segment := segments[0]
+	if child, ok := n.static[segment]; ok {
+		if child.lookup(segments[1:], raw[1:], params, m) {
+			return true
+		}
+		if strings.HasPrefix(segment, "_") {
+			return false
+		}
+	}
+	if segment != "" {
+		for _, param := range n.params {
+			if param.re != nil && !param.re.MatchString(segment) {
+				continue
+			}
+			value := segment
+			if rawParams[param.name] {
+				value = raw[0]
+			}
+			//копия, чтобы соседние ветки не затирали значения друг друга
+			next := append(params[:len(params):len(params)], param.name, value)
+			if param.lookup(segments[1:], raw[1:], next, m) {
+				return true
+			}
+		}
+	}
+	if n.catchAll != nil {
+		next := append(params[:len(params):len(params)],
+			n.catchAll.name, strings.Join(segments, "/"))
+		return n.catchAll.matchMethod(next, m)
+	}
+	return false
+}
+
+//matchMethod выбирает хэндлер узла по методу запроса,
+//HEAD без своего хэндлера обслуживается GET-хэндлером
+func (n *routeNode) matchMethod(params []string, m *routeMatch) bool {
+	r, ok := n.routes[m.method]
+	ok = ok && r.active()
+	if !ok && m.method == http.MethodHead {
+		r, ok = n.routes[http.MethodGet]
+		ok = ok && r.active()
+	}
+	if !ok {
+		for method, r := range n.routes {
+			if r.active() {
+				m.allowed[method] = true
+			}
+		}
+		return false
+	}
+
+	m.route = r
+	m.params = make(map[string]string, len(params)/2)
+	for i := 0; i+1 < len(params); i += 2 {
+		m.params[params[i]] = params[i+1]
+	}
+	return true
+}
+
+//allowHeader значение заголовка Allow
+func allowHeader(allowed map[string]bool) string {
+	if allowed[http.MethodGet] {
+		allowed[http.MethodHead] = true
+	}
+	allowed[http.MethodOptions] = true
+
+	methods := make([]string, 0, len(allowed))
+	for method := range allowed {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+//ctxKey ключи значений, которые роутер и middleware кладут в контекст запроса
+type ctxKey int
+
+const (
+	routeKey ctxKey = iota
+	identityKey
+	requestIDKey
+)
+
+//routeFrom маршрут, на который попал запрос, nil если не нашли
+func routeFrom(ctx context.Context) *RouteInfo {
+	info, _ := ctx.Value(routeKey).(*RouteInfo)
+	return info
+}
+
+//ServeHTTP находит маршрут и прогоняет запрос через middleware,
+//маршрут к этому моменту уже лежит в контексте запроса. Путь делится на
+//сегменты до раскодирования, так что %2F остаётся внутри сегмента
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	raw := splitPath(r.URL.EscapedPath())
+	segments := make([]string, len(raw))
+	for i, segment := range raw {
+		var err error
+		if segments[i], err = url.PathUnescape(segment); err != nil {
+			segments[i] = segment
+		}
+	}
+	m := &routeMatch{method: r.Method, allowed: make(map[string]bool)}
+	found := rt.root.lookup(segments, raw, make([]string, 0, 4), m)
+
+	var handler http.Handler
+	switch {
+	case found:
+		r = r.WithContext(context.WithValue(r.Context(), routeKey, m.route.info))
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.route.handler(w, r, m.params)
+		})
+	case len(m.allowed) != 0 && r.Method == http.MethodOptions:
+		allow := allowHeader(m.allowed)
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+		})
+	case len(m.allowed) != 0:
+		allow := allowHeader(m.allowed)
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", allow)
+			writeError(w, APIError{http.StatusMethodNotAllowed,
+				fmt.Errorf("method not allowed")})
+		})
+	default:
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, APIError{http.StatusNotFound, fmt.Errorf("not found")})
+		})
+	}
+
+	for i := len(rt.middlewares) - 1; i >= 0; i-- {
+		handler = rt.middlewares[i](handler)
+	}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//columnSchema метаданные столбца в том виде, в каком их отдаёт /{table}/_schema
+func columnSchema(info *Column) map[string]interface{} {
+	ct := info.columnType()
+	res := map[string]interface{}{
+		"field":   info.Field,
+		"type":    info.Type,
+		"null":    info.Null,
+		"key":     info.Key,
+		"default": info.Default,
+		"extra":   info.Extra,
+		"kind":    ct.Kind.String(),
+	}
+	if ct.Length != 0 {
+		res["length"] = ct.Length
+	}
+	if ct.Kind == KindEnum {
+		res["enum"] = ct.Enum
+	}
+	return res
+}
+
+//tableSchema отдаёт метаданные столбцов таблицы
+func (dbex *DBExplorer) tableSchema(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	tableName := params["table"]
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	tp, err := dbex.checkRead(sc, req, tableName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	columns := make([]map[string]interface{}, 0, len(tableInfo))
+	for _, info := range tp.visible(tableInfo) {
+		columns = append(columns, columnSchema(info))
+	}
+	keys := make([]string, 0, 1)
+	for _, key := range primaryKeys(tableInfo) {
+		keys = append(keys, key.Field)
+	}
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": map[string]interface{}{
+			"table":       tableName,
+			"primary_key": keys,
+			"columns":     columns}})
+	w.Write(jsonRes)
+}
+
+//openAPI отдаёт описание маршрутов, доступных пользователю, в формате OpenAPI 3
+func (dbex *DBExplorer) openAPI(w http.ResponseWriter, req *http.Request) {
+	jsonRes, _ := json.Marshal(dbex.openAPIDocument(req))
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jsonRes)
+}
+
+//schemaRef ссылка на схему из components
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+//envelope оборачивает схему ответа в {"response": ...}
+func envelope(properties map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"response": map[string]interface{}{
+				"type":       "object",
+				"properties": properties,
+			},
+		},
+	}
+}
+
+//propertySchema JSON-схема значения столбца
+func propertySchema(info *Column) map[string]interface{} {
+	ct := info.columnType()
+	prop := make(map[string]interface{})
+	switch ct.Kind {
+	case KindInt:
+		prop["type"] = "integer"
+		prop["format"] = "int64"
+		if ct.Bits <= 32 && !ct.Unsigned {
+			prop["format"] = "int32"
+		}
+		if ct.Unsigned {
+			prop["minimum"] = 0
+		}
+	case KindFloat:
+		prop["type"] = "number"
+		prop["format"] = "double"
+	case KindDecimal:
+		prop["type"] = "number"
+	case KindBool:
+		prop["type"] = "boolean"
+	case KindDate:
+		prop["type"] = "string"
+		prop["format"] = "date"
+	case KindTime:
+		prop["type"] = "string"
+		prop["format"] = "date-time"
+	case KindEnum:
+		prop["type"] = "string"
+		prop["enum"] = ct.Enum
+	case KindJSON:
+		//в json-столбце может лежать что угодно
+	case KindBlob:
+		prop["type"] = "string"
+		prop["format"] = "byte"
+	default:
+		prop["type"] = "string"
+		if ct.Length != 0 {
+			prop["maxLength"] = ct.Length
+		}
+	}
+	if info.Null == "YES" {
+		prop["nullable"] = true
+	}
+	return prop
+}
+
+//tableSchemas схемы записи таблицы, тела запроса на её создание и тела
+//PATCH: в нём все поля необязательны, а ключ не меняется.
+//access - права пользователя на таблицу вместе с ограничениями из Config
+func tableSchemas(tableInfo []*Column, access *TablePolicy) (map[string]interface{},
+	map[string]interface{}, map[string]interface{}) {
+	recordProps := make(map[string]interface{})
+	inputProps := make(map[string]interface{})
+	patchProps := make(map[string]interface{})
+	required := make([]string, 0)
+	for _, info := range tableInfo {
+		prop := propertySchema(info)
+		if !access.isHidden(info.Field) {
+			recordProps[info.Field] = prop
+		}
+		if !access.isWritable(info.Field) {
+			continue
+		}
+		if info.Key != "PRI" {
+			patchProps[info.Field] = prop
+		}
+		if info.Key == "PRI" && info.isAutoIncrement() {
+			continue
+		}
+		inputProps[info.Field] = prop
+		if info.Null != "YES" && info.Default == "" {
+			required = append(required, info.Field)
+		}
+	}
+
+	record := map[string]interface{}{
+		"type":       "object",
+		"properties": recordProps,
+	}
+	input := map[string]interface{}{
+		"type":       "object",
+		"properties": inputProps,
+	}
+	if len(required) != 0 {
+		input["required"] = required
+	}
+	patch := map[string]interface{}{
+		"type":       "object",
+		"properties": patchProps,
+	}
+	return record, input, patch
+}
+
+//pathParameters параметры пути вида {id} из шаблона URL
+func pathParameters(url string) []map[string]interface{} {
+	params := make([]map[string]interface{}, 0)
+	for _, part := range strings.Split(url, "/") {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			continue
+		}
+		//ограничения {id:int} и хвост {path...} в OpenAPI не передаются
+		name := strings.TrimSuffix(part[1:len(part)-1], "...")
+		if idx := strings.Index(name, ":"); idx != -1 {
+			name = name[:idx]
+		}
+		param := map[string]interface{}{
+			"name":     name,
+			"in":       "path",
+			"required": true,
+			"schema":   map[string]interface{}{"type": "string"},
+		}
+		if name == "id" {
+			param["description"] = "primary key, части составного ключа через запятую"
+		}
+		params = append(params, param)
+	}
+	return params
+}
+
+//queryParameters параметры строки запроса для листинга
+func queryParameters(names ...string) []map[string]interface{} {
+	params := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		params = append(params, map[string]interface{}{
+			"name":   name,
+			"in":     "query",
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	return params
+}
+
+//routeOperation описание операции маршрута route для таблицы table
+func routeOperation(route *RouteInfo, table string) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary": route.Method + " " + route.URL,
+	}
+	if table != "" {
+		op["tags"] = []string{table}
+	}
+	if legacyRoutes[route.Method+" "+route.URL] {
+		op["deprecated"] = true
+	}
+
+	ok := func(schema map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "OK",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schema},
+				},
+			},
+			"default": map[string]interface{}{
+				"description": "error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": schemaRef("Error")},
+				},
+			},
+		}
+	}
+	body := func(schema map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": schema},
+			},
+		}
+	}
+	records := map[string]interface{}{
+		"type":  "array",
+		"items": schemaRef(table),
+	}
+	count := map[string]interface{}{"type": "integer"}
+	listParams := queryParameters("limit", "offset", "cursor", "total",
+		"where", "order", "fields", "expand", "include_deleted")
+
+	switch route.Method + " " + route.URL {
+	case "GET /":
+		op["summary"] = "list tables"
+		op["responses"] = ok(envelope(map[string]interface{}{
+			"tables": map[string]interface{}{
+				"type": "array", "items": map[string]interface{}{"type": "string"}},
+		}))
+	case "GET /{table}", "GET /{table}/{id}/{related}":
+		op["summary"] = "list records of " + table
+		op["parameters"] = listParams
+		op["responses"] = ok(envelope(map[string]interface{}{
+			"records":     records,
+			"total":       count,
+			"next_cursor": map[string]interface{}{"type": "string", "nullable": true},
+		}))
+	case "GET /{table}/{id}":
+		op["summary"] = "get record of " + table
+		op["parameters"] = queryParameters("expand", "include_deleted")
+		op["responses"] = ok(envelope(map[string]interface{}{
+			"record": schemaRef(table),
+		}))
+	case "POST /{table}", "PUT /{table}/":
+		op["summary"] = "create record in " + table
+		op["requestBody"] = body(schemaRef(table + "_input"))
+		op["responses"] = ok(envelope(map[string]interface{}{}))
+	case "PATCH /{table}/{id}", "POST /{table}/{id}":
+		op["summary"] = "update record of " + table
+		op["requestBody"] = body(schemaRef(table + "_patch"))
+		op["responses"] = ok(envelope(map[string]interface{}{"updated": count}))
+	case "PUT /{table}/{id}":
+		op["summary"] = "create or replace record of " + table
+		op["requestBody"] = body(schemaRef(table + "_input"))
+		responses := ok(envelope(map[string]interface{}{
+			"created": map[string]interface{}{"type": "boolean"}}))
+		//201 - записи не было и она создана, 200 - обновлена
+		created := make(map[string]interface{})
+		for key, value := range responses["200"].(map[string]interface{}) {
+			created[key] = value
+		}
+		created["description"] = "Created"
+		responses["201"] = created
+		op["responses"] = responses
+	case "DELETE /{table}/{id}":
+		op["summary"] = "delete record of " + table
+		op["responses"] = ok(envelope(map[string]interface{}{"deleted": count}))
+	case "GET /{table}/_aggregate":
+		op["summary"] = "aggregate records of " + table
+		op["parameters"] = queryParameters("group_by", "count", "sum", "avg",
+			"min", "max", "where", "limit", "include_deleted")
+		op["responses"] = ok(envelope(map[string]interface{}{
+			"records": map[string]interface{}{
+				"type": "array", "items": map[string]interface{}{"type": "object"}},
+		}))
+	case "POST /_query":
+		op["summary"] = "run read-only SELECT"
+		op["requestBody"] = body(map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"sql":   map[string]interface{}{"type": "string"},
+				"args":  map[string]interface{}{"type": "array", "items": map[string]interface{}{}},
+				"limit": count,
+			},
+			"required": []string{"sql"},
+		})
+		op["responses"] = ok(envelope(map[string]interface{}{
+			"columns": map[string]interface{}{
+				"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"records":   map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}},
+			"truncated": map[string]interface{}{"type": "boolean"},
+		}))
+	case "GET /_cache":
+		op["summary"] = "response cache stats"
+		op["responses"] = ok(envelope(map[string]interface{}{
+			"hits":          count,
+			"misses":        count,
+			"evictions":     count,
+			"invalidations": count,
+			"entries":       count,
+			"bytes":         count,
+			"max_bytes":     count,
+		}))
+	case "GET /_graphql":
+		op["summary"] = "GraphQL schema in SDL"
+		op["responses"] = map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "schema available to the role",
+				"content": map[string]interface{}{
+					"text/plain": map[string]interface{}{},
+				},
+			},
+		}
+	case "POST /_graphql":
+		op["summary"] = "run GraphQL query or mutation"
+		op["requestBody"] = body(map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"query":         map[string]interface{}{"type": "string"},
+				"operationName": map[string]interface{}{"type": "string"},
+				"variables":     map[string]interface{}{"type": "object"},
+			},
+			"required": []string{"query"},
+		})
+		op["responses"] = ok(map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"data":   map[string]interface{}{"type": "object"},
+				"errors": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}},
+			},
+		})
+	case "GET /{table}/_changes":
+		op["summary"] = "stream changes of " + table
+		op["parameters"] = queryParameters("last_event_id")
+		op["responses"] = map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "Server-Sent Events: created, updated, deleted, reset",
+				"content": map[string]interface{}{
+					"text/event-stream": map[string]interface{}{},
+				},
+			},
+		}
+	case "POST /{table}/{id}/_restore":
+		op["summary"] = "restore deleted record of " + table
+		op["responses"] = ok(envelope(map[string]interface{}{"restored": count}))
+	case "GET /{table}/{id}/_history":
+		op["summary"] = "change history of " + table + " record"
+		op["responses"] = ok(envelope(map[string]interface{}{
+			"history": map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"type": "object"},
+			},
+		}))
+	case "GET /{table}/_export":
+		op["summary"] = "export records of " + table
+		op["parameters"] = queryParameters("format", "where", "order", "fields")
+		op["responses"] = map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "CSV или NDJSON",
+				"content": map[string]interface{}{
+					"text/csv":             map[string]interface{}{},
+					"application/x-ndjson": map[string]interface{}{},
+				},
+			},
+		}
+	case "POST /{table}/_import":
+		op["summary"] = "import records into " + table
+		op["parameters"] = queryParameters("format", "batch")
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"text/csv":             map[string]interface{}{},
+				"application/x-ndjson": map[string]interface{}{},
+			},
+		}
+		op["responses"] = ok(envelope(map[string]interface{}{
+			"inserted": count,
+			"failed":   count,
+			"aborted":  map[string]interface{}{"type": "boolean"},
+			"errors": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"line":  count,
+						"error": map[string]interface{}{"type": "string"},
+					},
+				},
+			},
+		}))
+	default:
+		op["responses"] = ok(map[string]interface{}{"type": "object"})
+	}
+	return op
+}
+
+//adminRoutes служебные маршруты, которые может вызывать только admin
+var adminRoutes = map[string]bool{
+	"POST /_reload": true,
+	"POST /_query":  true,
+	"GET /_cache":   true,
+}
+
+//openAPIDocument собирает OpenAPI-документ по маршрутам роутера, подставляя
+//в шаблоны с {table} каждую таблицу. Как и в схеме GraphQL, в документ
+//попадает только то, что доступно пользователю: таблицы, которые он может
+//читать или менять, изменения - только при праве на запись, столбцы - без
+//скрытых для него
+func (dbex *DBExplorer) openAPIDocument(req *http.Request) map[string]interface{} {
+	sc := dbex.schema()
+	tables := make([]string, 0, len(sc.tablesInfo))
+	policies := make(map[string]*TablePolicy, len(sc.tablesInfo))
+	for tableName := range sc.tablesInfo {
+		tp := dbex.tablePolicy(sc, req, tableName)
+		if tp.Read || tp.Write {
+			tables = append(tables, tableName)
+			policies[tableName] = tp
+		}
+	}
+	sort.Strings(tables)
+	//allowed можно ли пользователю вызвать маршрут route для таблицы
+	allowed := func(route *RouteInfo, tableName string) bool {
+		tp := policies[tableName]
+		if tp == nil {
+			return false
+		}
+		if route.Method == http.MethodGet {
+			return tp.Read
+		}
+		return tp.Write
+	}
+
+	schemas := map[string]interface{}{
+		"Error": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"error": map[string]interface{}{"type": "string"},
+				"code":  map[string]interface{}{"type": "string"},
+			},
+		},
+	}
+	for _, tableName := range tables {
+		tp := policies[tableName]
+		record, input, patch := tableSchemas(sc.tablesInfo[tableName], tp)
+		if tp.Read {
+			schemas[tableName] = record
+		}
+		if tp.Write {
+			schemas[tableName+"_input"] = input
+			schemas[tableName+"_patch"] = patch
+		}
+	}
+
+	paths := make(map[string]map[string]interface{})
+	addPath := func(path string, route *RouteInfo, op map[string]interface{}) {
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		if params := pathParameters(path); len(params) != 0 {
+			op["parameters"] = append(params, opParameters(op)...)
+		}
+		paths[path][strings.ToLower(route.Method)] = op
+	}
+
+	for _, route := range dbex.router.Routes() {
+		//HTML-страницы админки в описание JSON API не входят
+		if strings.HasPrefix(route.URL, "/_ui") {
+			continue
+		}
+		if legacyRoutes[route.Method+" "+route.URL] && !dbex.LegacyRoutes {
+			continue
+		}
+		if !strings.Contains(route.URL, "{table}") {
+			if !adminRoutes[route.Method+" "+route.URL] || dbex.isAdmin(req) {
+				addPath(route.URL, route, routeOperation(route, ""))
+			}
+			continue
+		}
+
+		for _, tableName := range tables {
+			if !allowed(route, tableName) {
+				continue
+			}
+			path := strings.Replace(route.URL, "{table}", tableName, -1)
+			if !strings.Contains(path, "{related}") {
+				addPath(path, route, routeOperation(route, tableName))
+				continue
+			}
+
+			//обратные связи раскрываются по таблицам, которые ссылаются на эту
+			for _, related := range tables {
+				if !allowed(route, related) {
+					continue
+				}
+				for _, fk := range sc.foreignKeys[related] {
+					if fk.RefTable == tableName {
+						addPath(strings.Replace(path, "{related}", related, -1),
+							route, routeOperation(route, related))
+						break
+					}
+				}
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "DBExplorer",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+		},
+	}
+}
+
+//opParameters уже заданные у операции параметры
+func opParameters(op map[string]interface{}) []map[string]interface{} {
+	params, _ := op["parameters"].([]map[string]interface{})
+	return params
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+//softDeleteColumn столбец мягкого удаления таблицы, nil - записи удаляются
+//физически. Подходит nullable-столбец SoftDeleteColumn с датой или строкой
+func (dbex *DBExplorer) softDeleteColumn(tableInfo []*Column) *Column {
+	if dbex.SoftDeleteColumn == "" {
+		return nil
+	}
+	info := findDBColumn(tableInfo, dbex.SoftDeleteColumn)
+	if info == nil || info.Null != "YES" {
+		return nil
+	}
+	switch info.columnType().Kind {
+	case KindTime, KindDate, KindString:
+		return info
+	}
+	return nil
+}
+
+//includeDeleted ?include_deleted=1 - показывать мягко удалённые записи
+func includeDeleted(query url.Values) bool {
+	return query.Get("include_deleted") == "1"
+}
+
+//hideDeleted отсекает в выборке мягко удалённые записи
+func (dbex *DBExplorer) hideDeleted(lq *listQuery, tableInfo []*Column,
+	query url.Values) {
+	column := dbex.softDeleteColumn(tableInfo)
+	if column == nil || includeDeleted(query) {
+		return
+	}
+	lq.where = append(lq.where, dbex.dialect.Quote(column.dbName())+" IS NULL")
+}
+
+//isDeleted запись мягко удалена
+func (dbex *DBExplorer) isDeleted(tableInfo []*Column,
+	record map[string]interface{}) bool {
+	column := dbex.softDeleteColumn(tableInfo)
+	return column != nil && record[column.Field] != nil
+}
+
+//restoreRecord POST /{table}/{id}/_restore - вернуть мягко удалённую запись
+func (dbex *DBExplorer) restoreRecord(w http.ResponseWriter, r *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	if err := dbex.checkWrite(sc, r, params["table"], nil); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	res, err := dbex.changeRecord(sc, r, params["table"], params["id"], "restore",
+		func(db sqlExecutor) (map[string]interface{}, error) {
+			return dbex.undeleteRecord(sc, db, params["table"], params["id"])
+		})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	recordRows(w, res["restored"].(int64))
+	dbex.setETag(w, r, sc, params["table"], params["id"])
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": res})
+	w.Write(jsonRes)
+}
+
+//undeleteRecord снимает отметку об удалении с записи id
+func (dbex *DBExplorer) undeleteRecord(sc *dbSchema, db sqlExecutor, tableName string,
+	id string) (map[string]interface{}, error) {
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		return nil, APIError{http.StatusNotFound, fmt.Errorf("unknown table")}
+	}
+	column := dbex.softDeleteColumn(tableInfo)
+	if column == nil {
+		return nil, APIError{http.StatusBadRequest,
+			fmt.Errorf("table has no soft delete")}
+	}
+
+	args := &sqlArgs{dialect: dbex.dialect}
+	cond, err := dbex.keyCondition(tableInfo, id, args)
+	if err != nil {
+		return nil, err
+	}
+	deletedAt := dbex.dialect.Quote(column.dbName())
+	result, err := db.Exec("UPDATE "+dbex.quoteTable(sc, tableName)+
+		" SET "+deletedAt+" = NULL WHERE "+cond+" AND "+deletedAt+" IS NOT NULL",
+		args.values...)
+	if err != nil {
+		return nil, err
+	}
+
+	restored, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"restored": restored}, nil
+}
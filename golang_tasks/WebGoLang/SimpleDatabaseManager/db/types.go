@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//TypeKind семейство типа столбца
+type TypeKind int
+
+//Семейства типов, к которым сводятся типы разных СУБД
+const (
+	KindString TypeKind = iota
+	KindInt
+	KindFloat
+	KindDecimal
+	KindBool
+	KindDate
+	KindTime
+	KindEnum
+	KindJSON
+	KindBlob
+)
+
+var kindNames = map[TypeKind]string{
+	KindString:  "string",
+	KindInt:     "int",
+	KindFloat:   "float",
+	KindDecimal: "decimal",
+	KindBool:    "bool",
+	KindDate:    "date",
+	KindTime:    "time",
+	KindEnum:    "enum",
+	KindJSON:    "json",
+	KindBlob:    "blob",
+}
+
+func (k TypeKind) String() string {
+	return kindNames[k]
+}
+
+//ColumnType разобранный Column.Type
+type ColumnType struct {
+	Kind TypeKind
+	//Length максимальная длина строки в символах, 0 - без ограничения
+	Length int
+	//Bits разрядность целого типа
+	Bits     int
+	Unsigned bool
+	//Precision и Scale для decimal(Precision,Scale)
+	Precision int
+	Scale     int
+	Enum      []string
+}
+
+//intBits разрядность целых типов
+var intBits = map[string]int{
+	"tinyint":   8,
+	"smallint":  16,
+	"mediumint": 24,
+	"int":       32,
+	"year":      16,
+	//integer встречается только в SQLite, где он 64-битный
+	"integer": 64,
+	"bigint":  64,
+	"serial":  64,
+}
+
+//textLengths ограничения текстовых типов без явной длины
+var textLengths = map[string]int{
+	"tinytext":   255,
+	"text":       65535,
+	"mediumtext": 16777215,
+	"longtext":   0,
+}
+
+//parseColumnType разбирает строку вида "bigint(20) unsigned" или
+//"enum('a','b')" в ColumnType
+func parseColumnType(columnType string) *ColumnType {
+	t := strings.ToLower(strings.TrimSpace(columnType))
+	ct := &ColumnType{}
+
+	if strings.HasSuffix(t, " zerofill") {
+		t = strings.TrimSuffix(t, " zerofill")
+	}
+	if strings.HasSuffix(t, " unsigned") {
+		ct.Unsigned = true
+		t = strings.TrimSuffix(t, " unsigned")
+	}
+
+	name, args := t, ""
+	if idx := strings.Index(t, "("); idx != -1 && strings.HasSuffix(t, ")") {
+		name, args = t[:idx], t[idx+1:len(t)-1]
+	}
+	name = strings.TrimSpace(name)
+
+	switch {
+	case name == "bool" || name == "boolean" || (name == "tinyint" && args == "1"):
+		ct.Kind = KindBool
+	case intBits[name] != 0:
+		ct.Kind = KindInt
+		ct.Bits = intBits[name]
+	case name == "float" || name == "double" || name == "real" ||
+		name == "double precision":
+		ct.Kind = KindFloat
+	case name == "decimal" || name == "numeric":
+		ct.Kind = KindDecimal
+		ct.Precision, ct.Scale = 65, 0
+		parts := strings.Split(args, ",")
+		if p, err := strconv.Atoi(strings.TrimSpace(parts[0])); err == nil {
+			ct.Precision = p
+		}
+		if len(parts) > 1 {
+			if s, err := strconv.Atoi(strings.TrimSpace(parts[1])); err == nil {
+				ct.Scale = s
+			}
+		}
+	case name == "date":
+		ct.Kind = KindDate
+	case name == "datetime" || strings.HasPrefix(name, "timestamp"):
+		ct.Kind = KindTime
+	case name == "enum":
+		ct.Kind = KindEnum
+		ct.Enum = parseEnumValues(args)
+	case name == "json" || name == "jsonb":
+		ct.Kind = KindJSON
+	case strings.HasSuffix(name, "blob") || name == "binary" ||
+		name == "varbinary" || name == "bytea":
+		ct.Kind = KindBlob
+		ct.Length, _ = strconv.Atoi(args)
+	case name == "char" || name == "varchar" || name == "character":
+		ct.Kind = KindString
+		ct.Length, _ = strconv.Atoi(args)
+	default:
+		ct.Kind = KindString
+		ct.Length = textLengths[name]
+	}
+	return ct
+}
+
+//parseEnumValues разбирает 'a','b','it''s' из enum(...)
+func parseEnumValues(args string) []string {
+	values := make([]string, 0)
+	inQuote := false
+	cur := strings.Builder{}
+	for i := 0; i < len(args); i++ {
+		c := args[i]
+		switch {
+		case c == '\'' && inQuote && i+1 < len(args) && args[i+1] == '\'':
+			cur.WriteByte('\'')
+			i++
+		case c == '\'':
+			if inQuote {
+				values = append(values, cur.String())
+				cur.Reset()
+			}
+			inQuote = !inQuote
+		case inQuote:
+			cur.WriteByte(c)
+		}
+	}
+	return values
+}
+
+//columnType возвращает разобранный тип столбца
+func (c *Column) columnType() *ColumnType {
+	if c.typ != nil {
+		return c.typ
+	}
+	return parseColumnType(c.Type)
+}
+
+//intRange допустимые значения целого типа
+func (ct *ColumnType) intRange() (*big.Int, *big.Int) {
+	bits := uint(ct.Bits)
+	if ct.Unsigned {
+		max := new(big.Int).Lsh(big.NewInt(1), bits)
+		return big.NewInt(0), max.Sub(max, big.NewInt(1))
+	}
+	max := new(big.Int).Lsh(big.NewInt(1), bits-1)
+	min := new(big.Int).Neg(max)
+	return min, max.Sub(max, big.NewInt(1))
+}
+
+//timeLayouts форматы, в которых СУБД отдают дату и время
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s", s)
+}
+
+//decodeValue приводит значение, прочитанное из базы, к виду для JSON-ответа
+func decodeValue(rec interface{}, ct *ColumnType) (interface{}, error) {
+	if rec == nil {
+		return nil, nil
+	}
+	if b, ok := rec.([]byte); ok && ct.Kind != KindBlob {
+		rec = string(b)
+	}
+
+	switch ct.Kind {
+	case KindInt:
+		if s, ok := rec.(string); ok {
+			if ct.Unsigned {
+				return strconv.ParseUint(s, 10, 64)
+			}
+			return strconv.ParseInt(s, 10, 64)
+		}
+	case KindFloat:
+		if s, ok := rec.(string); ok {
+			return strconv.ParseFloat(s, 64)
+		}
+	case KindDecimal:
+		switch x := rec.(type) {
+		case string:
+			if _, err := strconv.ParseFloat(x, 64); err != nil {
+				return nil, err
+			}
+			return json.Number(x), nil
+		case float64:
+			return json.Number(strconv.FormatFloat(x, 'f', -1, 64)), nil
+		case int64:
+			return json.Number(strconv.FormatInt(x, 10)), nil
+		}
+	case KindBool:
+		switch x := rec.(type) {
+		case int64:
+			return x != 0, nil
+		case string:
+			return x == "1" || x == "t" || x == "true", nil
+		}
+	case KindTime, KindDate:
+		layout := time.RFC3339
+		if ct.Kind == KindDate {
+			layout = "2006-01-02"
+		}
+		switch x := rec.(type) {
+		case time.Time:
+			return x.Format(layout), nil
+		case string:
+			//нулевые даты MySQL и прочее непарсящееся отдаём как есть
+			if t, err := parseTime(x); err == nil {
+				return t.Format(layout), nil
+			}
+			return x, nil
+		}
+	case KindJSON:
+		if s, ok := rec.(string); ok && json.Valid([]byte(s)) {
+			return json.RawMessage(s), nil
+		}
+	case KindBlob:
+		//[]byte при маршалинге в JSON превращается в base64
+		if s, ok := rec.(string); ok {
+			return []byte(s), nil
+		}
+	}
+	return rec, nil
+}
+
+//validateValue проверяет значение из JSON-запроса и приводит его
+//к виду, который можно передать в database/sql
+func validateValue(field interface{}, info *Column) (interface{}, error) {
+	ct := info.columnType()
+	invalidType := fmt.Errorf("field %s have invalid type", info.Field)
+
+	if field == nil {
+		if info.Null != "YES" {
+			return nil, invalidType
+		}
+		return nil, nil
+	}
+
+	if ct.Kind == KindJSON {
+		data, err := json.Marshal(field)
+		if err != nil {
+			return nil, invalidType
+		}
+		return string(data), nil
+	}
+
+	//числа приходят как float64 или как json.Number при UseNumber
+	if x, ok := field.(float64); ok {
+		field = json.Number(strconv.FormatFloat(x, 'f', -1, 64))
+	}
+
+	switch x := field.(type) {
+	case string:
+		switch ct.Kind {
+		case KindString:
+			if ct.Length != 0 && utf8.RuneCountInString(x) > ct.Length {
+				return nil, fmt.Errorf("field %s is too long", info.Field)
+			}
+			return x, nil
+		case KindEnum:
+			for _, v := range ct.Enum {
+				if v == x {
+					return x, nil
+				}
+			}
+			return nil, fmt.Errorf("field %s is not in enum", info.Field)
+		case KindTime:
+			t, err := parseTime(x)
+			if err != nil {
+				return nil, invalidType
+			}
+			return t.UTC().Format("2006-01-02 15:04:05"), nil
+		case KindDate:
+			t, err := time.Parse("2006-01-02", x)
+			if err != nil {
+				return nil, invalidType
+			}
+			return t.Format("2006-01-02"), nil
+		case KindBlob:
+			data, err := base64.StdEncoding.DecodeString(x)
+			if err != nil {
+				return nil, invalidType
+			}
+			if ct.Length != 0 && len(data) > ct.Length {
+				return nil, fmt.Errorf("field %s is too long", info.Field)
+			}
+			return data, nil
+		case KindDecimal:
+			return validateDecimal(x, info, ct)
+		}
+	case json.Number:
+		switch ct.Kind {
+		case KindInt:
+			n, ok := new(big.Int).SetString(x.String(), 10)
+			if !ok {
+				return nil, invalidType
+			}
+			min, max := ct.intRange()
+			if n.Cmp(min) < 0 || n.Cmp(max) > 0 {
+				return nil, fmt.Errorf("field %s is out of range", info.Field)
+			}
+			if ct.Unsigned {
+				return n.Uint64(), nil
+			}
+			return n.Int64(), nil
+		case KindFloat:
+			v, err := x.Float64()
+			if err != nil || math.IsInf(v, 0) {
+				return nil, invalidType
+			}
+			return v, nil
+		case KindDecimal:
+			return validateDecimal(x.String(), info, ct)
+		case KindBool:
+			if x == "0" || x == "1" {
+				return x == "1", nil
+			}
+		}
+	case bool:
+		if ct.Kind == KindBool {
+			return x, nil
+		}
+	}
+	return nil, invalidType
+}
+
+//validateDecimal проверяет, что число влезает в decimal(Precision,Scale)
+func validateDecimal(s string, info *Column, ct *ColumnType) (interface{}, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("field %s have invalid type", info.Field)
+	}
+
+	//FloatString с лишним знаком покажет, влезает ли дробная часть в Scale
+	str := strings.TrimPrefix(r.FloatString(ct.Scale+1), "-")
+	dot := strings.Index(str, ".")
+	intPart := strings.TrimLeft(str[:dot], "0")
+	fracPart := strings.TrimRight(str[dot+1:], "0")
+	if len(fracPart) > ct.Scale || len(intPart) > ct.Precision-ct.Scale {
+		return nil, fmt.Errorf("field %s is out of range", info.Field)
+	}
+	return r.FloatString(ct.Scale), nil
+}
+
+//parseQueryValue приводит значение из строки запроса к типу столбца
+func parseQueryValue(value string, info *Column) (interface{}, error) {
+	ct := info.columnType()
+	invalidType := fmt.Errorf("field %s have invalid type", info.Field)
+	switch ct.Kind {
+	case KindInt:
+		if ct.Unsigned {
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, invalidType
+			}
+			return v, nil
+		}
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, invalidType
+		}
+		return v, nil
+	case KindFloat:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, invalidType
+		}
+		return v, nil
+	case KindDecimal:
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return nil, invalidType
+		}
+		return value, nil
+	case KindBool:
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, invalidType
+		}
+		return v, nil
+	case KindTime:
+		t, err := parseTime(value)
+		if err != nil {
+			return nil, invalidType
+		}
+		return t.UTC().Format("2006-01-02 15:04:05"), nil
+	}
+	return value, nil
+}
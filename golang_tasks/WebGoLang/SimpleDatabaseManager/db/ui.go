@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//uiFiles шаблоны админки, внешних файлов у неё нет
+//go:embed ui/*.html
+var uiFiles embed.FS
+
+//uiPageSize записей на странице таблицы
+const uiPageSize = 20
+
+//uiPageNames страницы админки, каждая разбирается вместе с общим layout
+var uiPageNames = []string{"tables", "grid", "form"}
+
+//isUIRoute запрос пришёл в админку
+func isUIRoute(req *http.Request) bool {
+	route := routeFrom(req.Context())
+	return route != nil && strings.HasPrefix(route.URL, "/_ui")
+}
+
+//csrfToken токен форм админки: HMAC того, кто вошёл, на DBExplorer.Secret.
+//Чужая страница его не знает и не может отправить форму от имени
+//браузера, который помнит пароль
+func (dbex *DBExplorer) csrfToken(req *http.Request) string {
+	mac := hmac.New(sha256.New, dbex.Secret)
+	mac.Write([]byte("csrf"))
+	if ident := identityFrom(req.Context()); ident != nil {
+		mac.Write([]byte("\x00" + ident.Subject + "\x00" + ident.Role))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//checkCSRF разбирает форму и сверяет её csrf_token
+func (dbex *DBExplorer) checkCSRF(req *http.Request) error {
+	if err := req.ParseForm(); err != nil {
+		return APIError{http.StatusBadRequest, fmt.Errorf("invalid form")}
+	}
+	token := req.PostForm.Get("csrf_token")
+	if !hmac.Equal([]byte(token), []byte(dbex.csrfToken(req))) {
+		return APIError{http.StatusForbidden, fmt.Errorf("invalid csrf token")}
+	}
+	return nil
+}
+
+//loadUI разбирает встроенные шаблоны страниц
+func loadUI() (map[string]*template.Template, error) {
+	layout, err := template.ParseFS(uiFiles, "ui/layout.html")
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[string]*template.Template, len(uiPageNames))
+	for _, page := range uiPageNames {
+		tmpl, err := layout.Clone()
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err = tmpl.ParseFS(uiFiles, "ui/"+page+".html")
+		if err != nil {
+			return nil, err
+		}
+		pages[page] = tmpl
+	}
+	return pages, nil
+}
+
+//apiResponse ответ хэндлера API, вызванного из админки без похода по сети
+type apiResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (ar *apiResponse) Header() http.Header {
+	return ar.header
+}
+
+func (ar *apiResponse) Write(data []byte) (int, error) {
+	if ar.status == 0 {
+		ar.status = http.StatusOK
+	}
+	return ar.body.Write(data)
+}
+
+func (ar *apiResponse) WriteHeader(status int) {
+	if ar.status == 0 {
+		ar.status = status
+	}
+}
+
+//callAPI выполняет хэндлер API в контексте запроса админки: с той же
+//аутентификацией, политикой доступа и таймаутами. Из заголовков запроса
+//условные заменяются на header. Возвращает содержимое response и
+//заголовки ответа или APIError с ошибкой из ответа
+func (dbex *DBExplorer) callAPI(req *http.Request, method string, path string,
+	query url.Values, body map[string]interface{}, header http.Header,
+	handler func(http.ResponseWriter, *http.Request, map[string]string),
+	params map[string]string) (map[string]interface{}, http.Header, error) {
+	sub := req.Clone(req.Context())
+	sub.Method = method
+	sub.URL = &url.URL{Path: path, RawQuery: query.Encode()}
+	sub.RequestURI = sub.URL.RequestURI()
+	for _, name := range []string{"If-Match", "If-None-Match", "Content-Type"} {
+		sub.Header.Del(name)
+	}
+	for name, values := range header {
+		sub.Header[name] = values
+	}
+	data, _ := json.Marshal(body)
+	sub.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	ar := &apiResponse{header: make(http.Header)}
+	handler(ar, sub, params)
+
+	result := make(map[string]interface{})
+	decoder := json.NewDecoder(&ar.body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&result); err != nil {
+		return nil, nil, err
+	}
+	if ar.status != http.StatusOK {
+		return nil, ar.header, APIError{ar.status, fmt.Errorf("%v", result["error"])}
+	}
+	response, _ := result["response"].(map[string]interface{})
+	return response, ar.header, nil
+}
+
+//uiError показывает ошибку API на странице, внутренние ошибки
+//отдаются обычным ответом 500
+func uiError(err error) string {
+	if ae, ok := err.(APIError); ok {
+		return ae.Err.Error()
+	}
+	return ""
+}
+
+//render отдаёт страницу админки
+func (dbex *DBExplorer) render(w http.ResponseWriter, page string, status int,
+	data interface{}) {
+	buf := &bytes.Buffer{}
+	if err := dbex.uiPages[page].ExecuteTemplate(buf, "layout", data); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+//uiRedirect GET /_ui - на список таблиц
+func (dbex *DBExplorer) uiRedirect(w http.ResponseWriter, req *http.Request) {
+	http.Redirect(w, req, "/_ui/", http.StatusMovedPermanently)
+}
+
+//uiTables GET /_ui/ - список таблиц
+func (dbex *DBExplorer) uiTables(w http.ResponseWriter, req *http.Request) {
+	res, _, err := dbex.callAPI(req, http.MethodGet, "/", nil, nil, nil,
+		func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+			dbex.tableList(w, r)
+		}, nil)
+	if uiError(err) == "" && err != nil {
+		writeError(w, err)
+		return
+	}
+
+	tables := make([]string, 0)
+	if list, ok := res["tables"].([]interface{}); ok {
+		for _, table := range list {
+			tables = append(tables, fmt.Sprint(table))
+		}
+	}
+	dbex.render(w, "tables", uiStatus(err), map[string]interface{}{
+		"Title":  "Tables",
+		"Error":  uiError(err),
+		"Tables": tables,
+	})
+}
+
+//uiStatus статус страницы: 200 или статус ошибки API
+func uiStatus(err error) int {
+	if ae, ok := err.(APIError); ok {
+		return ae.HTTPStatus
+	}
+	return http.StatusOK
+}
+
+//uiCell значение в ячейке таблицы
+type uiCell struct {
+	Text string
+	Null bool
+}
+
+//uiRow строка таблицы, ID - id записи в виде для URL формы
+type uiRow struct {
+	ID    string
+	Cells []*uiCell
+}
+
+//cellText значение из ответа API в виде текста
+func cellText(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case json.Number:
+		return x.String()
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(x)
+		return string(data)
+	}
+	return fmt.Sprint(v)
+}
+
+//gridPage данные страницы таблицы
+type gridPage struct {
+	Title   string
+	Error   string
+	Table   string
+	Columns []string
+	Keyed   bool
+	Rows    []*uiRow
+
+	Order       string
+	Operators   []string
+	WhereColumn string
+	WhereOp     string
+	WhereValue  string
+
+	From, To, Total int64
+	PrevURL         string
+	NextURL         string
+
+	query url.Values
+}
+
+//pageURL ссылка на страницу таблицы с изменёнными параметрами
+func (gp *gridPage) pageURL(set map[string]string) string {
+	query := url.Values{}
+	for key, values := range gp.query {
+		query[key] = values
+	}
+	for key, value := range set {
+		if value == "" {
+			query.Del(key)
+			continue
+		}
+		query.Set(key, value)
+	}
+	if len(query) == 0 {
+		return "/_ui/" + gp.Table
+	}
+	return "/_ui/" + gp.Table + "?" + query.Encode()
+}
+
+//SortURL ссылка, сортирующая по столбцу, повторный клик - в обратную сторону
+func (gp *gridPage) SortURL(column string) string {
+	order := column
+	if gp.Order == column {
+		order = "-" + column
+	}
+	return gp.pageURL(map[string]string{"order": order, "offset": ""})
+}
+
+//uiGrid GET /_ui/{table} - записи таблицы постранично через getListFrom.
+//Клик по заголовку сортирует по столбцу, фильтр по столбцу уходит в where
+func (dbex *DBExplorer) uiGrid(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	tableName := params["table"]
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	query := req.URL.Query()
+
+	gp := &gridPage{
+		Title:       tableName,
+		Table:       tableName,
+		Columns:     make([]string, 0),
+		Keyed:       len(primaryKeys(tableInfo)) != 0,
+		Rows:        make([]*uiRow, 0),
+		Order:       query.Get("order"),
+		Operators:   make([]string, 0, len(whereOperators)),
+		WhereColumn: query.Get("where_column"),
+		WhereOp:     query.Get("where_op"),
+		WhereValue:  query.Get("where_value"),
+		query:       url.Values{},
+	}
+	for op := range whereOperators {
+		gp.Operators = append(gp.Operators, op)
+	}
+	gp.Operators = append(gp.Operators, "null", "notnull")
+	sort.Strings(gp.Operators)
+	for _, info := range dbex.tablePolicy(sc, req, tableName).visible(tableInfo) {
+		gp.Columns = append(gp.Columns, info.Field)
+	}
+	for _, key := range []string{"order", "where_column", "where_op", "where_value"} {
+		if value := query.Get(key); value != "" {
+			gp.query.Set(key, value)
+		}
+	}
+
+	offset, _ := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if offset < 0 {
+		offset = 0
+	}
+	apiQuery := url.Values{
+		"limit":  {strconv.Itoa(uiPageSize)},
+		"offset": {strconv.FormatInt(offset, 10)},
+		"total":  {"1"},
+	}
+	if gp.Order != "" {
+		apiQuery.Set("order", gp.Order)
+	}
+	if gp.WhereColumn != "" && gp.WhereOp != "" {
+		apiQuery.Set("where", gp.WhereColumn+":"+gp.WhereOp+":"+gp.WhereValue)
+	}
+
+	res, _, err := dbex.callAPI(req, http.MethodGet, "/"+tableName, apiQuery, nil, nil,
+		dbex.getListFrom, params)
+	if err != nil && uiError(err) == "" {
+		writeError(w, err)
+		return
+	}
+	gp.Error = uiError(err)
+
+	records, _ := res["records"].([]interface{})
+	for _, item := range records {
+		record, _ := item.(map[string]interface{})
+		row := &uiRow{
+			ID:    recordID(tableInfo, record),
+			Cells: make([]*uiCell, 0, len(gp.Columns)),
+		}
+		for _, column := range gp.Columns {
+			v := record[column]
+			row.Cells = append(row.Cells, &uiCell{Text: cellText(v), Null: v == nil})
+		}
+		gp.Rows = append(gp.Rows, row)
+	}
+
+	if total, ok := res["total"].(json.Number); ok {
+		gp.Total, _ = total.Int64()
+	}
+	gp.From, gp.To = offset+1, offset+int64(len(gp.Rows))
+	if len(gp.Rows) == 0 {
+		gp.From = offset
+	}
+	if offset > 0 {
+		prev := offset - uiPageSize
+		if prev < 0 {
+			prev = 0
+		}
+		gp.PrevURL = gp.pageURL(map[string]string{"offset": strconv.FormatInt(prev, 10)})
+	}
+	if gp.To < gp.Total {
+		gp.NextURL = gp.pageURL(map[string]string{"offset": strconv.FormatInt(gp.To, 10)})
+	}
+	dbex.render(w, "grid", uiStatus(err), gp)
+}
+
+//uiField поле формы записи, построенное по метаданным столбца
+type uiField struct {
+	Name      string
+	Type      string
+	Input     string
+	Step      string
+	MaxLength int
+	Options   []string
+	Required  bool
+	Nullable  bool
+	ReadOnly  bool
+	WriteOnly bool
+	Value     string
+	Checked   bool
+
+	info *Column
+}
+
+//newUIField выбирает элемент формы по типу столбца, поле обязательно,
+//если у столбца нет ни NULL, ни DEFAULT, ни автоинкремента
+func newUIField(info *Column) *uiField {
+	field := &uiField{
+		Name:     info.Field,
+		Type:     info.Type,
+		Input:    "text",
+		Nullable: info.Null == "YES",
+		Required: info.Null != "YES" && info.Default == "" && !info.isAutoIncrement(),
+		info:     info,
+	}
+
+	ct := info.columnType()
+	switch ct.Kind {
+	case KindInt:
+		field.Input, field.Step = "number", "1"
+	case KindFloat, KindDecimal:
+		field.Input, field.Step = "number", "any"
+	case KindBool:
+		field.Input, field.Required = "checkbox", false
+	case KindDate:
+		field.Input = "date"
+	case KindTime:
+		field.Input, field.Step = "datetime-local", "1"
+	case KindEnum:
+		field.Input, field.Options = "select", ct.Enum
+	case KindJSON:
+		field.Input = "textarea"
+	case KindString:
+		if ct.Length == 0 || ct.Length > 255 {
+			field.Input = "textarea"
+		}
+		field.MaxLength = ct.Length
+	}
+	return field
+}
+
+//setValue подставляет в поле значение из ответа API
+func (field *uiField) setValue(v interface{}) {
+	if v == nil {
+		return
+	}
+	switch field.Input {
+	case "checkbox":
+		field.Checked = v == true
+	case "datetime-local":
+		if t, err := parseTime(cellText(v)); err == nil {
+			field.Value = t.UTC().Format("2006-01-02T15:04:05")
+			return
+		}
+		field.Value = cellText(v)
+	default:
+		field.Value = cellText(v)
+	}
+}
+
+//formValue значение поля из формы в том виде, в каком его ждёт API,
+//пустое значение nullable-поля - null. ok == false - поле не отправляется
+func (field *uiField) formValue(form url.Values) (interface{}, bool) {
+	if field.Input == "checkbox" {
+		return form.Get(field.Name) != "", true
+	}
+	value := form.Get(field.Name)
+	kind := field.info.columnType().Kind
+	if value == "" {
+		switch {
+		case field.WriteOnly:
+			//текущее значение не показывается, пустое поле его не меняет
+			return nil, false
+		case field.Nullable:
+			return nil, true
+		case kind == KindString:
+			return "", true
+		}
+		return nil, false
+	}
+
+	switch kind {
+	case KindInt, KindFloat, KindDecimal:
+		return json.Number(value), true
+	case KindTime:
+		//datetime-local отдаёт время без секунд, если они нулевые
+		if len(value) == len("2006-01-02T15:04") {
+			value += ":00"
+		}
+	case KindJSON:
+		var v interface{}
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err == nil {
+			return v, true
+		}
+	}
+	return value, true
+}
+
+//recordFields поля формы записи: без скрытых столбцов, ключ только для
+//чтения при редактировании и без автоинкремента при создании. Столбцы
+//только для записи показываются пустыми и при редактировании необязательны
+func (dbex *DBExplorer) recordFields(sc *dbSchema, req *http.Request, tableName string,
+	tableInfo []*Column, create bool) []*uiField {
+	tp := dbex.tablePolicy(sc, req, tableName)
+	fields := make([]*uiField, 0, len(tableInfo))
+	for _, info := range tableInfo {
+		if tp.isHidden(info.Field) && !tp.isWriteOnly(info.Field) {
+			continue
+		}
+		if create && info.Key == "PRI" && info.isAutoIncrement() {
+			continue
+		}
+		field := newUIField(info)
+		if tp.isWriteOnly(info.Field) {
+			field.WriteOnly = true
+			if field.info.columnType().Kind == KindString {
+				field.Input = "password"
+			}
+			if !create {
+				field.Required = false
+			}
+		}
+		if tp.isReadOnly(info.Field) || !create && info.Key == "PRI" {
+			field.ReadOnly, field.Required = true, false
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+//formBody тело запроса к API из отправленной формы
+func formBody(fields []*uiField, form url.Values) map[string]interface{} {
+	body := make(map[string]interface{})
+	for _, field := range fields {
+		if field.ReadOnly {
+			continue
+		}
+		if v, ok := field.formValue(form); ok {
+			body[field.Name] = v
+		}
+	}
+	return body
+}
+
+//uiForm GET и POST /_ui/{table}/_new и /_ui/{table}/{id} - форма записи,
+//отправка создаёт или обновляет запись через те же хэндлеры, что и API.
+//Обновление идёт с If-Match версии, которую показала форма, чтобы не
+//затереть чужие изменения
+func (dbex *DBExplorer) uiForm(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	tableName := params["table"]
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	id := params["id"]
+	create := id == ""
+	fields := dbex.recordFields(sc, req, tableName, tableInfo, create)
+	page := map[string]interface{}{
+		"Title":  tableName,
+		"Table":  tableName,
+		"ID":     id,
+		"Fields": fields,
+		"Error":  "",
+		"CSRF":   dbex.csrfToken(req),
+		"ETag":   "",
+	}
+	apiParams := map[string]string{"table": tableName, "id": id}
+
+	var err error
+	if req.Method == http.MethodPost {
+		if err := dbex.checkCSRF(req); err != nil {
+			writeError(w, err)
+			return
+		}
+		body := formBody(fields, req.PostForm)
+		if create {
+			_, _, err = dbex.callAPI(req, http.MethodPut, "/"+tableName+"/", nil, body, nil,
+				dbex.createRecord, apiParams)
+		} else {
+			etag := req.PostForm.Get("etag")
+			page["ETag"] = etag
+			_, _, err = dbex.callAPI(req, http.MethodPost, "/"+tableName+"/"+id, nil, body,
+				ifMatch(etag), dbex.updateRecord, apiParams)
+		}
+		if err == nil {
+			http.Redirect(w, req, "/_ui/"+tableName, http.StatusSeeOther)
+			return
+		}
+		//показываем форму снова с тем, что ввёл пользователь
+		for _, field := range fields {
+			switch {
+			case field.WriteOnly:
+				//пароли и прочее только для записи обратно не отдаются
+			case field.Input == "checkbox":
+				field.Checked = req.PostForm.Get(field.Name) != ""
+			default:
+				field.Value = req.PostForm.Get(field.Name)
+			}
+		}
+	} else if !create {
+		var res map[string]interface{}
+		var header http.Header
+		res, header, err = dbex.callAPI(req, http.MethodGet, "/"+tableName+"/"+id, nil, nil, nil,
+			dbex.getRecord, apiParams)
+		page["ETag"] = header.Get("ETag")
+		record, _ := res["record"].(map[string]interface{})
+		for _, field := range fields {
+			field.setValue(record[field.Name])
+		}
+	}
+
+	if err != nil && uiError(err) == "" {
+		writeError(w, err)
+		return
+	}
+	page["Error"] = uiError(err)
+	dbex.render(w, "form", uiStatus(err), page)
+}
+
+//ifMatch заголовок If-Match с версией записи из формы
+func ifMatch(etag string) http.Header {
+	if etag == "" {
+		return nil
+	}
+	return http.Header{"If-Match": {etag}}
+}
+
+//uiDelete POST /_ui/{table}/{id}/_delete - удаление записи из формы
+func (dbex *DBExplorer) uiDelete(w http.ResponseWriter, req *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	tableName := params["table"]
+	if _, ok := sc.tablesInfo[tableName]; !ok {
+		writeError(w, APIError{http.StatusNotFound, fmt.Errorf("unknown table")})
+		return
+	}
+	if err := dbex.checkCSRF(req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	_, _, err := dbex.callAPI(req, http.MethodDelete, "/"+tableName+"/"+params["id"],
+		nil, nil, ifMatch(req.PostForm.Get("etag")), dbex.deleteRecord, params)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	http.Redirect(w, req, "/_ui/"+tableName, http.StatusSeeOther)
+}
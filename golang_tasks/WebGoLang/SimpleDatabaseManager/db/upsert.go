@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+//legacyRoutes старые маршруты: создание через PUT /{table}/ и обновление
+//через POST /{table}/{id}. Работают, пока включён DBExplorer.LegacyRoutes
+var legacyRoutes = map[string]bool{
+	"PUT /{table}/":      true,
+	"POST /{table}/{id}": true,
+}
+
+//legacyEnabled включены ли старые маршруты. Проверяется на каждом
+//запросе: LegacyRoutes выставляют уже после NewDbExplorer
+func (dbex *DBExplorer) legacyEnabled() bool {
+	return dbex.LegacyRoutes
+}
+
+//legacyRoute старый маршрут, ответ помечается заголовком Deprecation
+func legacyRoute(
+	handler func(http.ResponseWriter, *http.Request, map[string]string),
+) func(http.ResponseWriter, *http.Request, map[string]string) {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		w.Header().Set("Deprecation", "true")
+		handler(w, r, params)
+	}
+}
+
+//mergePatch применяет JSON Merge Patch (RFC 7396): null удаляет ключ,
+//объекты сливаются рекурсивно, остальное заменяется целиком
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+			continue
+		}
+		targetObj[key] = mergePatch(targetObj[key], value)
+	}
+	return targetObj
+}
+
+//patchRecord PATCH /{table}/{id} - частичное обновление по JSON Merge Patch:
+//переданные столбцы меняются, null очищает nullable-столбец, объект
+//в JSON-столбце сливается с текущим значением
+func (dbex *DBExplorer) patchRecord(w http.ResponseWriter, r *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	bodyStrct, err := readBody(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := dbex.checkWrite(sc, r, params["table"], bodyStrct); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	res, err := dbex.changeRecord(sc, r, params["table"], params["id"], "update",
+		func(db sqlExecutor) (map[string]interface{}, error) {
+			return dbex.mergeRecord(sc, db, params["table"], params["id"], bodyStrct)
+		})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	recordRows(w, res["updated"].(int64))
+	dbex.setETag(w, r, sc, params["table"], params["id"])
+
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": res})
+	w.Write(jsonRes)
+}
+
+//mergeRecord сливает объекты из patch с текущими значениями
+//JSON-столбцов и обновляет запись через modifyRecord
+func (dbex *DBExplorer) mergeRecord(sc *dbSchema, db sqlExecutor, tableName string, id string,
+	patch map[string]interface{}) (map[string]interface{}, error) {
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		return nil, APIError{http.StatusNotFound, fmt.Errorf("unknown table")}
+	}
+
+	var current map[string]interface{}
+	for _, info := range tableInfo {
+		value, ok := patch[info.Field].(map[string]interface{})
+		if !ok || info.columnType().Kind != KindJSON {
+			continue
+		}
+		if current == nil {
+			record, err := dbex.fetchRecord(sc, db, tableName, tableInfo, id, true)
+			if err != nil {
+				return nil, err
+			}
+			if record == nil {
+				return map[string]interface{}{"updated": int64(0)}, nil
+			}
+			current = record
+		}
+
+		var old interface{}
+		if raw, ok := current[info.Field].(json.RawMessage); ok {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.UseNumber()
+			if err := decoder.Decode(&old); err != nil {
+				return nil, err
+			}
+		}
+		patch[info.Field] = mergePatch(old, value)
+	}
+	return dbex.modifyRecord(sc, db, tableName, id, patch)
+}
+
+//putRecord PUT /{table}/{id} - создание записи с ключом из URL или
+//обновление переданных в теле столбцов существующей, мягко удалённая
+//запись при этом восстанавливается. Новая запись - 201, существующая - 200.
+//Ключ в теле необязателен, но должен совпадать с URL
+func (dbex *DBExplorer) putRecord(w http.ResponseWriter, r *http.Request,
+	params map[string]string) {
+	sc := dbex.schema()
+	bodyStrct, err := readBody(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := dbex.checkWrite(sc, r, params["table"], bodyStrct); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	res, err := dbex.changeRecord(sc, r, params["table"], params["id"], "upsert",
+		func(db sqlExecutor) (map[string]interface{}, error) {
+			return dbex.upsertRecord(sc, db, params["table"], params["id"], bodyStrct)
+		})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	recordRows(w, 1)
+	dbex.setETag(w, r, sc, params["table"], params["id"])
+
+	if res["created"] == true {
+		w.WriteHeader(http.StatusCreated)
+	}
+	jsonRes, _ := json.Marshal(map[string]interface{}{
+		"response": res})
+	w.Write(jsonRes)
+}
+
+//sameKey совпадает ли проверенное значение ключа из тела со значением
+//из URL. Оба уже приведены к типу столбца, только decimal из тела
+//дополнен нулями до Scale, поэтому он сравнивается как число
+func sameKey(bodyKey interface{}, urlKey interface{}, key *Column) bool {
+	if key.columnType().Kind == KindDecimal {
+		a, okA := new(big.Rat).SetString(fmt.Sprint(bodyKey))
+		b, okB := new(big.Rat).SetString(fmt.Sprint(urlKey))
+		return okA && okB && a.Cmp(b) == 0
+	}
+	return reflect.DeepEqual(bodyKey, urlKey)
+}
+
+//upsertRecord вставляет запись id или обновляет существующую одним
+//INSERT с Dialect.Upsert, а если диалект так не умеет - заблокированная
+//запись обновляется через UPDATE. Обязательные поля те же, что
+//у insertRecord, столбцы, которых нет в теле, у существующей записи
+//не меняются. Выполняется в транзакции changeRecord
+func (dbex *DBExplorer) upsertRecord(sc *dbSchema, db sqlExecutor, tableName string, id string,
+	bodyStrct map[string]interface{}) (map[string]interface{}, error) {
+	tableInfo, ok := sc.tablesInfo[tableName]
+	if !ok {
+		return nil, APIError{http.StatusNotFound, fmt.Errorf("unknown table")}
+	}
+	keys, values, err := keyValues(tableInfo, id)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, 0, len(tableInfo))
+	keyNames := make([]string, 0, len(keys))
+	for i, key := range keys {
+		//ключ в теле необязателен, но если есть - должен совпадать с URL
+		if v, ok := bodyStrct[key.Field]; ok {
+			bodyKey, err := dbex.validateParametrs(v, key)
+			if err != nil || !sameKey(bodyKey, values[i], key) {
+				return nil, APIError{http.StatusBadRequest,
+					fmt.Errorf("field %s does not match id", key.Field)}
+			}
+		}
+		columns = append(columns, key.dbName())
+		keyNames = append(keyNames, key.dbName())
+	}
+
+	updates := make([]string, 0, len(tableInfo))
+	for _, info := range tableInfo {
+		if info.Key == "PRI" {
+			continue
+		}
+		newField, ok := bodyStrct[info.Field]
+		if !ok {
+			if info.Null != "YES" && info.Default == "" {
+				return nil, APIError{http.StatusBadRequest,
+					fmt.Errorf("field %s is not nullable", info.Field)}
+			}
+			continue
+		}
+
+		v, err := dbex.validateParametrs(newField, info)
+		if err != nil {
+			return nil, APIError{http.StatusBadRequest, err}
+		}
+		values = append(values, v)
+		columns = append(columns, info.dbName())
+		updates = append(updates, info.dbName())
+	}
+	//PUT на мягко удалённую запись восстанавливает её
+	if column := dbex.softDeleteColumn(tableInfo); column != nil {
+		if _, ok := bodyStrct[column.Field]; !ok {
+			values = append(values, nil)
+			columns = append(columns, column.dbName())
+			updates = append(updates, column.dbName())
+		}
+	}
+
+	existing, err := dbex.fetchRecord(sc, db, tableName, tableInfo, id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	args := &sqlArgs{dialect: dbex.dialect}
+	upsert := dbex.dialect.Upsert(keyNames, updates)
+	if existing != nil && upsert == "" {
+		if len(updates) == 0 {
+			return map[string]interface{}{"created": false}, nil
+		}
+		sets := make([]string, 0, len(updates))
+		for i, column := range updates {
+			sets = append(sets, dbex.dialect.Quote(column)+" = "+args.add(values[len(keys)+i]))
+		}
+		cond, err := dbex.keyCondition(tableInfo, id, args)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec("UPDATE "+dbex.quoteTable(sc, tableName)+
+			" SET "+strings.Join(sets, ", ")+" WHERE "+cond, args.values...); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"created": false}, nil
+	}
+
+	quoted := make([]string, 0, len(columns))
+	placeholders := make([]string, 0, len(columns))
+	for i, column := range columns {
+		quoted = append(quoted, dbex.dialect.Quote(column))
+		placeholders = append(placeholders, args.add(values[i]))
+	}
+	sqlReq := "INSERT INTO " + dbex.quoteTable(sc, tableName) +
+		" (" + strings.Join(quoted, ", ") + ") VALUES (" +
+		strings.Join(placeholders, ", ") + ")" + upsert
+	result, err := db.Exec(sqlReq, args.values...)
+	if err != nil {
+		return nil, err
+	}
+	//в MySQL конфликт с другой строкой по уникальному столбцу
+	//не вставляет и не меняет ничего
+	if existing == nil {
+		if n, err := result.RowsAffected(); err == nil && n == 0 {
+			return nil, APIError{http.StatusConflict,
+				fmt.Errorf("record conflicts with an existing one")}
+		}
+	}
+
+	return map[string]interface{}{
+		"created": existing == nil}, nil
+}